@@ -69,7 +69,11 @@ func PublicKey(iri vocab.IRI, prvKey *rsa.PrivateKey) vocab.PublicKey {
 }
 
 func CreateBlankActor(o *oni, id vocab.IRI) vocab.Actor {
-	blank, err := o.Control.CreateActor(id, o.pw)
+	pw := o.config().Actor(id).Password
+	if pw == "" {
+		pw = o.pw
+	}
+	blank, err := o.Control.CreateActor(id, pw)
 	if err != nil {
 		if errors.Is(err, os.ErrExist) && blank != nil {
 			return *blank
@@ -77,6 +81,6 @@ func CreateBlankActor(o *oni, id vocab.IRI) vocab.Actor {
 		o.Logger.WithContext(lw.Ctx{"err": err.Error(), "iri": id}).Warnf("unable to create root actor")
 		return auth.AnonymousActor
 	}
-	o.Logger.WithContext(lw.Ctx{"iri": id, "pw": mask.S(o.pw)}).Infof("Created new root actor")
+	o.Logger.WithContext(lw.Ctx{"iri": id, "pw": mask.S(pw)}).Infof("Created new root actor")
 	return *blank
 }
@@ -0,0 +1,37 @@
+package oni
+
+import (
+	"net/http"
+
+	"git.sr.ht/~mariusor/lw"
+	vocab "github.com/go-ap/activitypub"
+	"github.com/go-ap/auth"
+	"github.com/go-ap/errors"
+)
+
+// AdminOnly allows access only to the root actor corresponding to the request's host.
+// The actor can authorize using an OAuth2 bearer token which has the admin scope, or an HTTP signature.
+func (o *oni) AdminOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		oniActor := o.oniActor(r)
+		if oniActor.Equals(auth.AnonymousActor) {
+			o.Error(errors.NotFoundf("nothing to see here, please move along")).ServeHTTP(w, r)
+			return
+		}
+		if o.isAdminRequest(r, oniActor) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("WWW-Authenticate", `Bearer realm="`+oniActor.ID.String()+`", scope="`+ScopeAdmin+`"`)
+		o.Error(errors.Unauthorizedf("admin access requires authorization")).ServeHTTP(w, r)
+	})
+}
+
+func (o *oni) isAdminRequest(r *http.Request, oniActor vocab.Actor) bool {
+	act, err := o.loadAuthorizedActor(r, oniActor)
+	if err != nil {
+		o.Logger.WithContext(lw.Ctx{"by": oniActor.ID, "log": "auth", "err": err.Error()}).Debugf("Failed to load admin actor")
+		return false
+	}
+	return act.ID.Equals(oniActor.ID, true) && o.checkScopes(r, ScopeAdmin) == nil
+}
@@ -0,0 +1,404 @@
+package oni
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"git.sr.ht/~mariusor/lw"
+	vocab "github.com/go-ap/activitypub"
+	"github.com/go-ap/errors"
+	"github.com/go-ap/processing"
+	"github.com/openshift/osin"
+)
+
+const (
+	archiveVersion = 1
+
+	archiveManifest = "manifest.json"
+	archiveActor    = "actor.json"
+	archiveMetadata = "metadata.json"
+	archiveClients  = "clients.json"
+	archiveItems    = "items"
+	archiveMedia    = "media"
+	archiveCols     = "collections"
+)
+
+// archivedCollections are the collections of the actor which are saved to the archive.
+var archivedCollections = []vocab.CollectionPath{
+	vocab.Outbox, vocab.Followers, vocab.Following, vocab.Liked,
+	processing.BlockedCollection, FollowRequestsCollection,
+}
+
+// ArchiveManifest describes the contents of an actor archive.
+type ArchiveManifest struct {
+	Version int       `json:"version"`
+	Actor   vocab.IRI `json:"actor"`
+	Created time.Time `json:"created"`
+	// Media maps the IRIs of the objects which had their binary content extracted, to the corresponding file.
+	Media map[vocab.IRI]archivedMedia `json:"media,omitempty"`
+}
+
+type archivedMedia struct {
+	Path      string `json:"path"`
+	MediaType string `json:"mediaType"`
+}
+
+type archivedCollection struct {
+	ID    vocab.IRI  `json:"id"`
+	Items vocab.IRIs `json:"items"`
+}
+
+type archivedClient struct {
+	ID          string          `json:"id"`
+	Secret      string          `json:"secret"`
+	RedirectURI string          `json:"redirectUri"`
+	UserData    json.RawMessage `json:"userData,omitempty"`
+}
+
+func archiveName(iri vocab.IRI) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(iri)))
+}
+
+type archiveWriter struct {
+	*tar.Writer
+	c       *Control
+	modTime time.Time
+}
+
+func (a archiveWriter) add(name string, raw []byte) error {
+	hdr := &tar.Header{Name: name, Mode: 0o600, Size: int64(len(raw)), ModTime: a.modTime}
+	if err := a.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := a.Write(raw)
+	return err
+}
+
+func (a archiveWriter) addJSON(name string, v any) error {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return a.add(name, raw)
+}
+
+// addItem saves "it" to the archive, with its inline binary content moved to a separate file.
+func (a archiveWriter) addItem(it vocab.Item, m *ArchiveManifest) error {
+	raw, err := vocab.MarshalJSON(it)
+	if err != nil {
+		return err
+	}
+	name := path.Join(archiveItems, archiveName(it.GetLink())+".json")
+
+	ob, err := vocab.ToObject(it)
+	if err != nil || !contentHasBinaryData(ob.Content) {
+		return a.add(name, raw)
+	}
+	contentType, data, err := a.c.getBinData(ob.Content, ob.MediaType)
+	if err != nil {
+		return err
+	}
+	mediaName := path.Join(archiveMedia, archiveName(ob.ID))
+	if ext, _ := mime.ExtensionsByType(contentType); len(ext) > 0 {
+		mediaName += ext[0]
+	}
+	if err = a.add(mediaName, data); err != nil {
+		return err
+	}
+	m.Media[ob.ID] = archivedMedia{Path: mediaName, MediaType: contentType}
+
+	// NOTE(marius): we work on a copy, as the loaded item can be shared with the storage's cache
+	cl, err := vocab.UnmarshalJSON(raw)
+	if err != nil {
+		return err
+	}
+	_ = vocab.OnObject(cl, func(ob *vocab.Object) error {
+		ob.Content = nil
+		return nil
+	})
+	if raw, err = vocab.MarshalJSON(cl); err != nil {
+		return err
+	}
+	return a.add(name, raw)
+}
+
+func (c *Control) loadCollectionItems(colIRI vocab.IRI) (vocab.ItemCollection, error) {
+	res, err := c.Storage.Load(colIRI)
+	if err != nil {
+		return nil, err
+	}
+	items := make(vocab.ItemCollection, 0)
+	err = vocab.OnCollectionIntf(res, func(col vocab.CollectionInterface) error {
+		items = append(items, col.Collection()...)
+		return nil
+	})
+	return items, err
+}
+
+// ExportActor writes a gzipped tar archive with the actor, its collections, the items they contain,
+// its OAuth2 clients and its metadata to "w".
+func (c *Control) ExportActor(iri vocab.IRI, w io.Writer) error {
+	it, err := c.Storage.Load(iri)
+	if err != nil {
+		return errors.Annotatef(err, "unable to load actor %s", iri)
+	}
+	actor, err := vocab.ToActor(it)
+	if err != nil {
+		return errors.Annotatef(err, "invalid actor %s", iri)
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := archiveWriter{Writer: tar.NewWriter(gz), c: c, modTime: TimeNow()}
+	manifest := ArchiveManifest{Version: archiveVersion, Actor: actor.ID, Created: tw.modTime, Media: make(map[vocab.IRI]archivedMedia)}
+
+	raw, err := vocab.MarshalJSON(actor)
+	if err != nil {
+		return err
+	}
+	if err = tw.add(archiveActor, raw); err != nil {
+		return err
+	}
+
+	m := new(Metadata)
+	if err = c.Storage.LoadMetadata(actor.ID, m); err == nil {
+		if err = tw.addJSON(archiveMetadata, m); err != nil {
+			return err
+		}
+	}
+
+	saved := make(map[vocab.IRI]struct{})
+	saveItem := func(it vocab.Item) error {
+		if vocab.IsNil(it) {
+			return nil
+		}
+		if _, ok := saved[it.GetLink()]; ok {
+			return nil
+		}
+		if vocab.IsIRI(it) {
+			loaded, err := c.Storage.Load(it.GetLink())
+			if err != nil {
+				// NOTE(marius): remote items that we don't have a local copy of are kept only as IRIs in the collections
+				return nil
+			}
+			it = loaded
+		}
+		saved[it.GetLink()] = struct{}{}
+		return tw.addItem(it, &manifest)
+	}
+
+	for _, colPath := range archivedCollections {
+		colIRI := colPath.IRI(actor)
+		items, err := c.loadCollectionItems(colIRI)
+		if err != nil {
+			if !errors.IsNotFound(err) {
+				c.Logger.WithContext(lw.Ctx{"iri": colIRI, "err": err.Error()}).Warnf("Unable to load collection")
+			}
+			continue
+		}
+		col := archivedCollection{ID: colIRI, Items: make(vocab.IRIs, 0, len(items))}
+		for _, it := range items {
+			col.Items = append(col.Items, it.GetLink())
+			if err = saveItem(it); err != nil {
+				return errors.Annotatef(err, "unable to archive %s", it.GetLink())
+			}
+			// NOTE(marius): for the activities in the outbox we also save the objects they operate on
+			if colPath == vocab.Outbox {
+				err = vocab.OnActivity(it, func(act *vocab.Activity) error {
+					return saveItem(act.Object)
+				})
+				if err != nil {
+					return errors.Annotatef(err, "unable to archive object of %s", it.GetLink())
+				}
+			}
+		}
+		if err = tw.addJSON(path.Join(archiveCols, string(colPath)+".json"), col); err != nil {
+			return err
+		}
+	}
+
+	clients, err := c.actorClients(actor.ID)
+	if err != nil {
+		return err
+	}
+	if err = tw.addJSON(archiveClients, clients); err != nil {
+		return err
+	}
+	if err = tw.addJSON(archiveManifest, manifest); err != nil {
+		return err
+	}
+	if err = tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// actorClients returns the OAuth2 clients hosted under the same domain as the actor.
+func (c *Control) actorClients(iri vocab.IRI) ([]archivedClient, error) {
+	u, err := iri.URL()
+	if err != nil {
+		return nil, err
+	}
+	all, err := c.Storage.ListClients()
+	if err != nil {
+		return nil, errors.Annotatef(err, "unable to list OAuth2 clients")
+	}
+	clients := make([]archivedClient, 0)
+	for _, cl := range all {
+		cu, err := url.Parse(cl.GetId())
+		if err != nil || cu.Host != u.Host {
+			continue
+		}
+		ac := archivedClient{ID: cl.GetId(), Secret: cl.GetSecret(), RedirectURI: cl.GetRedirectUri()}
+		switch ud := cl.GetUserData().(type) {
+		case []byte:
+			if json.Valid(ud) {
+				ac.UserData = ud
+			}
+		case json.RawMessage:
+			ac.UserData = ud
+		case nil:
+		default:
+			ac.UserData, _ = json.Marshal(fmt.Sprintf("%s", ud))
+		}
+		clients = append(clients, ac)
+	}
+	return clients, nil
+}
+
+// ImportActor rebuilds an actor exported with ExportActor into the current storage.
+func (c *Control) ImportActor(r io.Reader) (*vocab.Actor, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, errors.Annotatef(err, "invalid archive")
+	}
+	defer gz.Close()
+
+	files := make(map[string][]byte)
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Annotatef(err, "unable to read archive")
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		buf := bytes.Buffer{}
+		if _, err = io.Copy(&buf, tr); err != nil {
+			return nil, errors.Annotatef(err, "unable to read %s from archive", hdr.Name)
+		}
+		files[hdr.Name] = buf.Bytes()
+	}
+
+	manifest := ArchiveManifest{}
+	if err = json.Unmarshal(files[archiveManifest], &manifest); err != nil {
+		return nil, errors.Annotatef(err, "invalid archive manifest")
+	}
+	if manifest.Version != archiveVersion {
+		return nil, errors.Newf("unsupported archive version %d", manifest.Version)
+	}
+
+	it, err := vocab.UnmarshalJSON(files[archiveActor])
+	if err != nil {
+		return nil, errors.Annotatef(err, "invalid actor in archive")
+	}
+	actor, err := vocab.ToActor(it)
+	if err != nil {
+		return nil, errors.Annotatef(err, "invalid actor in archive")
+	}
+	if _, err = c.Storage.Save(actor); err != nil {
+		return nil, errors.Annotatef(err, "unable to save actor %s", actor.ID)
+	}
+
+	if raw, ok := files[archiveMetadata]; ok {
+		m := new(Metadata)
+		if err = json.Unmarshal(raw, m); err != nil {
+			return nil, errors.Annotatef(err, "invalid actor metadata in archive")
+		}
+		if err = c.Storage.SaveMetadata(actor.ID, m); err != nil {
+			return nil, errors.Annotatef(err, "unable to save actor metadata")
+		}
+	}
+
+	for name, raw := range files {
+		if !strings.HasPrefix(name, archiveItems+"/") {
+			continue
+		}
+		it, err := vocab.UnmarshalJSON(raw)
+		if err != nil {
+			c.Logger.WithContext(lw.Ctx{"file": name, "err": err.Error()}).Warnf("Invalid item in archive")
+			continue
+		}
+		if media, ok := manifest.Media[it.GetLink()]; ok {
+			data, ok := files[media.Path]
+			if !ok {
+				return nil, errors.Newf("missing media file %s for %s", media.Path, it.GetLink())
+			}
+			err = vocab.OnObject(it, func(ob *vocab.Object) error {
+				return c.saveMedia(ob, media.MediaType, bytes.NewReader(data))
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+		if _, err = c.Storage.Save(it); err != nil {
+			return nil, errors.Annotatef(err, "unable to save %s", it.GetLink())
+		}
+	}
+
+	for _, colPath := range archivedCollections {
+		raw, ok := files[path.Join(archiveCols, string(colPath)+".json")]
+		if !ok {
+			continue
+		}
+		col := archivedCollection{}
+		if err = json.Unmarshal(raw, &col); err != nil {
+			return nil, errors.Annotatef(err, "invalid %s collection in archive", colPath)
+		}
+		if err = c.ensureCollection(col.ID, actor); err != nil {
+			return nil, errors.Annotatef(err, "unable to save collection %s", col.ID)
+		}
+		existing, _ := c.loadCollectionItems(col.ID)
+		for _, iri := range col.Items {
+			if existing.Contains(iri) {
+				continue
+			}
+			if err = c.Storage.AddTo(col.ID, iri); err != nil {
+				return nil, errors.Annotatef(err, "unable to add %s to collection %s", iri, col.ID)
+			}
+		}
+	}
+
+	if raw, ok := files[archiveClients]; ok {
+		clients := make([]archivedClient, 0)
+		if err = json.Unmarshal(raw, &clients); err != nil {
+			return nil, errors.Annotatef(err, "invalid OAuth2 clients in archive")
+		}
+		for _, ac := range clients {
+			cl := &osin.DefaultClient{Id: ac.ID, Secret: ac.Secret, RedirectUri: ac.RedirectURI}
+			iri := vocab.EmptyIRI
+			if err = json.Unmarshal(ac.UserData, &iri); err == nil {
+				cl.UserData = iri
+			} else if len(ac.UserData) > 0 {
+				cl.UserData = []byte(ac.UserData)
+			}
+			if err = c.Storage.SaveClient(cl); err != nil {
+				return nil, errors.Annotatef(err, "unable to save OAuth2 client %s", ac.ID)
+			}
+		}
+	}
+	return actor, nil
+}
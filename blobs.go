@@ -0,0 +1,309 @@
+package oni
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+
+	"git.sr.ht/~mariusor/lw"
+	ct "github.com/elnormous/contenttype"
+	vocab "github.com/go-ap/activitypub"
+	"github.com/go-ap/errors"
+)
+
+const (
+	blobsDir = "blobs"
+
+	// blobRefPrefix is the prefix of the RFC 6920 Named Information URIs which replace
+	// the data URIs in the content of the media objects.
+	blobRefPrefix = "ni:///sha-256;"
+)
+
+// BlobStore keeps the media files under the storage path, named after the SHA-256 sum of their contents,
+// so files uploaded multiple times are stored only once.
+type BlobStore struct {
+	path string
+}
+
+func (c *Control) Blobs() BlobStore {
+	return BlobStore{path: filepath.Join(c.StoragePath, blobsDir)}
+}
+
+func isBlobRef(val []byte) bool {
+	return bytes.HasPrefix(val, []byte(blobRefPrefix))
+}
+
+func blobKey(ref []byte) (string, error) {
+	if !isBlobRef(ref) {
+		return "", errors.Newf("invalid blob reference %q", ref)
+	}
+	sum, err := base64.RawURLEncoding.DecodeString(string(ref[len(blobRefPrefix):]))
+	if err != nil || len(sum) != sha256.Size {
+		return "", errors.Newf("invalid blob reference %q", ref)
+	}
+	return hex.EncodeToString(sum), nil
+}
+
+func (b BlobStore) file(key string) string {
+	return filepath.Join(b.path, key[:2], key)
+}
+
+// Put stores the contents of "r", and returns the reference to be used in the content of the media object.
+func (b BlobStore) Put(r io.Reader) (string, error) {
+	if err := os.MkdirAll(b.path, 0700); err != nil {
+		return "", err
+	}
+	tmp, err := os.CreateTemp(b.path, ".upload-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+
+	h := sha256.New()
+	if _, err = io.Copy(io.MultiWriter(tmp, h), r); err != nil {
+		_ = tmp.Close()
+		return "", err
+	}
+	if err = tmp.Close(); err != nil {
+		return "", err
+	}
+
+	sum := h.Sum(nil)
+	dst := b.file(hex.EncodeToString(sum))
+	if _, err = os.Stat(dst); err != nil {
+		if err = os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+			return "", err
+		}
+		if err = os.Rename(tmp.Name(), dst); err != nil {
+			return "", err
+		}
+	}
+	return blobRefPrefix + base64.RawURLEncoding.EncodeToString(sum), nil
+}
+
+// Open returns the file corresponding to the "ref" blob reference.
+func (b BlobStore) Open(ref []byte) (*os.File, error) {
+	key, err := blobKey(ref)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(b.file(key))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, errors.NotFoundf("blob %s not found", key)
+		}
+		return nil, err
+	}
+	return f, nil
+}
+
+// saveMedia stores the data from "r" in the blob store, and replaces the content of "ob" with the reference to it.
+// The metadata of the JPEG and PNG images is removed before storing them.
+func (c *Control) saveMedia(ob *vocab.Object, mediaType string, r io.Reader) error {
+	if mt, err := ct.ParseMediaType(mediaType); err == nil && (mt.Matches(imageJpeg) || mt.Matches(imagePng)) {
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		if data, err = sanitizeImage(mt, data); err != nil {
+			return errors.Annotatef(err, "invalid image")
+		}
+		r = bytes.NewReader(data)
+	}
+	ref, err := c.Blobs().Put(r)
+	if err != nil {
+		return errors.Annotatef(err, "unable to store media")
+	}
+	ob.Content = DefaultValue(ref)
+	if mediaType != "" {
+		ob.MediaType = vocab.MimeType(mediaType)
+	}
+	return nil
+}
+
+// storeMedia moves the data URIs from the content of "it", and of the objects embedded in it, to the blob store.
+// It returns if anything has been changed.
+func (c *Control) storeMedia(it vocab.Item) (bool, error) {
+	if vocab.IsNil(it) || vocab.IsIRI(it) {
+		return false, nil
+	}
+	changed := false
+	var err error
+	if vocab.IsItemCollection(it) {
+		err = vocab.OnItemCollection(it, func(col *vocab.ItemCollection) error {
+			for _, ob := range *col {
+				ch, err := c.storeMedia(ob)
+				if err != nil {
+					return err
+				}
+				changed = changed || ch
+			}
+			return nil
+		})
+		return changed, err
+	}
+	if vocab.ActivityTypes.Match(it.GetType()) {
+		err = vocab.OnActivity(it, func(act *vocab.Activity) error {
+			changed, err = c.storeMedia(act.Object)
+			return err
+		})
+		return changed, err
+	}
+	err = vocab.OnObject(it, func(ob *vocab.Object) error {
+		if val := ob.Content.First(); bytes.HasPrefix(val, []byte("data:")) {
+			typ, r := dataURIReader(val, ob.MediaType)
+			if err := c.saveMedia(ob, typ, r); err != nil {
+				return err
+			}
+			changed = true
+		}
+		for _, embedded := range []vocab.Item{ob.Attachment, ob.Icon, ob.Image, ob.Preview} {
+			ch, err := c.storeMedia(embedded)
+			if err != nil {
+				return err
+			}
+			changed = changed || ch
+		}
+		return nil
+	})
+	return changed, err
+}
+
+// blobRefs returns the blob references from the content of "it", and of the objects embedded in it.
+func blobRefs(it vocab.Item) [][]byte {
+	refs := make([][]byte, 0)
+	if vocab.IsNil(it) || vocab.IsIRI(it) {
+		return refs
+	}
+	if vocab.IsItemCollection(it) {
+		_ = vocab.OnItemCollection(it, func(col *vocab.ItemCollection) error {
+			for _, ob := range *col {
+				refs = append(refs, blobRefs(ob)...)
+			}
+			return nil
+		})
+		return refs
+	}
+	_ = vocab.OnObject(it, func(ob *vocab.Object) error {
+		if val := ob.Content.First(); isBlobRef(val) {
+			refs = append(refs, val)
+		}
+		for _, embedded := range []vocab.Item{ob.Attachment, ob.Icon, ob.Image, ob.Preview} {
+			refs = append(refs, blobRefs(embedded)...)
+		}
+		return nil
+	})
+	return refs
+}
+
+type nopSeekCloser struct {
+	io.ReadSeeker
+}
+
+func (nopSeekCloser) Close() error {
+	return nil
+}
+
+// binDataReader returns the content type and a reader for the binary content of a media object,
+// which can be either a reference to the blob store or a data URI.
+func (c *Control) binDataReader(nlVal vocab.NaturalLanguageValues, mt vocab.MimeType) (string, io.ReadSeekCloser, error) {
+	val := nlVal.First()
+	if !isBlobRef(val) {
+		typ, r := dataURIReader(val, mt)
+		return typ, nopSeekCloser{r}, nil
+	}
+	contentType := "application/octet-stream"
+	if mt != "" {
+		contentType = string(mt)
+	}
+	f, err := c.Blobs().Open(val)
+	if err != nil {
+		return contentType, nil, err
+	}
+	return contentType, f, nil
+}
+
+func (c *Control) getBinData(nlVal vocab.NaturalLanguageValues, mt vocab.MimeType) (string, []byte, error) {
+	contentType, r, err := c.binDataReader(nlVal, mt)
+	if err != nil {
+		return contentType, nil, err
+	}
+	defer r.Close()
+	raw, err := io.ReadAll(r)
+	return contentType, raw, err
+}
+
+// ExtractMedia moves the data URIs from the content of the "actors", and of the items in their collections,
+// to the blob store.
+func (c *Control) ExtractMedia(actors ...vocab.Item) (int, error) {
+	count := 0
+	seen := make(map[vocab.IRI]struct{})
+
+	var extract func(iri vocab.IRI) error
+	extract = func(iri vocab.IRI) error {
+		if _, ok := seen[iri]; ok {
+			return nil
+		}
+		seen[iri] = struct{}{}
+
+		it, err := c.Storage.Load(iri)
+		if err != nil {
+			return nil
+		}
+		changed, err := c.storeMedia(it)
+		if err != nil {
+			return errors.Annotatef(err, "unable to extract media from %s", iri)
+		}
+		if changed {
+			if _, err = c.Storage.Save(it); err != nil {
+				return errors.Annotatef(err, "unable to save %s", iri)
+			}
+			c.Logger.WithContext(lw.Ctx{"iri": iri}).Debugf("Extracted media")
+			count++
+		}
+		// NOTE(marius): the objects and attachments referenced by IRI are stored separately
+		refs := make(vocab.IRIs, 0)
+		if vocab.ActivityTypes.Match(it.GetType()) {
+			_ = vocab.OnActivity(it, func(act *vocab.Activity) error {
+				refs = append(refs, itemIRIs(act.Object)...)
+				return nil
+			})
+		}
+		_ = vocab.OnObject(it, func(ob *vocab.Object) error {
+			refs = append(refs, itemIRIs(ob.Attachment, ob.Icon, ob.Image, ob.Preview)...)
+			return nil
+		})
+		for _, ref := range refs {
+			if err = extract(ref); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for _, it := range actors {
+		actor, err := vocab.ToActor(it)
+		if err != nil {
+			continue
+		}
+		if err = extract(actor.ID); err != nil {
+			return count, err
+		}
+		for _, colIRI := range (vocab.IRIs{vocab.Outbox.IRI(actor), vocab.Inbox.IRI(actor), vocab.Liked.IRI(actor)}) {
+			items, err := c.loadCollectionItems(colIRI)
+			if err != nil {
+				continue
+			}
+			for _, it := range items {
+				if err = extract(it.GetLink()); err != nil {
+					return count, err
+				}
+			}
+		}
+	}
+	return count, nil
+}
@@ -0,0 +1,295 @@
+package oni
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+
+	vocab "github.com/go-ap/activitypub"
+	"github.com/go-ap/errors"
+	"github.com/go-ap/processing"
+)
+
+// Problem is an inconsistency found in storage by the integrity check.
+type Problem struct {
+	IRI     vocab.IRI
+	Message string
+	Fixed   bool
+}
+
+func (p Problem) String() string {
+	status := "found"
+	if p.Fixed {
+		status = "fixed"
+	}
+	return fmt.Sprintf("%s: %s: %s", status, p.IRI, p.Message)
+}
+
+// checker walks the collections of the root actors looking for inconsistencies,
+// and repairs them if "repair" is set.
+type checker struct {
+	c       *Control
+	repair  bool
+	checked map[vocab.IRI]struct{}
+
+	Problems []Problem
+}
+
+func (k *checker) report(iri vocab.IRI, fix func() error, format string, args ...any) {
+	p := Problem{IRI: iri, Message: fmt.Sprintf(format, args...)}
+	if k.repair && fix != nil {
+		if err := fix(); err != nil {
+			p.Message += fmt.Sprintf(" (unable to fix: %s)", err)
+		} else {
+			p.Fixed = true
+		}
+	}
+	k.Problems = append(k.Problems, p)
+}
+
+// RootActors returns the actors which have OAuth2 clients, and are served from the root of their host.
+func (c *Control) RootActors() (vocab.ItemCollection, error) {
+	clients, err := c.Storage.ListClients()
+	if err != nil {
+		return nil, errors.Annotatef(err, "unable to list OAuth2 clients")
+	}
+	actors := make(vocab.ItemCollection, 0)
+	for _, cl := range clients {
+		iri := vocab.IRI(cl.GetId())
+		if p, ok := IRIPath(iri); !ok || p != "/" {
+			continue
+		}
+		it, err := c.Storage.Load(iri)
+		if err != nil {
+			continue
+		}
+		if vocab.ActorTypes.Match(it.GetType()) {
+			actors = append(actors, it)
+		}
+	}
+	return actors, nil
+}
+
+func publicKeyPem(prv crypto.PrivateKey) (string, error) {
+	signer, ok := prv.(crypto.Signer)
+	if !ok {
+		return "", errors.Newf("unsupported private key type %T", prv)
+	}
+	pubEnc, err := x509.MarshalPKIXPublicKey(signer.Public())
+	if err != nil {
+		return "", err
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubEnc})), nil
+}
+
+func (k *checker) checkKey(actor *vocab.Actor) {
+	m := new(Metadata)
+	if err := k.c.Storage.LoadMetadata(actor.ID, m); err != nil || m.PrivateKey == nil {
+		k.report(actor.ID, nil, "actor has no private key, it can be generated with the rotate-key command")
+		return
+	}
+	block, _ := pem.Decode(m.PrivateKey)
+	if block == nil {
+		k.report(actor.ID, nil, "invalid private key encoding")
+		return
+	}
+	prv, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		k.report(actor.ID, nil, "invalid private key: %s", err)
+		return
+	}
+	expected, err := publicKeyPem(prv)
+	if err != nil {
+		k.report(actor.ID, nil, "invalid private key: %s", err)
+		return
+	}
+
+	if block, _ = pem.Decode([]byte(actor.PublicKey.PublicKeyPem)); block != nil {
+		pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if eq, ok := pub.(interface{ Equal(crypto.PublicKey) bool }); err == nil && ok && eq.Equal(prv.(crypto.Signer).Public()) {
+			return
+		}
+	}
+	k.report(actor.ID, func() error {
+		// NOTE(marius): remote servers might have cached the old public key,
+		// so the repaired actor should be disseminated with the rotate-key command if it was in use.
+		actor.PublicKey = vocab.PublicKey{
+			ID:           vocab.IRI(fmt.Sprintf("%s#main", actor.ID)),
+			Owner:        actor.ID,
+			PublicKeyPem: expected,
+		}
+		_, err := k.c.Storage.Save(actor)
+		return err
+	}, "actor's public key doesn't match the private key")
+}
+
+// mustExist returns if the members of collection "col" are expected to be in storage:
+// activities in inboxes and outboxes are always saved, for the other collections only the local items.
+func mustExist(col, member vocab.IRI, actor *vocab.Actor) bool {
+	if vocab.Inbox.IRI(actor).Equals(col, false) || vocab.Outbox.IRI(actor).Equals(col, false) {
+		return true
+	}
+	return member.Contains(actor.ID, false)
+}
+
+func (k *checker) checkCollection(colIRI vocab.IRI, actor *vocab.Actor) vocab.ItemCollection {
+	if _, ok := k.checked[colIRI]; ok {
+		return nil
+	}
+	k.checked[colIRI] = struct{}{}
+
+	it, err := k.c.Storage.Load(colIRI)
+	if err != nil {
+		if !errors.IsNotFound(err) {
+			k.report(colIRI, nil, "unable to load collection: %s", err)
+		}
+		return nil
+	}
+
+	var items vocab.ItemCollection
+	var total *uint
+	switch {
+	case orderedCollectionTypes.Match(it.GetType()):
+		err = vocab.OnOrderedCollection(it, func(col *vocab.OrderedCollection) error {
+			items, total = col.OrderedItems, &col.TotalItems
+			col.OrderedItems = nil
+			return nil
+		})
+	case collectionTypes.Match(it.GetType()):
+		err = vocab.OnCollection(it, func(col *vocab.Collection) error {
+			items, total = col.Items, &col.TotalItems
+			col.Items = nil
+			return nil
+		})
+	default:
+		err = errors.Newf("unexpected type %s", typeToString(it.GetType()))
+	}
+	if err != nil {
+		k.report(colIRI, nil, "invalid collection: %s", err)
+		return nil
+	}
+
+	valid := make(vocab.ItemCollection, 0, len(items))
+	for _, member := range items {
+		iri := member.GetLink()
+		if _, err = k.c.Storage.Load(iri); err == nil || !errors.IsNotFound(err) || !mustExist(colIRI, iri, actor) {
+			valid = append(valid, member)
+			continue
+		}
+		k.report(colIRI, func() error {
+			return k.c.Storage.RemoveFrom(colIRI, iri)
+		}, "member %s doesn't exist", iri)
+	}
+
+	if *total != uint(len(items)) {
+		k.report(colIRI, func() error {
+			// NOTE(marius): the items have been removed from the collection object above,
+			// as, like in tryCreateCollection, we only want to update the totalItems property.
+			*total = uint(len(valid))
+			_, err := k.c.Storage.Save(it)
+			return err
+		}, "totalItems is %d, but the collection has %d members", *total, len(items))
+	}
+	return valid
+}
+
+// checkActivity looks for activities whose local object has been removed without leaving a Tombstone behind.
+func (k *checker) checkActivity(it vocab.Item, actor *vocab.Actor) {
+	act, err := vocab.ToActivity(it)
+	if err != nil || vocab.IsNil(act.Object) || act.Type == vocab.DeleteType {
+		return
+	}
+	obIRI := act.Object.GetLink()
+	if !obIRI.Contains(actor.ID, false) {
+		return
+	}
+	if _, err = k.c.Storage.Load(obIRI); !errors.IsNotFound(err) {
+		return
+	}
+	k.report(act.ID, func() error {
+		tomb := vocab.Tombstone{ID: obIRI, Type: vocab.TombstoneType, Deleted: TimeNow()}
+		if vocab.IsObject(act.Object) {
+			tomb.FormerType = act.Object.GetType()
+		}
+		_, err := k.c.Storage.Save(tomb)
+		return err
+	}, "object %s has been removed without a Tombstone", obIRI)
+}
+
+func (k *checker) checkActor(actor *vocab.Actor) {
+	k.checkKey(actor)
+
+	collections := vocab.IRIs{
+		vocab.Inbox.IRI(actor), vocab.Outbox.IRI(actor), vocab.Followers.IRI(actor),
+		vocab.Following.IRI(actor), vocab.Liked.IRI(actor), processing.BlockedCollection.IRI(actor),
+		processing.IgnoredCollection.IRI(actor), FollowRequestsCollection.IRI(actor),
+	}
+	for _, colIRI := range collections {
+		for _, member := range k.checkCollection(colIRI, actor) {
+			it, err := k.c.Storage.Load(member.GetLink())
+			if err != nil {
+				continue
+			}
+			objects := vocab.ItemCollection{it}
+			if vocab.ActivityTypes.Match(it.GetType()) {
+				k.checkActivity(it, actor)
+				_ = vocab.OnActivity(it, func(act *vocab.Activity) error {
+					if vocab.IsNil(act.Object) {
+						return nil
+					}
+					if ob, err := k.c.Storage.Load(act.Object.GetLink()); err == nil {
+						objects = append(objects, ob)
+					}
+					return nil
+				})
+			}
+			// NOTE(marius): the replies, likes and shares collections of the actor's objects
+			for _, it := range objects {
+				_ = vocab.OnObject(it, func(ob *vocab.Object) error {
+					for _, col := range []vocab.Item{ob.Replies, ob.Likes, ob.Shares} {
+						if !vocab.IsNil(col) && col.GetLink().Contains(actor.ID, false) {
+							k.checkCollection(col.GetLink(), actor)
+						}
+					}
+					return nil
+				})
+			}
+		}
+	}
+}
+
+func (k *checker) checkClients() error {
+	clients, err := k.c.Storage.ListClients()
+	if err != nil {
+		return errors.Annotatef(err, "unable to list OAuth2 clients")
+	}
+	for _, cl := range clients {
+		id := cl.GetId()
+		if _, err = k.c.Storage.Load(vocab.IRI(id)); !errors.IsNotFound(err) {
+			continue
+		}
+		k.report(vocab.IRI(id), func() error {
+			return k.c.Storage.RemoveClient(id)
+		}, "OAuth2 client has no actor")
+	}
+	return nil
+}
+
+// Check verifies the consistency of the storage for the root "actors", and the OAuth2 clients.
+// When "repair" is true, the problems which can be fixed automatically are repaired.
+func (c *Control) Check(repair bool, actors ...vocab.Item) ([]Problem, error) {
+	k := checker{c: c, repair: repair, checked: make(map[vocab.IRI]struct{})}
+	for _, it := range actors {
+		actor, err := vocab.ToActor(it)
+		if err != nil {
+			k.report(it.GetLink(), nil, "invalid actor: %s", err)
+			continue
+		}
+		k.checkActor(actor)
+	}
+	if err := k.checkClients(); err != nil {
+		return k.Problems, err
+	}
+	return k.Problems, nil
+}
@@ -0,0 +1,258 @@
+package oni
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+
+	"git.sr.ht/~mariusor/lw"
+	vocab "github.com/go-ap/activitypub"
+	"github.com/go-ap/errors"
+	"github.com/go-ap/processing"
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/openshift/osin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ClientInformationResponse is the RFC 7592 response with the registered metadata of a client,
+// and with the token and URI the client can use to manage its registration.
+//
+// https://datatracker.ietf.org/doc/html/rfc7592#section-3
+type ClientInformationResponse struct {
+	ClientRegistrationResponse
+	ClientRegistrationRequest
+
+	RegistrationAccessToken string `json:"registration_access_token,omitempty"`
+	RegistrationClientURI   string `json:"registration_client_uri,omitempty"`
+}
+
+// registrationClientURI returns the RFC 7592 client configuration end-point for the client actor with "clientID".
+func registrationClientURI(self vocab.Item, clientID vocab.IRI) vocab.IRI {
+	return self.GetLink().AddPath("oauth/client").AddPath(path.Base(clientID.String()))
+}
+
+// newRegistrationToken generates the registration access token for the client actor with "iri", and saves its hash.
+func (c *Control) newRegistrationToken(iri vocab.IRI) (string, error) {
+	tok := GenerateSecret()
+	hash, err := HashSecret(tok)
+	if err != nil {
+		return "", err
+	}
+	m := new(Metadata)
+	if err = c.Storage.LoadMetadata(iri, m); err != nil && !errors.IsNotFound(err) {
+		return "", err
+	}
+	m.RegistrationToken = []byte(hash)
+	return tok, c.Storage.SaveMetadata(iri, m)
+}
+
+func (c *Control) checkRegistrationToken(iri vocab.IRI, tok string) bool {
+	m := new(Metadata)
+	if err := c.Storage.LoadMetadata(iri, m); err != nil || len(m.RegistrationToken) == 0 {
+		return false
+	}
+	return bcrypt.CompareHashAndPassword(m.RegistrationToken, []byte(tok)) == nil
+}
+
+// processOutbox processes the activity of type "typ" with "ob" as object, in the outbox of "author".
+func (c *Control) processOutbox(author vocab.Actor, typ vocab.ActivityVocabularyType, ob vocab.Item) error {
+	act := vocab.Activity{
+		Type:         typ,
+		To:           vocab.ItemCollection{vocab.PublicNS},
+		CC:           vocab.ItemCollection{author.GetLink()},
+		AttributedTo: author.GetLink(),
+		Actor:        author,
+		Updated:      TimeNow(),
+		Object:       ob,
+	}
+
+	lwCtx := lw.Ctx{"op": strings.ToLower(string(typ))}
+	ap := processing.New(
+		processing.WithLogger(c.Logger.WithContext(lwCtx)),
+		processing.WithClient(c.Client(author, lwCtx)),
+		processing.WithStorage(c.Storage),
+		processing.WithIDGenerator(GenerateID),
+		processing.WithIRI(author.ID),
+	)
+	_, err := ap.ProcessClientActivity(act, author, vocab.Outbox.IRI(author))
+	return err
+}
+
+// registeredMetadata returns the metadata the client was registered with, which we keep in its user data.
+func registeredMetadata(cl osin.Client) ClientRegistrationRequest {
+	regReq := ClientRegistrationRequest{}
+	var raw []byte
+	switch ud := cl.GetUserData().(type) {
+	case []byte:
+		raw = ud
+	case json.RawMessage:
+		raw = ud
+	case string:
+		raw = []byte(ud)
+	}
+	if len(raw) > 0 {
+		_ = json.Unmarshal(raw, &regReq)
+	}
+	return regReq
+}
+
+func unauthorizedClient(w http.ResponseWriter) error {
+	w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+	return errors.Unauthorizedf("invalid registration access token")
+}
+
+// loadManagedClient loads the client actor and OAuth2 client the RFC 7592 request is made for.
+// The request needs to be authorized with the registration access token which was returned when registering the client.
+func (o *oni) loadManagedClient(w http.ResponseWriter, r *http.Request, self vocab.Actor) (*vocab.Actor, osin.Client, error) {
+	id, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		return nil, nil, errors.NotFoundf("not found")
+	}
+	iri := self.GetLink().AddPath("client").AddPath(id.String())
+
+	// NOTE(marius): we don't let the clients without a valid token find out if a client exists
+	tok := bearerToken(r)
+	if tok == "" || !o.checkRegistrationToken(iri, tok) {
+		return nil, nil, unauthorizedClient(w)
+	}
+	cl, err := o.Storage.GetClient(iri.String())
+	if err != nil || cl == nil {
+		return nil, nil, unauthorizedClient(w)
+	}
+	it, err := o.Storage.Load(iri)
+	if err != nil {
+		return nil, nil, err
+	}
+	clientActor, err := vocab.ToActor(it)
+	if err != nil {
+		return nil, nil, unauthorizedClient(w)
+	}
+	return clientActor, cl, nil
+}
+
+func (o *oni) writeClientInformation(w http.ResponseWriter, r *http.Request, self vocab.Actor, clientActor *vocab.Actor, cl osin.Client) {
+	resp := ClientInformationResponse{
+		ClientRegistrationResponse: ClientRegistrationResponse{
+			ClientID: cl.GetId(),
+			IssuedAt: clientActor.Published.Unix(),
+		},
+		ClientRegistrationRequest: registeredMetadata(cl),
+		RegistrationAccessToken:   bearerToken(r),
+		RegistrationClientURI:     registrationClientURI(self, clientActor.ID).String(),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// ReadClientConfiguration returns the registered metadata of a client.
+//
+// https://datatracker.ietf.org/doc/html/rfc7592#section-2.1
+func (o *oni) ReadClientConfiguration(w http.ResponseWriter, r *http.Request) {
+	self := o.oniActor(r)
+	clientActor, cl, err := o.loadManagedClient(w, r, self)
+	if err != nil {
+		o.Error(err).ServeHTTP(w, r)
+		return
+	}
+	o.writeClientInformation(w, r, self, clientActor, cl)
+}
+
+// UpdateClientConfiguration replaces the registered metadata of a client, and updates its Application actor
+// with the new name, logo and URLs.
+//
+// https://datatracker.ietf.org/doc/html/rfc7592#section-2.2
+func (o *oni) UpdateClientConfiguration(w http.ResponseWriter, r *http.Request) {
+	self := o.oniActor(r)
+	clientActor, cl, err := o.loadManagedClient(w, r, self)
+	if err != nil {
+		o.Error(err).ServeHTTP(w, r)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		o.Error(errors.NewBadRequest(err, "unable to read request body")).ServeHTTP(w, r)
+		return
+	}
+	regReq := ClientRegistrationRequest{}
+	if err = json.Unmarshal(body, &regReq); err != nil {
+		o.Error(errors.NewBadRequest(err, "invalid RFC7592 payload")).ServeHTTP(w, r)
+		return
+	}
+	ident := struct {
+		ClientID string `json:"client_id"`
+	}{}
+	_ = json.Unmarshal(body, &ident)
+	if ident.ClientID != cl.GetId() {
+		o.Error(errors.BadRequestf("client_id doesn't match the client being updated")).ServeHTTP(w, r)
+		return
+	}
+	name, urls, redirect := regReq.clientURLs()
+	if len(redirect) == 0 {
+		o.Error(errors.BadRequestf("invalid redirect URIs")).ServeHTTP(w, r)
+		return
+	}
+
+	clientActor.PreferredUsername = vocab.DefaultNaturalLanguage(name)
+	clientActor.URL = urls
+	clientActor.Icon = nil
+	if regReq.LogoURI != "" {
+		clientActor.Icon = vocab.IRI(regReq.LogoURI)
+	}
+	clientActor.Updated = TimeNow()
+	if err = o.processOutbox(self, vocab.UpdateType, clientActor); err != nil {
+		o.Error(errors.Annotatef(err, "unable to update the client actor")).ServeHTTP(w, r)
+		return
+	}
+
+	userData, _ := json.Marshal(regReq)
+	updated := &osin.DefaultClient{
+		Id:          cl.GetId(),
+		Secret:      cl.GetSecret(),
+		RedirectUri: strings.Join(redirect, "\n"),
+		UserData:    userData,
+	}
+	if err = o.Storage.SaveClient(updated); err != nil {
+		o.Error(errors.Annotatef(err, "unable to save OAuth2 client application")).ServeHTTP(w, r)
+		return
+	}
+	o.Logger.WithContext(lw.Ctx{"client": cl.GetId()}).Infof("Updated OAuth2 client registration")
+	o.writeClientInformation(w, r, self, clientActor, updated)
+}
+
+// DeleteClientConfiguration removes the client, replaces its Application actor with a Tombstone,
+// and revokes the tokens issued to it.
+//
+// https://datatracker.ietf.org/doc/html/rfc7592#section-2.3
+func (o *oni) DeleteClientConfiguration(w http.ResponseWriter, r *http.Request) {
+	self := o.oniActor(r)
+	clientActor, cl, err := o.loadManagedClient(w, r, self)
+	if err != nil {
+		o.Error(err).ServeHTTP(w, r)
+		return
+	}
+
+	lctx := lw.Ctx{"client": cl.GetId()}
+	cnt, err := o.RevokeClient(cl.GetId())
+	if err != nil {
+		if !errors.IsNotImplemented(err) {
+			o.Error(err).ServeHTTP(w, r)
+			return
+		}
+		// NOTE(marius): a storage backend which can't list the tokens shouldn't keep the client from being removed
+		o.Logger.WithContext(lctx, lw.Ctx{"err": err.Error()}).Warnf("Unable to revoke the client tokens")
+	}
+	if err = o.Storage.RemoveClient(cl.GetId()); err != nil {
+		o.Error(errors.Annotatef(err, "unable to remove OAuth2 client application")).ServeHTTP(w, r)
+		return
+	}
+	if err = o.processOutbox(self, vocab.DeleteType, clientActor); err != nil {
+		o.Logger.WithContext(lctx, lw.Ctx{"err": err.Error()}).Warnf("Unable to delete the client actor")
+	}
+	o.Logger.WithContext(lctx, lw.Ctx{"tokens": cnt}).Infof("Deleted OAuth2 client registration")
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,112 @@
+package oni
+
+import (
+	"crypto/subtle"
+
+	"git.sr.ht/~mariusor/lw"
+	"git.sr.ht/~mariusor/storage-all"
+	"github.com/openshift/osin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// HashSecret returns the bcrypt hash of an OAuth2 client secret, which is what gets saved in the storage.
+// The public clients don't have a secret, and for them the result is empty.
+func HashSecret(secret string) (string, error) {
+	if secret == "" {
+		return "", nil
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(secret), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+func isHashedSecret(secret string) bool {
+	_, err := bcrypt.Cost([]byte(secret))
+	return err == nil
+}
+
+// HashedClient is an OAuth2 client application whose secret is stored as a bcrypt hash.
+type HashedClient struct {
+	osin.DefaultClient
+
+	// migrate saves the client, after its plaintext secret has been replaced with the hash.
+	migrate func(osin.Client) error
+}
+
+// ClientSecretMatches checks the secret against the hash.
+// NOTE(marius): the clients saved before we hashed the secrets have them in plaintext, and when they match
+// we replace them with their hash.
+func (c *HashedClient) ClientSecretMatches(secret string) bool {
+	if isHashedSecret(c.Secret) {
+		return bcrypt.CompareHashAndPassword([]byte(c.Secret), []byte(secret)) == nil
+	}
+	if subtle.ConstantTimeCompare([]byte(c.Secret), []byte(secret)) != 1 {
+		return false
+	}
+	if secret != "" && c.migrate != nil {
+		if hash, err := HashSecret(secret); err == nil {
+			toSave := c.DefaultClient
+			toSave.Secret = hash
+			if err = c.migrate(&toSave); err == nil {
+				c.Secret = hash
+			}
+		}
+	}
+	return true
+}
+
+// clientStorage is the storage used by the OAuth2 server, which loads the clients as HashedClient.
+type clientStorage struct {
+	storage.FullStorage
+	l lw.Logger
+}
+
+func (s clientStorage) Clone() osin.Storage {
+	return s
+}
+
+func (s clientStorage) GetClient(id string) (osin.Client, error) {
+	cl, err := s.FullStorage.GetClient(id)
+	if err != nil || cl == nil {
+		return cl, err
+	}
+	hc := HashedClient{
+		DefaultClient: osin.DefaultClient{
+			Id:          cl.GetId(),
+			Secret:      cl.GetSecret(),
+			RedirectUri: cl.GetRedirectUri(),
+			UserData:    cl.GetUserData(),
+		},
+		migrate: s.migrate,
+	}
+	return &hc, nil
+}
+
+func (s clientStorage) migrate(cl osin.Client) error {
+	lctx := lw.Ctx{"client": cl.GetId()}
+	if err := s.FullStorage.SaveClient(cl); err != nil {
+		s.l.WithContext(lctx, lw.Ctx{"err": err.Error()}).Warnf("Unable to save the hashed OAuth2 client secret")
+		return err
+	}
+	s.l.WithContext(lctx).Infof("Hashed the plaintext OAuth2 client secret")
+	return nil
+}
+
+// clientStorage returns the storage for the OAuth2 server.
+func (c *Control) clientStorage() clientStorage {
+	return clientStorage{
+		FullStorage: c.Storage,
+		l:           c.Logger.WithContext(lw.Ctx{"log": "auth"}),
+	}
+}
+
+// newClient returns a client with the hash of "secret", ready to be saved in the storage.
+func newClient(id, secret, redirectURI string, userData any) (*osin.DefaultClient, error) {
+	hash, err := HashSecret(secret)
+	if err != nil {
+		return nil, err
+	}
+	return &osin.DefaultClient{Id: id, Secret: hash, RedirectUri: redirectURI, UserData: userData}, nil
+}
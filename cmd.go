@@ -7,34 +7,153 @@ import (
 	"encoding/pem"
 	"fmt"
 	"net/url"
+	"os"
+	"slices"
 	"strings"
 	"syscall"
+	"time"
 
 	"git.sr.ht/~mariusor/lw"
 	"git.sr.ht/~mariusor/oni/internal/xdg"
+	"github.com/alecthomas/kong"
 	vocab "github.com/go-ap/activitypub"
 	"github.com/go-ap/errors"
 	"github.com/go-ap/processing"
-	"github.com/openshift/osin"
 	"golang.org/x/term"
 )
 
 type SSH struct {
-	OAuth2      OAuth2      `cmd:"" name:"oauth" description:"OAuth2 client and access token helper"`
-	Actor       ActorCmd    `cmd:"" description:"Actor helper"`
-	Block       Block       `cmd:"" description:"Block instances or actors"`
-	Debug       Debug       `cmd:"" help:"Toggle debug mode for the running ${name} server."`
-	Maintenance Maintenance `cmd:"" help:"Toggle maintenance mode for the running ${name} server."`
-	Reload      Reload      `cmd:"" help:"Reload the running ${name} server configuration"`
-	Stop        Stop        `cmd:"" help:"Stops the running ${name} server configuration"`
+	OAuth2         OAuth2         `cmd:"" name:"oauth" description:"OAuth2 client and access token helper"`
+	Actor          ActorCmd       `cmd:"" description:"Actor helper"`
+	Block          Block          `cmd:"" description:"Block instances or actors"`
+	Queue          QueueCmd       `cmd:"" description:"Outbound delivery queue management"`
+	FollowRequests FollowRequests `cmd:"" name:"follow-requests" description:"Manage the pending follow requests of actors which approve followers manually"`
+	Auth           AuthCmd        `cmd:"" description:"Password authentication helper"`
+	Debug          Debug          `cmd:"" help:"Set or toggle debug mode for the running ${name} server."`
+	Maintenance    Maintenance    `cmd:"" help:"Set or toggle maintenance mode for the running ${name} server."`
+	Reload         Reload         `cmd:"" help:"Reload the running ${name} server configuration"`
+	Stop           Stop           `cmd:"" help:"Stops the running ${name} server configuration"`
+	Status         Status         `cmd:"" help:"Show the status of the running ${name} server."`
 }
 
 var CLI struct {
 	SSH
 	Path    string `default:"${default_path}" help:"Storage path (or DSN) for the ActivityPub storage. DSN can have the format type:///path/to/storage."`
 	Verbose int    `name:"verbose" short:"v" default:"0" type:"counter" help:"Increase verbosity of the log output" `
+	Config  string `default:"${default_config}" type:"path" help:"Path to the configuration file, which is reloaded on SIGHUP."`
 
-	Run Run `cmd:"" help:"Run the ${name} instance server (version: ${version})" default:"withargs"`
+	Storage StorageCmd `cmd:"" description:"Storage maintenance helper"`
+	Run     Run        `cmd:"" help:"Run the ${name} instance server (version: ${version})" default:"withargs"`
+}
+
+type StorageCmd struct {
+	Migrate Migrate      `cmd:"" description:"Copy the contents of a storage to a different backend"`
+	Check   StorageCheck `cmd:"" description:"Check the consistency of the storage, and optionally repair it"`
+	Media   ExtractMedia `cmd:"" name:"extract-media" description:"Move the inline media content of existing objects to the blob store"`
+}
+
+type ExtractMedia struct {
+	For []string `arg:"" optional:"" description:"The root actors to convert the objects for. All the root actors with OAuth2 clients are used if missing."`
+}
+
+func (e ExtractMedia) Run(ctl *Control) error {
+	actors, err := ctl.loadActorsOrRoot(e.For)
+	if err != nil {
+		return err
+	}
+	count, err := ctl.ExtractMedia(actors...)
+	_, _ = fmt.Fprintf(ctl.out, "Converted %d objects\n", count)
+	return err
+}
+
+type StorageCheck struct {
+	Repair bool     `help:"Fix the problems which can be repaired automatically."`
+	For    []string `arg:"" optional:"" description:"The root actors to check. All the root actors with OAuth2 clients are checked if missing."`
+}
+
+// loadActorsOrRoot loads the actors from "urls", or all the root actors if it's empty.
+func (c *Control) loadActorsOrRoot(urls []string) (vocab.ItemCollection, error) {
+	if len(urls) == 0 {
+		return c.RootActors()
+	}
+	actors := make(vocab.ItemCollection, 0, len(urls))
+	for _, u := range urls {
+		it, err := c.Storage.Load(vocab.IRI(u))
+		if err != nil {
+			return nil, errors.Annotatef(err, "unable to load actor %s", u)
+		}
+		actors = append(actors, it)
+	}
+	return actors, nil
+}
+
+func (s StorageCheck) Run(ctl *Control) error {
+	actors, err := ctl.loadActorsOrRoot(s.For)
+	if err != nil {
+		return err
+	}
+	problems, err := ctl.Check(s.Repair, actors...)
+	for _, p := range problems {
+		_, _ = fmt.Fprintln(ctl.out, p.String())
+	}
+	if err != nil {
+		return err
+	}
+	fixed := 0
+	for _, p := range problems {
+		if p.Fixed {
+			fixed++
+		}
+	}
+	_, _ = fmt.Fprintf(ctl.out, "Checked %d actors: %d problems found, %d fixed\n", len(actors), len(problems), fixed)
+	return nil
+}
+
+type Migrate struct {
+	From string `required:"" help:"Storage DSN to migrate from, in the format type:///path/to/storage."`
+	To   string `required:"" help:"Storage DSN to migrate to, in the format type:///path/to/storage."`
+}
+
+// openStorage opens the storage at the "dsn" for the storage helper commands,
+// which need to access other storages than the one of the running server.
+func openStorage(dsn string, ll lw.Logger) (*Control, error) {
+	typ, path := ParseStorageDSN(dsn)
+	ctl, err := SetupCtl(path, ll, typ)
+	if err != nil {
+		return nil, err
+	}
+	if opener, ok := storageAs[interface{ Open() error }](ctl.Storage); ok {
+		if err = opener.Open(); err != nil {
+			return nil, errors.Annotatef(err, "unable to open storage %s", dsn)
+		}
+	}
+	return ctl, nil
+}
+
+func (m Migrate) Run(ctl *Control) error {
+	from, err := openStorage(m.From, ctl.Logger.WithContext(lw.Ctx{"storage": "from"}))
+	if err != nil {
+		return err
+	}
+	defer from.Storage.Close()
+
+	to, err := openStorage(m.To, ctl.Logger.WithContext(lw.Ctx{"storage": "to"}))
+	if err != nil {
+		return err
+	}
+	defer to.Storage.Close()
+
+	mig := Migration{From: from, To: to}
+	if err = mig.Run(); err != nil {
+		_, _ = fmt.Fprintf(ctl.out, "Migration interrupted after %s, run it again to resume\n", mig.String())
+		return err
+	}
+	_, _ = fmt.Fprintf(ctl.out, "Migrated %s\n", mig.String())
+	if err = mig.Verify(); err != nil {
+		return err
+	}
+	_, _ = fmt.Fprintf(ctl.out, "Verified the destination storage\n")
+	return nil
 }
 
 type Block struct {
@@ -54,93 +173,396 @@ func (b Block) Run(ctl *Control) error {
 	if err != nil {
 		return errors.Annotatef(err, "unable to load actor from the client IRI")
 	}
-	service := *act
+	ctl.BlockFor(*act, b.URL...)
+	return nil
+}
+
+// UnblockFor removes the "urls" from the blocked collection of "service".
+func (c *Control) UnblockFor(service vocab.Item, urls ...string) {
+	blockedIRI := processing.BlockedCollection.IRI(service)
+	for _, u := range urls {
+		if err := c.Storage.RemoveFrom(blockedIRI, vocab.IRI(u)); err != nil {
+			c.Logger.Warnf("Unable to unblock instance %s: %s", u, err)
+		}
+	}
+}
+
+// BlockFor adds the "urls" to the blocked collection of the "service" actor, if they're not already part of it,
+// and returns the ones it has added.
+func (c *Control) BlockFor(service vocab.Actor, urls ...string) []string {
+	blockedIRI := processing.BlockedCollection.IRI(service)
+	col, _ := c.Storage.Load(blockedIRI)
+	if !vocab.IsObject(col) {
+		col = vocab.OrderedCollection{
+			ID:        blockedIRI,
+			Type:      vocab.OrderedCollectionType,
+			To:        vocab.ItemCollection{service.ID},
+			Published: TimeNow(),
+		}
+
+		var err error
+		if col, err = c.Storage.Save(col); err != nil {
+			c.Logger.Warnf("Unable to save the blocked collection %s: %s", blockedIRI, err)
+		}
+	}
+	var blocked vocab.IRIs
+	added := make([]string, 0, len(urls))
+	_ = vocab.OnCollectionIntf(col, func(col vocab.CollectionInterface) error {
+		blocked = col.Collection().IRIs()
+		return nil
+	})
 
-	for _, u := range b.URL {
-		toBlock, _ := ctl.Storage.Load(vocab.IRI(u))
+	for _, u := range urls {
+		if blocked.Contains(vocab.IRI(u)) {
+			continue
+		}
+		toBlock, err := c.Storage.Load(vocab.IRI(u))
 		if vocab.IsNil(toBlock) {
 			// NOTE(marius): if we don't have a local representation of the blocked item
 			// we invent an empty object that we can block.
 			// This probably needs more investigation to check if we should at least try to remote load.
-			ctl.Logger.Warnf("Unable to load instance to block %s: %s", u, err)
-			if toBlock, err = ctl.Storage.Save(vocab.Object{ID: vocab.IRI(u)}); err != nil {
-				ctl.Logger.Warnf("Unable to save locally the instance to block %s: %s", u, err)
+			c.Logger.Warnf("Unable to load instance to block %s: %s", u, err)
+			if _, err = c.Storage.Save(vocab.Object{ID: vocab.IRI(u)}); err != nil {
+				c.Logger.Warnf("Unable to save locally the instance to block %s: %s", u, err)
 			}
 		}
+		if err = c.Storage.AddTo(blockedIRI, vocab.IRI(u)); err != nil {
+			c.Logger.Warnf("Unable to block instance %s: %s", u, err)
+			continue
+		}
+		added = append(added, u)
+	}
+	return added
+}
 
-		blockedIRI := processing.BlockedCollection.IRI(service)
-		col, _ := ctl.Storage.Load(blockedIRI)
-		if !vocab.IsObject(col) {
-			col = vocab.OrderedCollection{
-				ID:        blockedIRI,
-				Type:      vocab.OrderedCollectionType,
-				To:        vocab.ItemCollection{service.ID},
-				Published: TimeNow(),
-			}
+type QueueCmd struct {
+	List  QueueList  `cmd:"" description:"List the jobs in the delivery queue" alias:"ls"`
+	Retry QueueRetry `cmd:"" description:"Move dead-letter jobs back to the delivery queue"`
+	Purge QueuePurge `cmd:"" description:"Remove jobs from the delivery queue"`
+}
 
-			if col, err = ctl.Storage.Save(col); err != nil {
-				ctl.Logger.Warnf("Unable to save the blocked collection %s: %s", blockedIRI, err)
-			}
+type QueueList struct {
+	Dead bool `description:"List the dead-letter jobs instead of the pending ones."`
+}
+
+func (l QueueList) Run(ctl *Control) error {
+	jobs, err := ctl.Queue().List(l.Dead)
+	if err != nil {
+		return err
+	}
+	for _, j := range jobs {
+		_, _ = fmt.Fprintf(ctl.out, "%s %s attempts=%d next=%s\n", j.ID, j.Inbox, j.Attempts, j.NextTry.Format(time.RFC3339))
+		if j.LastError != "" {
+			_, _ = fmt.Fprintf(ctl.out, "    %s\n", j.LastError)
+		}
+	}
+	pending, dead := ctl.Queue().Count()
+	_, _ = fmt.Fprintf(ctl.out, "Pending: %d, dead: %d\n", pending, dead)
+	return nil
+}
+
+type QueueRetry struct {
+	ID []string `arg:"" optional:"" description:"The IDs (or ID prefixes) of the dead-letter jobs to retry. All jobs are retried if missing."`
+}
+
+func (r QueueRetry) Run(ctl *Control) error {
+	cnt, err := ctl.Queue().Retry(r.ID...)
+	_, _ = fmt.Fprintf(ctl.out, "Retrying %d jobs\n", cnt)
+	return err
+}
+
+type QueuePurge struct {
+	Pending bool     `description:"Purge the pending jobs instead of the dead-letter ones."`
+	ID      []string `arg:"" optional:"" description:"The IDs (or ID prefixes) of the jobs to remove. All jobs are removed if missing."`
+}
+
+func (p QueuePurge) Run(ctl *Control) error {
+	cnt, err := ctl.Queue().Purge(!p.Pending, p.ID...)
+	_, _ = fmt.Fprintf(ctl.out, "Removed %d jobs\n", cnt)
+	return err
+}
+
+type FollowRequests struct {
+	List   ListFollowRequests    `cmd:"" description:"List the pending follow requests" alias:"ls"`
+	Accept RespondFollowRequests `cmd:"" description:"Accept pending follow requests"`
+	Reject RespondFollowRequests `cmd:"" description:"Reject pending follow requests"`
+}
+
+func loadRootActor(ctl *Control, iri string) (*vocab.Actor, error) {
+	if iri == "" {
+		return nil, errors.Newf("Need to provide the root actor URL")
+	}
+	it, err := ctl.Storage.Load(vocab.IRI(iri))
+	if err != nil {
+		return nil, err
+	}
+	return vocab.ToActor(it)
+}
+
+type ListFollowRequests struct {
+	For string `required:"" description:"Which root actor to list the follow requests for."`
+}
+
+func (l ListFollowRequests) Run(ctl *Control) error {
+	actor, err := loadRootActor(ctl, l.For)
+	if err != nil {
+		return err
+	}
+	requests, err := ctl.FollowRequests(actor)
+	if err != nil {
+		return err
+	}
+	for _, it := range requests {
+		_ = vocab.OnActivity(it, func(f *vocab.Activity) error {
+			_, _ = fmt.Fprintf(ctl.out, "%s by %s\n", f.ID, f.Actor.GetLink())
+			return nil
+		})
+	}
+	return nil
+}
+
+type RespondFollowRequests struct {
+	For    string   `required:"" description:"Which root actor to respond to the follow requests for."`
+	Follow []string `arg:"" description:"The Follow activities, or the actors that sent them, to respond to."`
+}
+
+func (r RespondFollowRequests) Run(ctx *kong.Context, ctl *Control) error {
+	typ := vocab.AcceptType
+	if ctx.Selected().Name == "reject" {
+		typ = vocab.RejectType
+	}
+	actor, err := loadRootActor(ctl, r.For)
+	if err != nil {
+		return err
+	}
+	requests, err := ctl.FollowRequests(actor)
+	if err != nil {
+		return err
+	}
+	responded := 0
+	for _, it := range requests {
+		matches := false
+		_ = vocab.OnActivity(it, func(f *vocab.Activity) error {
+			matches = slices.ContainsFunc(r.Follow, func(s string) bool {
+				return f.ID.Equals(vocab.IRI(s), true) || f.Actor.GetLink().Equals(vocab.IRI(s), true)
+			})
+			return nil
+		})
+		if !matches {
+			continue
 		}
-		if err := ctl.Storage.AddTo(blockedIRI, vocab.IRI(u)); err != nil {
-			ctl.Logger.Warnf("Unable to block instance %s: %s", u, err)
+		if err = ctl.RespondToFollowRequest(*actor, it, typ); err != nil {
+			return err
 		}
+		responded++
+		_, _ = fmt.Fprintf(ctl.out, "%s: %s\n", typ, it.GetLink())
+	}
+	if responded == 0 {
+		return errors.NotFoundf("no pending follow requests matching %s", strings.Join(r.Follow, ", "))
 	}
 	return nil
 }
 
 type Run struct {
-	Listen string `default:"127.0.0.1:60123" short:"l" help:"Listen socket"`
-	URL    string `default:"${default_url}" help:"Default URL for the instance actor"`
-	Pw     string `default:"${default_pw}" help:"Default password to use for the instance actor"`
+	Listen []string `short:"l" help:"Listen sockets, overriding the ones from the configuration file (default: ${default_listen})"`
+	URL    string   `default:"${default_url}" help:"Default URL for the instance actor"`
+	Pw     string   `help:"Default password to use for new instance actors, a random one is generated for each if missing"`
+
+	TLSCertDir   string `name:"tls-cert-dir" type:"path" help:"Directory with the TLS certificates of the root actors' hosts, named <host>.crt and <host>.key. When set, the TCP sockets serve HTTPS."`
+	HTTPRedirect string `name:"http-redirect" help:"Plain HTTP socket which redirects to HTTPS, when using --tls-cert-dir, eg: :80"`
 }
 
 func (s Run) Run(ctl *Control) error {
-	return Oni(
+	cfg, err := LoadConfig(CLI.Config)
+	if err != nil {
+		return err
+	}
+	initFns := []optionFn{
 		WithPassword(s.Pw),
 		WithLogger(ctl.Logger),
-		WithStorage(ctl.Storage, ctl.StoragePath),
-		ListenOn(s.Listen),
-	).Run(context.Background())
+		WithStorage(ctl.Storage, ctl.StorageType, ctl.StoragePath),
+		WithVerbosity(CLI.Verbose),
+		WithConfig(CLI.Config, *cfg),
+	}
+	if len(s.Listen) > 0 {
+		initFns = append(initFns, ListenOn(s.Listen...))
+	}
+	if s.TLSCertDir != "" {
+		initFns = append(initFns, WithTLS(s.TLSCertDir, s.HTTPRedirect))
+	}
+	return Oni(initFns...).Run(context.Background())
 }
 
+type pauseMethod int
+
+const (
+	notPaused pauseMethod = iota
+	pausedByControl
+	pausedBySignal
+)
+
 func (c *Control) Close() {
-	if _, ok := c.Storage.(interface{ Open() error }); ok {
-		_ = c.SendSignal(syscall.SIGUSR1)
+	if _, ok := storageAs[interface{ Open() error }](c.Storage); ok {
+		switch c.paused {
+		case pausedByControl:
+			_, _ = c.command(cmdMaintenance, stateOff, syscall.SIGUSR1)
+		case pausedBySignal:
+			// NOTE(marius): the signal only toggles the maintenance mode, so we send it again to resume the server
+			_ = c.SendSignal(syscall.SIGUSR1)
+		}
 	}
 	c.Storage.Close()
 }
 
+// Open opens the storage, after putting the running server in maintenance mode, so it releases it.
 func (c *Control) Open() error {
-	if opener, ok := c.Storage.(interface{ Open() error }); ok {
-		_ = c.SendSignal(syscall.SIGUSR1)
+	if opener, ok := storageAs[interface{ Open() error }](c.Storage); ok {
+		c.paused = c.pauseServer()
 		return opener.Open()
 	}
 	return nil
 }
 
-type Maintenance struct{}
+func (c *Control) pauseServer() pauseMethod {
+	st, err := c.sendControl(controlRequest{Command: cmdStatus})
+	if isUnreachable(err) {
+		if c.SendSignal(syscall.SIGUSR1) != nil {
+			return notPaused
+		}
+		return pausedBySignal
+	}
+	if err != nil || st.Maintenance {
+		return notPaused
+	}
+	if _, err = c.sendControl(controlRequest{Command: cmdMaintenance, State: stateOn}); err != nil {
+		return notPaused
+	}
+	return pausedByControl
+}
+
+// controlCommands are the commands sent to the running server, which don't need to open the storage.
+var controlCommands = []string{"status", "maintenance", "debug", "reload", "stop", "auth"}
+
+// IsControlCommand returns if "cmd", as returned by kong.Context.Command, is sent to the running server.
+func IsControlCommand(cmd string) bool {
+	name, _, _ := strings.Cut(cmd, " ")
+	return slices.Contains(controlCommands, name)
+}
+
+// ownStorageCommands are the commands which open the storages they work with, instead of the one from --path.
+var ownStorageCommands = []string{"storage migrate"}
+
+// NeedsStorage returns if "cmd", as returned by kong.Context.Command, uses the storage from --path.
+func NeedsStorage(cmd string) bool {
+	if IsControlCommand(cmd) {
+		return false
+	}
+	return !slices.ContainsFunc(ownStorageCommands, func(c string) bool {
+		return cmd == c || strings.HasPrefix(cmd, c+" ")
+	})
+}
+
+func onOff(on bool) string {
+	if on {
+		return stateOn
+	}
+	return stateOff
+}
+
+type AuthCmd struct {
+	Lockouts LockoutsCmd `cmd:"" description:"Manage the lockouts after failed password authentication attempts"`
+}
+
+type LockoutsCmd struct {
+	List  LockoutList  `cmd:"" description:"List the addresses with failed authentication attempts" alias:"ls"`
+	Clear LockoutClear `cmd:"" description:"Clear the failed authentication attempts and lockouts"`
+}
+
+type LockoutList struct{}
+
+func (l LockoutList) Run(ctl *Control) error {
+	res, err := ctl.roundTripControl(controlRequest{Command: cmdLockouts})
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, l := range res.Lockouts {
+		locked := "no"
+		if l.Locked(now) {
+			locked = "until " + l.Until.Format(time.RFC3339)
+		}
+		_, _ = fmt.Fprintf(ctl.out, "%s ip=%s factor=%s failures=%d last=%s locked=%s\n", l.Actor, l.IP, l.Factor,
+			l.Failures, l.Last.Format(time.RFC3339), locked)
+	}
+	_, _ = fmt.Fprintf(ctl.out, "Lockouts: %d\n", len(res.Lockouts))
+	return nil
+}
+
+type LockoutClear struct {
+	Actor string `arg:"" optional:"" description:"The actor to clear the lockouts for, all of them if missing."`
+}
+
+func (c LockoutClear) Run(ctl *Control) error {
+	res, err := ctl.roundTripControl(controlRequest{Command: cmdClearLocks, Actor: c.Actor})
+	if err != nil {
+		return err
+	}
+	_, _ = fmt.Fprintf(ctl.out, "Cleared %d lockouts\n", res.Cleared)
+	return nil
+}
+
+type Maintenance struct {
+	State string `arg:"" optional:"" enum:"on,off,toggle" default:"toggle" help:"The maintenance mode state: on, off or toggle."`
+}
 
 func (m Maintenance) Run(ctl *Control) error {
-	return ctl.SendSignal(syscall.SIGUSR1)
+	st, err := ctl.command(cmdMaintenance, m.State, syscall.SIGUSR1)
+	if err != nil {
+		return err
+	}
+	if st == nil {
+		_, _ = fmt.Fprintln(ctl.out, "Maintenance mode toggled using signals")
+		return nil
+	}
+	_, _ = fmt.Fprintf(ctl.out, "Maintenance mode: %s\n", onOff(st.Maintenance))
+	return nil
 }
 
-type Debug struct{}
+type Debug struct {
+	State string `arg:"" optional:"" enum:"on,off,toggle" default:"toggle" help:"The debug mode state: on, off or toggle."`
+}
 
 func (d Debug) Run(ctl *Control) error {
-	return ctl.SendSignal(syscall.SIGUSR2)
+	st, err := ctl.command(cmdDebug, d.State, syscall.SIGUSR2)
+	if err != nil {
+		return err
+	}
+	if st == nil {
+		_, _ = fmt.Fprintln(ctl.out, "Debug mode toggled using signals")
+		return nil
+	}
+	_, _ = fmt.Fprintf(ctl.out, "Debug mode: %s\n", onOff(st.Debug))
+	return nil
 }
 
 type Reload struct{}
 
 func (m Reload) Run(ctl *Control) error {
-	return ctl.SendSignal(syscall.SIGHUP)
+	if _, err := ctl.command(cmdReload, "", syscall.SIGHUP); err != nil {
+		return err
+	}
+	_, _ = fmt.Fprintln(ctl.out, "Configuration reloaded")
+	return nil
 }
 
 type Stop struct{}
 
 func (m Stop) Run(ctl *Control) error {
-	return ctl.SendSignal(syscall.SIGTERM)
+	if _, err := ctl.command(cmdStop, "", syscall.SIGTERM); err != nil {
+		return err
+	}
+	_, _ = fmt.Fprintln(ctl.out, "Stopping")
+	return nil
 }
 
 func (c *Control) SendSignal(sig syscall.Signal) error {
@@ -190,7 +612,68 @@ type OAuth2 struct {
 }
 
 type Token struct {
-	Add Add `cmd:"" description:"Adds an OAuth2 authorization token" alias:"new"`
+	Add    Add         `cmd:"" description:"Adds an OAuth2 authorization token" alias:"new"`
+	List   TokenList   `cmd:"" description:"List the OAuth2 access tokens" alias:"ls"`
+	Revoke TokenRevoke `cmd:"" description:"Revoke an OAuth2 access token, or all the tokens of a client"`
+	Prune  TokenPrune  `cmd:"" description:"Remove the expired OAuth2 access tokens and authorization codes"`
+}
+
+type TokenList struct {
+	For string `description:"Only list the tokens issued for this actor."`
+}
+
+func (l TokenList) Run(ctl *Control) error {
+	tokens, err := ctl.ListTokens(vocab.IRI(l.For))
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, ad := range tokens {
+		expires := "never"
+		if ad.ExpiresIn > 0 {
+			expires = ad.ExpireAt().Format(time.RFC3339)
+			if accessExpired(ad, now) {
+				expires += " (expired)"
+			}
+		}
+		_, _ = fmt.Fprintf(ctl.out, "%s client=%s actor=%s created=%s expires=%s\n", ad.AccessToken, clientID(ad.Client),
+			tokenUser(ad.UserData), ad.CreatedAt.Format(time.RFC3339), expires)
+		if ad.Scope != "" {
+			_, _ = fmt.Fprintf(ctl.out, "    scope: %s\n", ad.Scope)
+		}
+	}
+	_, _ = fmt.Fprintf(ctl.out, "Tokens: %d\n", len(tokens))
+	return nil
+}
+
+type TokenRevoke struct {
+	Token string `arg:"" description:"The access token to revoke, or the ID of the client whose tokens to revoke."`
+}
+
+func (r TokenRevoke) Run(ctl *Control) error {
+	if ad, err := ctl.Storage.LoadAccess(r.Token); err == nil && ad != nil {
+		if err = ctl.RevokeAccess(ad); err != nil {
+			return err
+		}
+		_, _ = fmt.Fprintf(ctl.out, "Revoked token for %s\n", tokenUser(ad.UserData))
+		return nil
+	}
+	if _, err := ctl.Storage.GetClient(r.Token); err != nil {
+		return errors.NotFoundf("no access token or client found for %q", r.Token)
+	}
+	cnt, err := ctl.RevokeClient(r.Token)
+	_, _ = fmt.Fprintf(ctl.out, "Revoked %d tokens for client %s\n", cnt, r.Token)
+	return err
+}
+
+type TokenPrune struct {
+	Expired bool `required:"" description:"Remove the expired tokens."`
+}
+
+func (p TokenPrune) Run(ctl *Control) error {
+	cnt, err := ctl.PruneExpired()
+	_, _ = fmt.Fprintf(ctl.out, "Removed %d expired tokens\n", cnt)
+	return err
 }
 
 type Add struct {
@@ -217,11 +700,222 @@ type ActorCmd struct {
 	FixCollections FixCollections `cmd:"" description:"Fix a root actor's collections"`
 	RotateKey      RotateKey      `cmd:"" description:"Rotate the public/private key pair for an actor"`
 	ChangePassword ChangePassword `cmd:"" description:"Change the password for the actor"`
+
+	ApproveFollowers ApproveFollowers `cmd:"" description:"Toggle the manual approval of follow requests for the actor"`
+	TwoFactor        TwoFactorCmd     `cmd:"" name:"2fa" description:"Manage the TOTP two-factor authentication of the actor"`
+	Passkey          PasskeyCmd       `cmd:"" description:"Manage the passkeys the actor can sign in with"`
+	Export           ExportActor      `cmd:"" description:"Export the actor with its activities, collections, OAuth2 clients and keys to an archive"`
+	Import           ImportActor      `cmd:"" description:"Import an actor from an archive created by export"`
+	ImportMastodon   ImportMastodon   `cmd:"" name:"import-mastodon" description:"Import the posts, media and blocked domains from a Mastodon account archive"`
+}
+
+type ImportMastodon struct {
+	For  string `required:"" description:"The root actor to import the Mastodon archive into."`
+	Path string `arg:"" type:"existingfile" description:"The Mastodon archive zip file."`
+}
+
+func (i ImportMastodon) Run(ctl *Control) error {
+	actor, err := loadRootActor(ctl, i.For)
+	if err != nil {
+		return err
+	}
+	res, err := ctl.ImportMastodon(*actor, i.Path)
+	if res != nil {
+		_, _ = fmt.Fprintf(ctl.out, "Imported %d activities, %d media files, %d blocked domains, skipped %d activities\n",
+			res.Activities, res.Media, res.Blocked, res.Skipped)
+		if len(res.Following) > 0 {
+			_, _ = fmt.Fprintf(ctl.out, "The following accounts need to be followed manually:\n")
+			for _, acc := range res.Following {
+				_, _ = fmt.Fprintf(ctl.out, "  %s\n", acc)
+			}
+		}
+	}
+	return err
+}
+
+type ExportActor struct {
+	IRI vocab.IRI `arg:"" description:"The actor to export."`
+	Out string    `short:"o" required:"" type:"path" description:"The path of the archive file to write."`
+}
+
+func (e ExportActor) Run(ctl *Control) error {
+	f, err := os.OpenFile(e.Out, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return errors.Annotatef(err, "unable to create archive file")
+	}
+	if err = ctl.ExportActor(e.IRI, f); err != nil {
+		_ = f.Close()
+		_ = os.Remove(e.Out)
+		return err
+	}
+	return f.Close()
+}
+
+type ImportActor struct {
+	Path string `arg:"" type:"existingfile" description:"The archive file to import."`
+}
+
+func (i ImportActor) Run(ctl *Control) error {
+	f, err := os.Open(i.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	actor, err := ctl.ImportActor(f)
+	if err != nil {
+		return err
+	}
+	_, _ = fmt.Fprintf(ctl.out, "Imported %s\n", actor.ID)
+	return nil
+}
+
+type ApproveFollowers struct {
+	For      string `arg:"" description:"The actor to change the follower approval mode for."`
+	Manually bool   `default:"true" negatable:"automatically" description:"Keep follow requests pending until they are accepted or rejected manually."`
+}
+
+func (a ApproveFollowers) Run(ctl *Control) error {
+	actor, err := loadRootActor(ctl, a.For)
+	if err != nil {
+		return err
+	}
+	return ctl.SetManuallyApprovesFollowers(actor.ID, a.Manually)
+}
+
+type TwoFactorCmd struct {
+	Enable        TwoFactorEnable   `cmd:"" description:"Enable two-factor authentication, and show the authenticator app QR code and the recovery codes"`
+	Disable       TwoFactorDisable  `cmd:"" description:"Disable two-factor authentication"`
+	RecoveryCodes TwoFactorRecovery `cmd:"" name:"recovery-codes" description:"Replace the recovery codes"`
+}
+
+type TwoFactorEnable struct {
+	For string `arg:"" description:"The actor to enable two-factor authentication for."`
+}
+
+func printRecoveryCodes(ctl *Control, codes []string) {
+	_, _ = fmt.Fprintln(ctl.out, "Recovery codes, each of them can be used once instead of an authentication code:")
+	for _, code := range codes {
+		_, _ = fmt.Fprintf(ctl.out, "    %s\n", code)
+	}
+}
+
+func (e TwoFactorEnable) Run(ctl *Control) error {
+	actor, err := loadRootActor(ctl, e.For)
+	if err != nil {
+		return err
+	}
+	secret, codes, err := ctl.EnableTOTP(actor.ID)
+	if err != nil {
+		return err
+	}
+	uri := totpURI(secret, *actor)
+	_, _ = fmt.Fprintln(ctl.out, "Scan the QR code, or add the following URI to an authenticator app:")
+	_, _ = fmt.Fprintln(ctl.out, uri)
+	if err = printQR(ctl.out, uri); err != nil {
+		ctl.Logger.WithContext(lw.Ctx{"err": err.Error()}).Warnf("Unable to render the QR code")
+	}
+	printRecoveryCodes(ctl, codes)
+	return nil
+}
+
+type TwoFactorDisable struct {
+	For string `arg:"" description:"The actor to disable two-factor authentication for."`
+}
+
+func (d TwoFactorDisable) Run(ctl *Control) error {
+	actor, err := loadRootActor(ctl, d.For)
+	if err != nil {
+		return err
+	}
+	if err = ctl.DisableTOTP(actor.ID); err != nil {
+		return err
+	}
+	_, _ = fmt.Fprintf(ctl.out, "Disabled two-factor authentication for %s\n", actor.ID)
+	return nil
+}
+
+type TwoFactorRecovery struct {
+	For string `arg:"" description:"The actor to replace the recovery codes for."`
+}
+
+func (r TwoFactorRecovery) Run(ctl *Control) error {
+	actor, err := loadRootActor(ctl, r.For)
+	if err != nil {
+		return err
+	}
+	codes, err := ctl.NewRecoveryCodes(actor.ID)
+	if err != nil {
+		return err
+	}
+	printRecoveryCodes(ctl, codes)
+	return nil
+}
+
+type PasskeyCmd struct {
+	Add    PasskeyAdd    `cmd:"" description:"Create a one-time link for adding a passkey"`
+	List   PasskeyList   `cmd:"" description:"List the passkeys" alias:"ls"`
+	Remove PasskeyRemove `cmd:"" description:"Remove a passkey" alias:"rm"`
+}
+
+type PasskeyAdd struct {
+	For string `arg:"" description:"The actor to add a passkey for."`
+}
+
+func (a PasskeyAdd) Run(ctl *Control) error {
+	actor, err := loadRootActor(ctl, a.For)
+	if err != nil {
+		return err
+	}
+	link, err := ctl.NewPasskeyLink(*actor)
+	if err != nil {
+		return err
+	}
+	_, _ = fmt.Fprintf(ctl.out, "Open the following link in the browser to add a passkey, it's valid for %s:\n", passkeyLinkTimeout)
+	_, _ = fmt.Fprintln(ctl.out, link)
+	return nil
+}
+
+type PasskeyList struct {
+	For string `arg:"" description:"The actor to list the passkeys for."`
+}
+
+func (l PasskeyList) Run(ctl *Control) error {
+	actor, err := loadRootActor(ctl, l.For)
+	if err != nil {
+		return err
+	}
+	keys, err := ctl.Passkeys(actor.ID)
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		_, _ = fmt.Fprintf(ctl.out, "%s %q created=%s\n", k.ID(), k.Name, k.Created.Format(time.RFC3339))
+	}
+	_, _ = fmt.Fprintf(ctl.out, "Passkeys: %d\n", len(keys))
+	return nil
+}
+
+type PasskeyRemove struct {
+	For string `arg:"" description:"The actor to remove the passkey from."`
+	ID  string `arg:"" description:"The ID or the name of the passkey, as shown by list."`
+}
+
+func (r PasskeyRemove) Run(ctl *Control) error {
+	actor, err := loadRootActor(ctl, r.For)
+	if err != nil {
+		return err
+	}
+	if err = ctl.RemovePasskey(actor.ID, r.ID); err != nil {
+		return err
+	}
+	_, _ = fmt.Fprintf(ctl.out, "Removed passkey %s\n", r.ID)
+	return nil
 }
 
 type AddActor struct {
 	URL       string `description:"The URL for the new actor."`
-	Pw        string `default:"${default_pw}" description:"The password for the new actor."`
+	Pw        string `description:"The password for the new actor, a random one is generated if missing."`
 	WithToken bool   `negatable:"without-token" description:"Create an OAuth2 token that can be used immediately."`
 }
 
@@ -384,13 +1078,11 @@ func (c ChangePassword) Run(ctl *Control) error {
 	}
 
 	if client, err := ctl.Storage.GetClient(string(c.IRI)); err == nil {
-		toUpdate := osin.DefaultClient{
-			Id:          client.GetId(),
-			Secret:      string(pw),
-			RedirectUri: client.GetRedirectUri(),
-			UserData:    client.GetUserData(),
+		toUpdate, err := newClient(client.GetId(), string(pw), client.GetRedirectUri(), client.GetUserData())
+		if err != nil {
+			return err
 		}
-		if err := ctl.Storage.SaveClient(&toUpdate); err != nil {
+		if err = ctl.Storage.SaveClient(toUpdate); err != nil {
 			return err
 		}
 	}
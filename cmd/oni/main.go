@@ -25,11 +25,12 @@ func main() {
 		kong.Description("CLI helper to manage and run ${name} instances, version ${version}."),
 		kong.UsageOnError(),
 		kong.Vars{
-			"name":         oni.AppName,
-			"version":      oni.Version,
-			"default_path": xdg.DataPath(oni.AppName),
-			"default_pw":   oni.DefaultOAuth2ClientPw,
-			"default_url":  oni.DefaultURL,
+			"name":           oni.AppName,
+			"version":        oni.Version,
+			"default_path":   xdg.DataPath(oni.AppName),
+			"default_url":    oni.DefaultURL,
+			"default_config": oni.DefaultConfigPath(),
+			"default_listen": oni.DefaultListen,
 		},
 		kong.ConfigureHelp(kong.HelpOptions{Compact: true, Summary: true}),
 	)
@@ -45,17 +46,24 @@ func main() {
 	// verbosity = 1 means show info messages
 	// verbosity = 2 debug messages
 	// verbosity = 3 tracing messages
-	ll := lw.Dev(lw.SetLevel(DefaultLogLevel - lw.Level(oni.CLI.Verbose)))
+	// The logger itself is created at the lowest level, and the effective level is set globally
+	// so it can be changed when reloading the configuration.
+	ll := lw.Dev(lw.SetLevel(lw.TraceLevel))
+	oni.SetLogLevel(DefaultLogLevel - lw.Level(oni.CLI.Verbose))
 	ctl, err := oni.SetupCtl(oni.CLI.Path, ll, storageType)
 	if err != nil {
 		_, _ = fmt.Fprintf(os.Stderr, "Error: %+v\n", err)
 		os.Exit(1)
 	}
-	if err = ctl.Open(); err != nil {
-		_, _ = fmt.Fprintf(os.Stderr, "Error: %+v\n", err)
-		os.Exit(1)
+	// NOTE(marius): the commands sent to the running server don't need the storage, which it might be using,
+	// and neither do the ones which open their own storages
+	if oni.NeedsStorage(ctx.Command()) {
+		if err = ctl.Open(); err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "Error: %+v\n", err)
+			os.Exit(1)
+		}
+		defer ctl.Close()
 	}
-	defer ctl.Close()
 
 	if err = ctx.Run(ctl); err != nil {
 		_, _ = fmt.Fprintf(os.Stderr, "Error: %+v\n", err)
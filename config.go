@@ -0,0 +1,242 @@
+package oni
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"git.sr.ht/~mariusor/lw"
+	"git.sr.ht/~mariusor/oni/internal/xdg"
+	"github.com/BurntSushi/toml"
+	vocab "github.com/go-ap/activitypub"
+	"github.com/go-ap/errors"
+	"github.com/rs/zerolog"
+)
+
+const ConfigFileName = "config.toml"
+
+// Config is the declarative configuration of an ONI instance.
+//
+// An example file:
+//
+//	listen = ["127.0.0.1:60123", "/run/oni/oni.sock"]
+//	log_level = "info"
+//	redirect_urls = ["https://client.example.com/callback"]
+//	cors_origins = ["https://*"]
+//	trusted_proxies = ["127.0.0.1", "10.0.0.0/8", "unix"]
+//
+//	[uploads]
+//	max_body_size = "40MB"
+//	max_media_size = { image = "10MB", video = "25MB" }
+//
+//	[auth]
+//	max_failures = 5
+//	lockout = "1m"
+//	failure_delay = "1s"
+//
+//	[[actor]]
+//	url = "https://johndoe.example.com"
+//	password = "SuperSecretOAuth2ClientPassword"
+//	block = ["https://naughty.social"]
+//	require_alt_text = true
+type Config struct {
+	Listen         []string      `toml:"listen"`
+	LogLevel       string        `toml:"log_level"`
+	RedirectURLs   []string      `toml:"redirect_urls"`
+	CORSOrigins    []string      `toml:"cors_origins"`
+	TrustedProxies []string      `toml:"trusted_proxies"`
+	Uploads        UploadsConfig `toml:"uploads"`
+	Auth           AuthConfig    `toml:"auth"`
+	Actors         []ActorConfig `toml:"actor"`
+}
+
+// UploadsConfig holds the limits for the bodies of the POST requests, and for the media files they contain.
+// The media size limits are keyed by either a full media type, like "image/gif", or just its type, like "image".
+type UploadsConfig struct {
+	MaxBodySize  ByteSize            `toml:"max_body_size"`
+	MaxMediaSize map[string]ByteSize `toml:"max_media_size"`
+}
+
+// AuthConfig holds the limits for the failed password authentication attempts.
+// After MaxFailures failed attempts for an actor from the same address, the address is locked out for Lockout,
+// and every following failure doubles it. FailureDelay is how long the failed attempts wait before responding.
+type AuthConfig struct {
+	MaxFailures  int           `toml:"max_failures"`
+	Lockout      time.Duration `toml:"lockout"`
+	FailureDelay time.Duration `toml:"failure_delay"`
+}
+
+// ActorConfig holds the settings for one of the root actors.
+type ActorConfig struct {
+	URL            string   `toml:"url"`
+	Password       string   `toml:"password"`
+	Block          []string `toml:"block"`
+	RequireAltText bool     `toml:"require_alt_text"`
+}
+
+func DefaultConfigPath() string {
+	return filepath.Join(xdg.ConfigPath(AppName), ConfigFileName)
+}
+
+// LoadConfig reads the configuration file at "path".
+// A missing file is not an error, and it results in an empty configuration.
+func LoadConfig(path string) (*Config, error) {
+	cfg := new(Config)
+	if path == "" {
+		return cfg, nil
+	}
+	meta, err := toml.DecodeFile(path, cfg)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return cfg, nil
+		}
+		return nil, errors.Annotatef(err, "unable to load configuration file %s", path)
+	}
+	if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+		keys := make([]string, 0, len(undecoded))
+		for _, k := range undecoded {
+			keys = append(keys, k.String())
+		}
+		return nil, errors.Newf("unknown keys in configuration file %s: %s", path, strings.Join(keys, ", "))
+	}
+	if cfg.LogLevel != "" {
+		if _, err = zerolog.ParseLevel(cfg.LogLevel); err != nil {
+			return nil, errors.Annotatef(err, "invalid log level %q", cfg.LogLevel)
+		}
+	}
+	if _, err = parseTrustedProxies(cfg.TrustedProxies...); err != nil {
+		return nil, err
+	}
+	for _, a := range cfg.Actors {
+		if _, err = vocab.IRI(a.URL).URL(); err != nil || a.URL == "" {
+			return nil, errors.Newf("invalid actor URL %q", a.URL)
+		}
+	}
+	return cfg, nil
+}
+
+// Actor returns the settings for the root actor with "iri".
+func (c Config) Actor(iri vocab.IRI) ActorConfig {
+	i := slices.IndexFunc(c.Actors, func(a ActorConfig) bool {
+		return vocab.IRI(a.URL).Equals(iri, true)
+	})
+	if i < 0 {
+		return ActorConfig{URL: iri.String()}
+	}
+	return c.Actors[i]
+}
+
+// SetLogLevel changes the level for all the application loggers.
+func SetLogLevel(lvl lw.Level) {
+	zerolog.SetGlobalLevel(lvl)
+}
+
+// WithConfig sets the configuration loaded from the file at "path", which is read again on reload.
+func WithConfig(path string, cfg Config) optionFn {
+	return func(o *oni) {
+		o.configPath = path
+		o.setConfig(cfg)
+	}
+}
+
+// WithVerbosity sets the verbosity requested on the command line, which takes precedence over
+// the log level from the configuration file.
+func WithVerbosity(verbose int) optionFn {
+	return func(o *oni) {
+		o.verbose = verbose
+	}
+}
+
+// config returns the current configuration.
+func (o *oni) config() Config {
+	if cfg := o.conf.Load(); cfg != nil {
+		return *cfg
+	}
+	return Config{}
+}
+
+// setConfig applies the values from "cfg" which can change without restarting the listening sockets.
+// The actors which have been removed since the previous configuration are dropped.
+func (o *oni) setConfig(cfg Config) {
+	if len(cfg.Listen) > 0 {
+		o.Listen = cfg.Listen
+	}
+	prev := o.config()
+	for _, p := range prev.Actors {
+		iri := vocab.IRI(p.URL)
+		if !slices.ContainsFunc(cfg.Actors, func(a ActorConfig) bool { return iri.Equals(vocab.IRI(a.URL), true) }) {
+			o.a = slices.DeleteFunc(o.a, func(act vocab.Actor) bool { return act.ID.Equals(iri, true) })
+		}
+	}
+	for _, a := range cfg.Actors {
+		if !slices.ContainsFunc(o.a, func(act vocab.Actor) bool { return act.ID.Equals(vocab.IRI(a.URL), true) }) {
+			o.a = append(o.a, DefaultActor(vocab.IRI(a.URL)))
+		}
+	}
+	o.conf.Store(&cfg)
+}
+
+// applyConfigBlocks blocks the items from the "block" list of the configuration for the root "actor", and unblocks
+// the ones which have been removed from it since.
+// NOTE(marius): we keep track only of the items blocked because of the configuration, so the ones which have been
+// blocked otherwise, with "oni block" for example, stay blocked.
+func (c *Control) applyConfigBlocks(actor vocab.Actor, block []string) error {
+	m := new(Metadata)
+	if err := c.Storage.LoadMetadata(actor.ID, m); err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	removed := slices.DeleteFunc(slices.Clone(m.ConfigBlocks), func(u string) bool {
+		return slices.Contains(block, u)
+	})
+	if len(removed) > 0 {
+		c.UnblockFor(actor, removed...)
+	}
+	added := c.BlockFor(actor, block...)
+	if len(removed) == 0 && len(added) == 0 {
+		return nil
+	}
+	m.ConfigBlocks = slices.DeleteFunc(m.ConfigBlocks, func(u string) bool {
+		return slices.Contains(removed, u)
+	})
+	m.ConfigBlocks = append(m.ConfigBlocks, added...)
+	return c.Storage.SaveMetadata(actor.ID, m)
+}
+
+// setLogLevel applies the configured log level, unless the verbosity has been set on the command line.
+func (o *oni) setLogLevel() {
+	cfg := o.config()
+	if cfg.LogLevel == "" || o.verbose != 0 {
+		return
+	}
+	if lvl, err := zerolog.ParseLevel(cfg.LogLevel); err == nil {
+		SetLogLevel(lvl)
+	}
+}
+
+// Reload reads the configuration file again, and applies it to the running instance.
+// The HTTP handlers are replaced atomically, so the connections in progress are not interrupted.
+func (o *oni) Reload() error {
+	cfg, err := LoadConfig(o.configPath)
+	if err != nil {
+		return err
+	}
+
+	listen := slices.Clone(o.Listen)
+	o.mu.Lock()
+	o.setConfig(*cfg)
+	o.setLogLevel()
+	if !slices.Equal(listen, o.Listen) {
+		o.Logger.WithContext(lw.Ctx{"listen": o.Listen}).Warnf("Changes to the listening sockets need a restart")
+	}
+	o.Listen = listen
+	o.mu.Unlock()
+
+	o.loadRootActors()
+	if o.certs != nil {
+		o.certs.Load()
+	}
+	o.setupRoutes()
+	return nil
+}
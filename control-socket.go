@@ -0,0 +1,245 @@
+package oni
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"git.sr.ht/~mariusor/lw"
+	"git.sr.ht/~mariusor/oni/internal/xdg"
+	vocab "github.com/go-ap/activitypub"
+	"github.com/go-ap/errors"
+)
+
+// NOTE(marius): the control socket accepts one JSON encoded request per connection, and it answers with
+// the status of the server after executing it, so the CLI can show the result of the commands.
+
+const (
+	cmdStatus      = "status"
+	cmdMaintenance = "maintenance"
+	cmdDebug       = "debug"
+	cmdReload      = "reload"
+	cmdStop        = "stop"
+	cmdLockouts    = "lockouts"
+	cmdClearLocks  = "clear-lockouts"
+
+	stateOn     = "on"
+	stateOff    = "off"
+	stateToggle = "toggle"
+
+	controlTimeout = 30 * time.Second
+)
+
+type controlRequest struct {
+	Command string `json:"command"`
+	State   string `json:"state,omitempty"`
+	Actor   string `json:"actor,omitempty"`
+}
+
+type controlResponse struct {
+	Error    string        `json:"error,omitempty"`
+	Status   *ServerStatus `json:"status,omitempty"`
+	Lockouts []Lockout     `json:"lockouts,omitempty"`
+	Cleared  int           `json:"cleared,omitempty"`
+}
+
+// controlUnreachable is returned when there's no server listening on the control socket.
+type controlUnreachable struct {
+	error
+}
+
+func isUnreachable(err error) bool {
+	return errors.As(err, new(controlUnreachable))
+}
+
+// ControlSocketPath returns the path of the control socket for the instance using the storage at "storagePath".
+// It's named after the hash of the storage path, so multiple instances on the same machine don't clash,
+// while keeping it under the length limit for Unix socket paths.
+func ControlSocketPath(storagePath string) string {
+	if abs, err := filepath.Abs(storagePath); err == nil {
+		storagePath = abs
+	}
+	sum := sha256.Sum256([]byte(storagePath))
+	return filepath.Join(xdg.RuntimePath(), AppName+"-"+hex.EncodeToString(sum[:6])+".sock")
+}
+
+func newState(state string, current bool) (bool, error) {
+	switch state {
+	case stateOn:
+		return true, nil
+	case stateOff:
+		return false, nil
+	case stateToggle, "":
+		return !current, nil
+	}
+	return current, errors.Newf("invalid state %q", state)
+}
+
+func (o *oni) setMaintenance(on bool) error {
+	if InMaintenanceMode.Swap(on) == on {
+		return nil
+	}
+	return o.Pause()
+}
+
+// handleControl executes the control request, and returns the resulting status of the server.
+func (o *oni) handleControl(req controlRequest) controlResponse {
+	var err error
+	lctx := lw.Ctx{"command": req.Command}
+	if req.State != "" {
+		lctx["state"] = req.State
+	}
+	var lockouts []Lockout
+	cleared := 0
+	switch req.Command {
+	case cmdStatus:
+	case cmdMaintenance:
+		var on bool
+		if on, err = newState(req.State, InMaintenanceMode.Load()); err == nil {
+			err = o.setMaintenance(on)
+		}
+	case cmdDebug:
+		var on bool
+		if on, err = newState(req.State, InDebugMode.Load()); err == nil {
+			InDebugMode.Store(on)
+		}
+	case cmdReload:
+		err = o.Reload()
+	case cmdStop:
+		// NOTE(marius): we stop the same way as when receiving SIGTERM, which lets the response get sent first
+		err = syscall.Kill(os.Getpid(), syscall.SIGTERM)
+	case cmdLockouts:
+		lockouts = o.limiter.List()
+	case cmdClearLocks:
+		cleared = o.limiter.Clear(vocab.IRI(req.Actor))
+		lctx["cleared"] = cleared
+	default:
+		err = errors.Newf("unknown command %q", req.Command)
+	}
+	st := o.Status()
+	res := controlResponse{Status: &st, Lockouts: lockouts, Cleared: cleared}
+	if err != nil {
+		res.Error = err.Error()
+		lctx["err"] = err.Error()
+		o.Logger.WithContext(lctx).Warnf("Control command failed")
+		return res
+	}
+	o.Logger.WithContext(lctx).Debugf("Control command received")
+	return res
+}
+
+func (o *oni) serveControlConn(conn net.Conn) {
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(controlTimeout))
+
+	var res controlResponse
+	req := controlRequest{}
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		res.Error = errors.Annotatef(err, "invalid request").Error()
+	} else {
+		res = o.handleControl(req)
+	}
+	_ = json.NewEncoder(conn).Encode(res)
+}
+
+func listenControl(path string) (net.Listener, error) {
+	if conn, err := net.Dial("unix", path); err == nil {
+		_ = conn.Close()
+		return nil, errors.Newf("another instance is listening on %s", path)
+	}
+	// NOTE(marius): the socket left behind by an instance which didn't stop cleanly
+	_ = os.Remove(path)
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, err
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.Chmod(path, 0o600); err != nil {
+		_ = l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// serveControl accepts connections on the control socket until "ctx" is done.
+func (o *oni) serveControl(ctx context.Context) {
+	path := ControlSocketPath(o.StoragePath)
+	l, err := listenControl(path)
+	if err != nil {
+		o.Logger.WithContext(lw.Ctx{"socket": path, "err": err.Error()}).Warnf("Unable to open control socket")
+		return
+	}
+	o.Logger.WithContext(lw.Ctx{"socket": path}).Debugf("Accepting control commands")
+	go func() {
+		<-ctx.Done()
+		_ = l.Close()
+	}()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go o.serveControlConn(conn)
+	}
+}
+
+// sendControl sends the request to the server using the same storage, and returns its resulting status.
+func (c *Control) sendControl(req controlRequest) (*ServerStatus, error) {
+	res, err := c.roundTripControl(req)
+	return res.Status, err
+}
+
+// roundTripControl sends the request to the server using the same storage, and returns its full response.
+// For the commands running inside the server process, like the SSH ones, the request is handled directly.
+func (c *Control) roundTripControl(req controlRequest) (controlResponse, error) {
+	res := controlResponse{}
+	if c.handleControl != nil {
+		res = c.handleControl(req)
+		if res.Error != "" {
+			return res, errors.Newf("%s", res.Error)
+		}
+		return res, nil
+	}
+
+	path := ControlSocketPath(c.StoragePath)
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err != nil {
+		return res, controlUnreachable{errors.Annotatef(err, "unable to connect to control socket %s", path)}
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(controlTimeout))
+
+	if err = json.NewEncoder(conn).Encode(req); err != nil {
+		return res, errors.Annotatef(err, "unable to send %s command", req.Command)
+	}
+	if err = json.NewDecoder(conn).Decode(&res); err != nil {
+		return res, errors.Annotatef(err, "invalid response to %s command", req.Command)
+	}
+	if res.Error != "" {
+		return res, errors.Newf("%s", res.Error)
+	}
+	return res, nil
+}
+
+// command sends "cmd" over the control socket, and if the server can't be reached that way,
+// falls back to sending the "sig" signal to the process in the pid file, which can only toggle states.
+// The returned status is nil when the signal has been used.
+func (c *Control) command(cmd, state string, sig syscall.Signal) (*ServerStatus, error) {
+	st, err := c.sendControl(controlRequest{Command: cmd, State: state})
+	if err == nil || !isUnreachable(err) {
+		return st, err
+	}
+	if sig == 0 || (state != "" && state != stateToggle) {
+		return nil, err
+	}
+	c.Logger.WithContext(lw.Ctx{"err": err.Error()}).Debugf("Falling back to signals")
+	return nil, c.SendSignal(sig)
+}
@@ -31,11 +31,17 @@ type Control struct {
 	Storage storage.FullStorage
 	Logger  lw.Logger
 
+	StorageType storage.Type
 	StoragePath string
 
 	out io.Writer
 	err io.Writer
 	in  io.Reader
+
+	// handleControl is set when the commands run inside the server process
+	handleControl func(controlRequest) controlResponse
+	// paused records how the running server has been put in maintenance mode for the duration of the command
+	paused pauseMethod
 }
 
 func SetupCtl(storagePath string, ll lw.Logger, typ storage.Type) (*Control, error) {
@@ -64,6 +70,7 @@ func SetupCtl(storagePath string, ll lw.Logger, typ storage.Type) (*Control, err
 		return nil, err
 	}
 	ctl.Storage = st
+	ctl.StorageType = typ
 	ctl.StoragePath = storagePath
 
 	if ctl.in == nil {
@@ -112,7 +119,7 @@ func (c *Control) Client(actor vocab.Actor, lctx lw.Ctx) *client.C {
 	}
 
 	ua := fmt.Sprintf("%s@%s (+%s %s)", nameOni, Version, actor.GetLink(), ProjectURL)
-	tr := http.DefaultTransport
+	var tr http.RoundTripper = metricsTransport{http.DefaultTransport}
 	if IsDev {
 		tr = cache.Private(tr, cache.FS(filepath.Join(cachePath, "oni")))
 	}
@@ -158,6 +165,12 @@ func (c *Control) CreateActor(iri vocab.IRI, pw string) (*vocab.Actor, error) {
 		return act, errors.Annotatef(os.ErrExist, "actor exists")
 	}
 
+	generated := false
+	if pw == "" {
+		pw = GenerateSecret()
+		generated = true
+	}
+
 	o := DefaultActor(iri)
 	iri = o.GetLink()
 	o.Followers = vocab.Followers.Of(iri)
@@ -176,11 +189,15 @@ func (c *Control) CreateActor(iri vocab.IRI, pw string) (*vocab.Actor, error) {
 	}
 
 	u, _ := actor.ID.URL()
-	if err = c.CreateOAuth2ClientAlways(actor.ID, pw); err != nil {
+	if err = c.CreateOAuth2Client(actor.ID, pw); err != nil {
 		c.Logger.WithContext(lw.Ctx{"host": u.Hostname(), "err": err.Error()}).Errorf("Unable to save OAuth2 Client")
 		return nil, err
 	}
 	c.Logger.WithContext(lw.Ctx{"ClientID": actor.ID}).Debugf("Created OAuth2 Client")
+	if generated {
+		// NOTE(marius): the secret is not recoverable later, so this is the only time it's shown
+		c.Logger.WithContext(lw.Ctx{"iri": iri, "pw": pw}).Warnf("Generated password and OAuth2 client secret for new actor")
+	}
 
 	if actor, err = c.GenKeyPair(actor); err != nil {
 		c.Logger.WithContext(lw.Ctx{"err": err, "id": o.ID}).Errorf("Unable to generate Private/Public key pair")
@@ -271,7 +288,7 @@ func (c *Control) GenAccessToken(clientID, actorIdentifier string, dat interface
 		AuthorizeData: aud,
 		Client:        cl,
 		RedirectUri:   cl.GetRedirectUri(),
-		Scope:         "scope",
+		Scope:         scopes(Scopes).String(),
 		Authorized:    true,
 		Expiration:    -1,
 	}
@@ -307,6 +324,28 @@ func (c *Control) GenAccessToken(clientID, actorIdentifier string, dat interface
 type Metadata struct {
 	Pw         []byte `jsonld:"pw,omitempty"`
 	PrivateKey []byte `jsonld:"key,omitempty"`
+
+	ManuallyApprovesFollowers bool `jsonld:"manuallyApprovesFollowers,omitempty"`
+
+	// RegistrationToken is the hash of the RFC 7592 registration access token of a dynamically registered client.
+	RegistrationToken []byte `jsonld:"registrationToken,omitempty"`
+
+	// TOTPSecret is the RFC 6238 secret of the actors which have enabled two-factor authentication,
+	// and TOTPLastStep is the time step of the last code used, which can't be used again.
+	TOTPSecret   []byte `jsonld:"totpSecret,omitempty"`
+	TOTPLastStep int64  `jsonld:"totpLastStep,omitempty"`
+	// RecoveryCodes are the bcrypt hashes of the one-time codes which can be used instead of a TOTP code.
+	RecoveryCodes [][]byte `jsonld:"recoveryCodes,omitempty"`
+
+	// Passkeys are the JSON encoded WebAuthn credentials of the actor.
+	Passkeys [][]byte `jsonld:"passkeys,omitempty"`
+	// PasskeyLink is the hash of the token of the one-time link for adding a passkey, valid until PasskeyLinkExpires.
+	PasskeyLink        []byte `jsonld:"passkeyLink,omitempty"`
+	PasskeyLinkExpires int64  `jsonld:"passkeyLinkExpires,omitempty"`
+
+	// ConfigBlocks are the items a root actor has blocked because they're in its block list from the configuration
+	// file, which get unblocked when they're removed from it.
+	ConfigBlocks []string `jsonld:"configBlocks,omitempty"`
 }
 
 func (c *Control) GenKeyPair(actor *vocab.Actor) (*vocab.Actor, error) {
@@ -371,7 +410,7 @@ func (c *Control) GenKeyPair(actor *vocab.Actor) (*vocab.Actor, error) {
 func (c *Control) UpdateActorKey(actor *vocab.Actor) (*vocab.Actor, error) {
 	// NOTE(marius): we initialize the client that we're going to use for Update
 	// dissemination with an HTTP-Signature based on the current private key.
-	cl := c.Client(*actor, lw.Ctx{"log": "client"})
+	cl := c.DeliveryClient(*actor, lw.Ctx{"log": "client"})
 
 	st := c.Storage
 	l := c.Logger
@@ -422,20 +461,44 @@ func checkIRIResolvesLocally(iri vocab.IRI) (*net.TCPAddr, error) {
 	return net.ResolveTCPAddr("tcp", host)
 }
 
-func (c *Control) CreateOAuth2ClientAlways(i vocab.IRI, pw string) error {
+// CreateOAuth2Client saves the OAuth2 client for the root actor with IRI "i".
+// The secret of an existing client is kept, unless a non-empty "pw" is passed,
+// while a new client without a "pw" gets a randomly generated one.
+func (c *Control) CreateOAuth2Client(i vocab.IRI, pw string, redirectURLs ...string) error {
 	u, _ := i.URL()
+
+	id := string(uriRootIRI(u))
+	secret := ""
 	if pw == "" {
-		pw = DefaultOAuth2ClientPw
+		existing, err := c.Storage.GetClient(id)
+		switch {
+		case err == nil && existing != nil:
+			// NOTE(marius): the existing secret is already hashed, or it gets hashed the first time it's used
+			secret = existing.GetSecret()
+		case err == nil || errors.IsNotFound(err):
+			pw = GenerateSecret()
+			c.Logger.WithContext(lw.Ctx{"ClientID": id, "pw": pw}).Warnf("Generated OAuth2 client secret")
+		default:
+			// NOTE(marius): we don't replace the secret of a client we failed to load
+			return errors.Annotatef(err, "unable to load OAuth2 client %s", id)
+		}
+	}
+	if pw != "" {
+		hash, err := HashSecret(pw)
+		if err != nil {
+			return errors.Annotatef(err, "unable to hash OAuth2 client secret")
+		}
+		secret = hash
 	}
 
-	id := string(uriRootIRI(u))
 	uris := append(
 		[]string{id, DefaultOniAppRedirectURL, DefaultBOXAppRedirectURL, processing.OAuthOOBRedirectURN},
 		strings.Split(ExtraRedirectURL, "\n")...,
 	)
+	uris = append(uris, redirectURLs...)
 	cl := &osin.DefaultClient{
 		Id:          id,
-		Secret:      pw,
+		Secret:      secret,
 		RedirectUri: strings.Join(uris, "\n"),
 		UserData:    i,
 	}
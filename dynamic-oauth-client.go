@@ -197,16 +197,11 @@ func (o *oni) SetupAuthServerWithDynamicClientData(r *http.Request, oniActor voc
 		if err != nil {
 			return err
 		}
-		cl, err := o.Storage.GetClient(client)
-		if err != nil {
+		if _, err = o.Storage.GetClient(client); err != nil {
 			return err
 		}
 
 		s.Config.AllowClientSecretInParams = true
-		if vocab.IRI(client).Contains(oniActor.ID, false) && r.FormValue("client_secret") == "" {
-			// NOTE(marius): client ID and current server are on the same host
-			r.Form.Set("client_secret", cl.GetSecret())
-		}
 	} else {
 		auth, err := osin.CheckBasicAuth(r)
 		if err != nil {
@@ -236,7 +231,8 @@ func (o *oni) SetupAuthServerWithDynamicClientData(r *http.Request, oniActor voc
 		if err != nil {
 			return err
 		}
-		r.SetBasicAuth(url.QueryEscape(cl.GetId()), cl.GetSecret())
+		// NOTE(marius): the OAuth2 server checks the secret the client sent against the one of the client we found
+		r.SetBasicAuth(url.QueryEscape(cl.GetId()), url.QueryEscape(auth.Password))
 	}
 	return nil
 }
@@ -327,14 +323,11 @@ func CreateOAuthClient(st storage.FullStorage, clientActor *vocab.Actor, redirec
 		return nil, errors.Annotatef(err, "Error saving metadata for application %s", vocab.NameOf(clientActor))
 	}
 
-	d := &osin.DefaultClient{
-		Id:          id,
-		Secret:      string(pw),
-		RedirectUri: strings.Join(redirect, "\n"),
-		UserData:    userData,
+	d, err := newClient(id, string(pw), strings.Join(redirect, "\n"), userData)
+	if err != nil {
+		return nil, errors.Annotatef(err, "unable to hash OAuth2 client secret")
 	}
-
-	if err := st.SaveClient(d); err != nil {
+	if err = st.SaveClient(d); err != nil {
 		return nil, errors.Annotatef(err, "unable to save OAuth2 client application")
 	}
 	return d, nil
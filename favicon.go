@@ -5,9 +5,6 @@ import (
 	"crypto/md5"
 	"fmt"
 	"image"
-	"image/gif"
-	"image/jpeg"
-	"image/png"
 	"io"
 	"net/http"
 	"time"
@@ -80,25 +77,14 @@ func (o *oni) ServeFavIcon(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	f := bytes.Buffer{}
-	contentType, updatedAt, err := binDataFromItem(it, &f)
+	f, err := o.binDataFromItem(it)
 	if err != nil {
 		o.Error(err).ServeHTTP(w, r)
 		return
 	}
-	var orig image.Image
-	switch {
-	case contentType.Matches(imageJpeg):
-		orig, err = jpeg.Decode(&f)
-	case contentType.Matches(imagePng):
-		orig, err = png.Decode(&f)
-	case contentType.Matches(imageGif):
-		orig, err = gif.Decode(&f)
-	case contentType.Matches(imageSvg):
-		orig, err = svgDecode(&f)
-	default:
-		err = errors.Newf("invalid image type: %s", contentType)
-	}
+	defer f.Close()
+	updatedAt := f.updatedAt
+	orig, err := decodeImage(f.contentType, f)
 	if err != nil {
 		o.Error(errors.NewNotFound(err, "failed to open image")).ServeHTTP(w, r)
 		return
@@ -129,7 +115,7 @@ func (o *oni) ServeFavIcon(w http.ResponseWriter, r *http.Request) {
 	raw = buf.Bytes()
 	eTag := fmt.Sprintf(`"%2x"`, md5.Sum(raw))
 
-	w.Header().Set("Content-Type", contentType.MIME())
+	w.Header().Set("Content-Type", f.contentType.MIME())
 	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(raw)))
 	w.Header().Set("Vary", "Accept")
 	w.Header().Set("ETag", eTag)
@@ -0,0 +1,487 @@
+package oni
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	ct "github.com/elnormous/contenttype"
+	vocab "github.com/go-ap/activitypub"
+	"github.com/go-ap/errors"
+	"github.com/microcosm-cc/bluemonday"
+)
+
+var (
+	rssXML   = ct.NewMediaType("application/rss+xml")
+	atomXML  = ct.NewMediaType("application/atom+xml")
+	feedJSON = ct.NewMediaType("application/feed+json")
+
+	feedMediaTypes = []ct.MediaType{rssXML, atomXML, feedJSON}
+
+	// feedFormats are the values of the "format" query parameter for the feed media types,
+	// which the autodiscovery links use, as the feed readers don't always send a matching Accept header.
+	feedFormats = map[string]ct.MediaType{"rss": rssXML, "atom": atomXML, "json": feedJSON}
+)
+
+// feedTitleLength is the maximum length of the titles generated from the content of the items without a name.
+const feedTitleLength = 80
+
+type feedEnclosure struct {
+	URL       string
+	MediaType string
+	Length    int
+}
+
+type feedItem struct {
+	ID         string
+	URL        string
+	Title      string
+	Content    string
+	Published  time.Time
+	Updated    time.Time
+	Enclosures []feedEnclosure
+}
+
+// feed is the common representation of a collection, which is then rendered as RSS, Atom or JSON Feed.
+type feed struct {
+	ID          string
+	Title       string
+	Description string
+	Author      string
+	Link        string
+	Self        string
+	Updated     time.Time
+	Items       []feedItem
+}
+
+// FeedLink is an autodiscovery link for the feeds of an actor.
+type FeedLink struct {
+	Type  string
+	Title string
+	URL   vocab.IRI
+}
+
+// feedURL returns the URL of the "format" feed of the "col" collection.
+func feedURL(col vocab.IRI, format string) vocab.IRI {
+	return vocab.IRI(col.String() + "?format=" + format)
+}
+
+func feedLinks(actor vocab.Actor) func() []FeedLink {
+	links := make([]FeedLink, 0)
+	if !vocab.IsNil(actor.Outbox) {
+		name := bluemonday.StripTagsPolicy().Sanitize(vocab.PreferredNameOf(actor))
+		outbox := actor.Outbox.GetLink()
+		links = append(links,
+			FeedLink{Type: rssXML.String(), Title: name + " (RSS)", URL: feedURL(outbox, "rss")},
+			FeedLink{Type: atomXML.String(), Title: name + " (Atom)", URL: feedURL(outbox, "atom")},
+			FeedLink{Type: feedJSON.String(), Title: name + " (JSON Feed)", URL: feedURL(outbox, "json")},
+		)
+	}
+	return func() []FeedLink {
+		return links
+	}
+}
+
+func (o *oni) enclosureFromItem(it vocab.Item) (feedEnclosure, bool) {
+	if vocab.IsIRI(it) {
+		var err error
+		if it, err = o.Storage.Load(it.GetLink()); err != nil {
+			return feedEnclosure{}, false
+		}
+	}
+	enc := feedEnclosure{}
+	err := vocab.OnObject(it, func(ob *vocab.Object) error {
+		if !mediaTypes.Match(ob.Type) {
+			return errors.UnsupportedMediaTypef("invalid object type: %s", ob.Type)
+		}
+		enc.URL = ob.ID.String()
+		enc.MediaType = string(ob.MediaType)
+		if contentHasBinaryData(ob.Content) {
+			typ, r, err := o.binDataReader(ob.Content, ob.MediaType)
+			if err != nil {
+				return err
+			}
+			defer r.Close()
+			size, err := r.Seek(0, io.SeekEnd)
+			if err != nil {
+				return err
+			}
+			enc.MediaType = typ
+			enc.Length = int(size)
+		}
+		return nil
+	})
+	return enc, err == nil && enc.MediaType != ""
+}
+
+func plainText(n vocab.NaturalLanguageValues) string {
+	return strings.TrimSpace(bluemonday.StripTagsPolicy().Sanitize(n.First().String()))
+}
+
+func (o *oni) feedItemFromObject(it vocab.Item, published time.Time) (feedItem, bool) {
+	if vocab.IsIRI(it) {
+		var err error
+		if it, err = o.Storage.Load(it.GetLink()); err != nil {
+			return feedItem{}, false
+		}
+	}
+	_ = sanitizeItem(it)
+
+	fi := feedItem{}
+	err := vocab.OnObject(it, func(ob *vocab.Object) error {
+		fi.ID = ob.ID.String()
+		fi.URL = fi.ID
+		if !vocab.IsNil(ob.URL) {
+			if urls, ok := ob.URL.(vocab.ItemCollection); ok && len(urls) > 0 {
+				fi.URL = urls.First().GetLink().String()
+			} else {
+				fi.URL = ob.URL.GetLink().String()
+			}
+		}
+		fi.Published = ob.Published
+		if fi.Published.IsZero() {
+			fi.Published = published
+		}
+		fi.Updated = ob.Updated
+
+		fi.Title = plainText(ob.Name)
+		if contentHasBinaryData(ob.Content) {
+			// NOTE(marius): media objects are represented by their enclosure
+			if enc, ok := o.enclosureFromItem(ob); ok {
+				fi.Enclosures = append(fi.Enclosures, enc)
+			}
+			fi.Content = ob.Summary.First().String()
+		} else {
+			fi.Content = ob.Content.First().String()
+			if fi.Title == "" {
+				fi.Title = plainText(ob.Summary)
+			}
+			if fi.Title == "" {
+				fi.Title = plainText(ob.Content)
+				if r := []rune(fi.Title); len(r) > feedTitleLength {
+					fi.Title = string(r[:feedTitleLength]) + "…"
+				}
+			}
+		}
+		if fi.Title == "" {
+			fi.Title = typeToString(ob.Type)
+		}
+
+		attachments := vocab.ItemCollection{}
+		if vocab.IsItemCollection(ob.Attachment) {
+			_ = vocab.OnItemCollection(ob.Attachment, func(col *vocab.ItemCollection) error {
+				attachments = *col
+				return nil
+			})
+		} else if !vocab.IsNil(ob.Attachment) {
+			attachments = append(attachments, ob.Attachment)
+		}
+		for _, att := range attachments {
+			if enc, ok := o.enclosureFromItem(att); ok {
+				fi.Enclosures = append(fi.Enclosures, enc)
+			}
+		}
+		return nil
+	})
+	return fi, err == nil
+}
+
+func (o *oni) feedFromCollection(it vocab.Item, actor vocab.Actor, self string) feed {
+	f := feed{
+		ID:          it.GetLink().String(),
+		Link:        it.GetLink().String(),
+		Self:        self,
+		Author:      bluemonday.StripTagsPolicy().Sanitize(vocab.PreferredNameOf(actor)),
+		Description: plainText(actor.Summary),
+	}
+	_, col := vocab.Split(it.GetLink())
+	f.Title = fmt.Sprintf("%s :: %s", f.Author, col)
+
+	_ = vocab.OnCollectionIntf(it, func(col vocab.CollectionInterface) error {
+		for _, it := range col.Collection() {
+			if vocab.IsNil(it) {
+				continue
+			}
+			ob := it
+			var published time.Time
+			if vocab.ActivityTypes.Match(it.GetType()) {
+				_ = vocab.OnActivity(it, func(act *vocab.Activity) error {
+					ob = act.Object
+					published = act.Published
+					return nil
+				})
+			}
+			if vocab.IsNil(ob) {
+				continue
+			}
+			fi, ok := o.feedItemFromObject(ob, published)
+			if !ok {
+				continue
+			}
+			if fi.Published.After(f.Updated) {
+				f.Updated = fi.Published
+			}
+			if fi.Updated.After(f.Updated) {
+				f.Updated = fi.Updated
+			}
+			f.Items = append(f.Items, fi)
+		}
+		return nil
+	})
+	if f.Updated.IsZero() {
+		f.Updated = TimeNow()
+	}
+	return f
+}
+
+type rssEnclosure struct {
+	URL    string `xml:"url,attr"`
+	Type   string `xml:"type,attr"`
+	Length int    `xml:"length,attr"`
+}
+
+type rssItem struct {
+	Title       string        `xml:"title,omitempty"`
+	Link        string        `xml:"link"`
+	GUID        string        `xml:"guid"`
+	PubDate     string        `xml:"pubDate,omitempty"`
+	Description string        `xml:"description"`
+	Enclosure   *rssEnclosure `xml:"enclosure,omitempty"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	LastBuildDate string    `xml:"lastBuildDate"`
+	Self          atomLink  `xml:"atom:link"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	AtomNS  string     `xml:"xmlns:atom,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+func (f feed) rss() rssFeed {
+	res := rssFeed{
+		Version: "2.0",
+		AtomNS:  "http://www.w3.org/2005/Atom",
+		Channel: rssChannel{
+			Title:         f.Title,
+			Link:          f.Link,
+			Description:   f.Description,
+			LastBuildDate: f.Updated.Format(time.RFC1123Z),
+			Self:          atomLink{Href: f.Self, Rel: "self", Type: rssXML.String()},
+		},
+	}
+	for _, it := range f.Items {
+		ri := rssItem{
+			Title:       it.Title,
+			Link:        it.URL,
+			GUID:        it.ID,
+			Description: it.Content,
+		}
+		if !it.Published.IsZero() {
+			ri.PubDate = it.Published.Format(time.RFC1123Z)
+		}
+		// NOTE(marius): RSS 2.0 allows only one enclosure per item
+		if len(it.Enclosures) > 0 {
+			e := it.Enclosures[0]
+			ri.Enclosure = &rssEnclosure{URL: e.URL, Type: e.MediaType, Length: e.Length}
+		}
+		res.Channel.Items = append(res.Channel.Items, ri)
+	}
+	return res
+}
+
+type atomLink struct {
+	Href   string `xml:"href,attr"`
+	Rel    string `xml:"rel,attr,omitempty"`
+	Type   string `xml:"type,attr,omitempty"`
+	Length int    `xml:"length,attr,omitempty"`
+}
+
+type atomContent struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomEntry struct {
+	ID        string      `xml:"id"`
+	Title     string      `xml:"title"`
+	Updated   string      `xml:"updated"`
+	Published string      `xml:"published,omitempty"`
+	Links     []atomLink  `xml:"link"`
+	Content   atomContent `xml:"content"`
+}
+
+type atomFeed struct {
+	XMLName  xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID       string      `xml:"id"`
+	Title    string      `xml:"title"`
+	Subtitle string      `xml:"subtitle,omitempty"`
+	Updated  string      `xml:"updated"`
+	Author   atomAuthor  `xml:"author"`
+	Links    []atomLink  `xml:"link"`
+	Entries  []atomEntry `xml:"entry"`
+}
+
+func (f feed) atom() atomFeed {
+	res := atomFeed{
+		ID:       f.ID,
+		Title:    f.Title,
+		Subtitle: f.Description,
+		Updated:  f.Updated.Format(time.RFC3339),
+		Author:   atomAuthor{Name: f.Author},
+		Links: []atomLink{
+			{Href: f.Link, Rel: "alternate", Type: html.String()},
+			{Href: f.Self, Rel: "self", Type: atomXML.String()},
+		},
+	}
+	for _, it := range f.Items {
+		updated := it.Updated
+		if updated.IsZero() {
+			updated = it.Published
+		}
+		ae := atomEntry{
+			ID:      it.ID,
+			Title:   it.Title,
+			Updated: updated.Format(time.RFC3339),
+			Links:   []atomLink{{Href: it.URL, Rel: "alternate", Type: html.String()}},
+			Content: atomContent{Type: "html", Body: it.Content},
+		}
+		if !it.Published.IsZero() {
+			ae.Published = it.Published.Format(time.RFC3339)
+		}
+		for _, e := range it.Enclosures {
+			ae.Links = append(ae.Links, atomLink{Href: e.URL, Rel: "enclosure", Type: e.MediaType, Length: e.Length})
+		}
+		res.Entries = append(res.Entries, ae)
+	}
+	return res
+}
+
+type jsonFeedAttachment struct {
+	URL         string `json:"url"`
+	MimeType    string `json:"mime_type"`
+	SizeInBytes int    `json:"size_in_bytes,omitempty"`
+}
+
+type jsonFeedItem struct {
+	ID            string               `json:"id"`
+	URL           string               `json:"url,omitempty"`
+	Title         string               `json:"title,omitempty"`
+	ContentHTML   string               `json:"content_html"`
+	DatePublished string               `json:"date_published,omitempty"`
+	DateModified  string               `json:"date_modified,omitempty"`
+	Attachments   []jsonFeedAttachment `json:"attachments,omitempty"`
+}
+
+type jsonFeedAuthor struct {
+	Name string `json:"name"`
+}
+
+type jsonFeed struct {
+	Version     string           `json:"version"`
+	Title       string           `json:"title"`
+	HomePageURL string           `json:"home_page_url,omitempty"`
+	FeedURL     string           `json:"feed_url,omitempty"`
+	Description string           `json:"description,omitempty"`
+	Authors     []jsonFeedAuthor `json:"authors,omitempty"`
+	Items       []jsonFeedItem   `json:"items"`
+}
+
+func (f feed) jsonFeed() jsonFeed {
+	res := jsonFeed{
+		Version:     "https://jsonfeed.org/version/1.1",
+		Title:       f.Title,
+		HomePageURL: f.Link,
+		FeedURL:     f.Self,
+		Description: f.Description,
+		Authors:     []jsonFeedAuthor{{Name: f.Author}},
+		Items:       make([]jsonFeedItem, 0, len(f.Items)),
+	}
+	for _, it := range f.Items {
+		ji := jsonFeedItem{ID: it.ID, URL: it.URL, Title: it.Title, ContentHTML: it.Content}
+		if !it.Published.IsZero() {
+			ji.DatePublished = it.Published.Format(time.RFC3339)
+		}
+		if !it.Updated.IsZero() {
+			ji.DateModified = it.Updated.Format(time.RFC3339)
+		}
+		for _, e := range it.Enclosures {
+			ji.Attachments = append(ji.Attachments, jsonFeedAttachment{URL: e.URL, MimeType: e.MediaType, SizeInBytes: e.Length})
+		}
+		res.Items = append(res.Items, ji)
+	}
+	return res
+}
+
+// requestedFeedType returns the feed media type from the "format" query parameter of the request.
+func requestedFeedType(r *http.Request) (ct.MediaType, bool) {
+	mt, ok := feedFormats[r.URL.Query().Get("format")]
+	return mt, ok
+}
+
+// acceptedFeedType returns the feed media type requested with the "format" query parameter, or the one
+// the request prefers over the other representations of "it", if it's an outbox or an object collection.
+func acceptedFeedType(it vocab.Item, r *http.Request) (ct.MediaType, bool) {
+	if !vocab.CollectionTypes.Match(it.GetType()) {
+		return ct.MediaType{}, false
+	}
+	if _, col := vocab.Split(it.GetLink()); col != vocab.Outbox && !vocab.ValidObjectCollection(col) {
+		return ct.MediaType{}, false
+	}
+	if mt, ok := requestedFeedType(r); ok {
+		return mt, true
+	}
+	available := append([]ct.MediaType{applicationJsonLD, applicationJsonActivity, applicationJson, fallbackHTML}, feedMediaTypes...)
+	accepted, _, _ := ct.GetAcceptableMediaType(r, available)
+	accepts := checkAcceptMediaType(accepted)
+	for _, mt := range feedMediaTypes {
+		if accepts(mt) {
+			return mt, true
+		}
+	}
+	return ct.MediaType{}, false
+}
+
+// ServeFeed renders the "it" collection as an RSS, Atom or JSON Feed document, depending on "mt".
+func (o *oni) ServeFeed(it vocab.Item, mt ct.MediaType) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		f := o.feedFromCollection(it, o.oniActor(r), fmt.Sprintf("%s://%s%s", requestScheme(r), r.Host, r.RequestURI))
+
+		buf := bytes.Buffer{}
+		var err error
+		switch {
+		case mt.Matches(feedJSON):
+			err = json.NewEncoder(&buf).Encode(f.jsonFeed())
+		case mt.Matches(atomXML):
+			buf.WriteString(xml.Header)
+			err = xml.NewEncoder(&buf).Encode(f.atom())
+		default:
+			buf.WriteString(xml.Header)
+			err = xml.NewEncoder(&buf).Encode(f.rss())
+		}
+		if err != nil {
+			o.Error(errors.Annotatef(err, "unable to render feed")).ServeHTTP(w, r)
+			return
+		}
+		raw := buf.Bytes()
+		eTag := fmt.Sprintf(`"%2x"`, md5.Sum(raw))
+		writeResponse(raw, it.GetType(), f.Updated, mt.String()+"; charset=utf-8", eTag).ServeHTTP(w, r)
+	}
+}
@@ -0,0 +1,157 @@
+package oni
+
+import (
+	"git.sr.ht/~mariusor/lw"
+	vocab "github.com/go-ap/activitypub"
+	"github.com/go-ap/errors"
+	"github.com/go-ap/processing"
+	"github.com/valyala/fastjson"
+)
+
+// FollowRequestsCollection holds the Follow activities which are waiting for the approval
+// of a root actor that manually approves its followers.
+const FollowRequestsCollection = vocab.CollectionPath("followRequests")
+
+// ManuallyApprovesFollowers returns if the actor with "iri" has the manual follower approval mode enabled.
+func (c *Control) ManuallyApprovesFollowers(iri vocab.IRI) bool {
+	m := new(Metadata)
+	if err := c.Storage.LoadMetadata(iri, m); err != nil {
+		return false
+	}
+	return m.ManuallyApprovesFollowers
+}
+
+// contextTerms is a JSON-LD context which maps terms to IRIs.
+// NOTE(marius): jsonld.Context collapses to the IRI when it has a single element, so we can't use it for this.
+type contextTerms map[string]string
+
+func (c contextTerms) Collapse() any {
+	return c
+}
+
+// manuallyApprovesFollowersContext defines the term which is not part of the ActivityStreams vocabulary,
+// the same way Mastodon does it.
+var manuallyApprovesFollowersContext = contextTerms{"manuallyApprovesFollowers": "as:manuallyApprovesFollowers"}
+
+// manualApprovalActor is an actor which approves its followers manually.
+// NOTE(marius): the vocab.Actor type doesn't have the "manuallyApprovesFollowers" property,
+// so we set it on the JSON object the actor is encoded to.
+type manualApprovalActor struct {
+	vocab.Item
+}
+
+func (a manualApprovalActor) MarshalJSON() ([]byte, error) {
+	dat, err := vocab.MarshalJSON(a.Item)
+	if err != nil {
+		return nil, err
+	}
+	v, err := fastjson.ParseBytes(dat)
+	if err != nil {
+		return nil, err
+	}
+	ob, err := v.Object()
+	if err != nil {
+		return nil, err
+	}
+	ob.Set("manuallyApprovesFollowers", new(fastjson.Arena).NewTrue())
+	return v.MarshalTo(nil), nil
+}
+
+func (c *Control) SetManuallyApprovesFollowers(iri vocab.IRI, manual bool) error {
+	m := new(Metadata)
+	if err := c.Storage.LoadMetadata(iri, m); err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	m.ManuallyApprovesFollowers = manual
+	return c.Storage.SaveMetadata(iri, m)
+}
+
+// ensureCollection creates the collection at "colIRI" belonging to "owner", if it doesn't exist already.
+func (c *Control) ensureCollection(colIRI vocab.IRI, owner vocab.Item) error {
+	col, _ := c.Storage.Load(colIRI)
+	if vocab.IsObject(col) {
+		return nil
+	}
+	col = vocab.OrderedCollection{
+		ID:        colIRI,
+		Type:      vocab.OrderedCollectionType,
+		To:        vocab.ItemCollection{owner.GetLink()},
+		Published: TimeNow(),
+	}
+	_, err := c.Storage.Save(col)
+	return err
+}
+
+// AddFollowRequest saves the Follow activity to the follow requests collection of the followed actor.
+func (c *Control) AddFollowRequest(follow vocab.Item) error {
+	return vocab.OnActivity(follow, func(f *vocab.Activity) error {
+		if vocab.IsNil(f.Object) {
+			return errors.NotFoundf("Follow object is nil")
+		}
+		colIRI := FollowRequestsCollection.IRI(f.Object.GetLink())
+		if err := c.ensureCollection(colIRI, f.Object); err != nil {
+			return errors.Annotatef(err, "unable to save the follow requests collection %s", colIRI)
+		}
+		return c.Storage.AddTo(colIRI, f.GetLink())
+	})
+}
+
+// FollowRequests returns the pending Follow activities for "actor".
+func (c *Control) FollowRequests(actor vocab.Item) (vocab.ItemCollection, error) {
+	res, err := c.Storage.Load(FollowRequestsCollection.IRI(actor))
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	requests := make(vocab.ItemCollection, 0)
+	err = vocab.OnCollectionIntf(res, func(col vocab.CollectionInterface) error {
+		for _, it := range col.Collection() {
+			if vocab.IsIRI(it) {
+				loaded, err := c.Storage.Load(it.GetLink())
+				if err != nil {
+					c.Logger.WithContext(lw.Ctx{"iri": it.GetLink(), "err": err.Error()}).Warnf("Unable to load follow request")
+					continue
+				}
+				it = loaded
+			}
+			if it.GetType() == vocab.FollowType {
+				requests = append(requests, it)
+			}
+		}
+		return nil
+	})
+	return requests, err
+}
+
+func followResponse(typ vocab.ActivityVocabularyType, accepter vocab.Actor, f vocab.Follow) *vocab.Activity {
+	resp := new(vocab.Activity)
+	resp.Type = typ
+	_ = resp.To.Append(f.Actor.GetID())
+	resp.InReplyTo = f.GetID()
+	resp.Object = f.GetID()
+	resp.Actor = accepter
+	return resp
+}
+
+// RespondToFollowRequest sends an Accept or a Reject for the pending "follow" through the actor's outbox
+// and removes it from the follow requests collection.
+func (c *Control) RespondToFollowRequest(actor vocab.Actor, follow vocab.Item, typ vocab.ActivityVocabularyType) error {
+	lctx := lw.Ctx{"log": "processing", "op": typ}
+	p := processing.New(
+		processing.WithLogger(c.Logger.WithContext(lctx)),
+		processing.WithClient(c.DeliveryClient(actor, lctx)), processing.WithStorage(c.Storage),
+		processing.WithIDGenerator(GenerateID), processing.WithLocalIRIChecker(c.IRIHasLocalParent()),
+		processing.WithIRI(actor.ID),
+	)
+	err := vocab.OnActivity(follow, func(f *vocab.Activity) error {
+		resp := followResponse(typ, actor, *f)
+		_, err := p.ProcessClientActivity(resp, actor, vocab.Outbox.IRI(actor))
+		return err
+	})
+	if err != nil {
+		return errors.Annotatef(err, "unable to process %s for %s", typ, follow.GetLink())
+	}
+	return c.Storage.RemoveFrom(FollowRequestsCollection.IRI(actor), follow.GetLink())
+}
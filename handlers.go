@@ -76,7 +76,16 @@ func (o *oni) Error(err error) http.HandlerFunc {
 func (o *oni) setupOAuthRoutes(m chi.Router) {
 	m.HandleFunc("/oauth/authorize", o.Authorize)
 	m.HandleFunc("/oauth/token", o.Token)
+	m.Post("/oauth/introspect", o.IntrospectToken)
+	m.Post("/oauth/revoke", o.RevokeToken)
 	m.HandleFunc("/oauth/client", HandleOAuthClientRegistration(o))
+	m.Get("/oauth/client/{id}", o.ReadClientConfiguration)
+	m.Put("/oauth/client/{id}", o.UpdateClientConfiguration)
+	m.Delete("/oauth/client/{id}", o.DeleteClientConfiguration)
+	m.Get("/oauth/passkey", o.PasskeyPage)
+	m.Post("/oauth/passkey/register", o.BeginPasskeyRegistration)
+	m.Post("/oauth/passkey/register/{ceremony}", o.FinishPasskeyRegistration)
+	m.Post("/oauth/passkey/login", o.BeginPasskeyLogin)
 }
 
 func (o *oni) setupRoutes() {
@@ -84,9 +93,13 @@ func (o *oni) setupRoutes() {
 	if IsDev {
 		allowedOrigins = append(allowedOrigins, "http://*")
 	}
+	cfg := o.config()
+	if len(cfg.CORSOrigins) > 0 {
+		allowedOrigins = cfg.CORSOrigins
+	}
 	c := cors.New(cors.Options{
 		AllowedOrigins:   allowedOrigins,
-		AllowedMethods:   []string{"GET", "POST", "OPTIONS"},
+		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
 		AllowedHeaders:   []string{"*"},
 		AllowCredentials: true,
 		AllowOriginFunc:  checkOriginForBlockedActors,
@@ -97,7 +110,11 @@ func (o *oni) setupRoutes() {
 
 	m := chi.NewMux()
 
+	// NOTE(marius): the configuration has been validated when loading it
+	proxies, _ := parseTrustedProxies(cfg.TrustedProxies...)
+
 	rl := o.Logger.WithContext(lw.Ctx{"log": "req"})
+	m.Use(Proxied(proxies))
 	m.Use(o.OutOfOrderMw)
 	m.Use(Log(rl), c.Handler)
 
@@ -106,9 +123,14 @@ func (o *oni) setupRoutes() {
 	o.setupStaticRoutes(m)
 	o.setupWellKnownRoutes(m)
 
-	m.Mount("/debug", middleware.Profiler())
+	m.Route("/debug", func(m chi.Router) {
+		m.Use(o.AdminOnly)
+		m.Get("/status", o.ServeStatus)
+		m.Mount("/", middleware.Profiler())
+	})
+	m.With(o.AdminOnly).Get("/metrics", o.Metrics)
 
-	o.m = m
+	o.m.Store(m)
 }
 
 func (o *oni) setupStaticRoutes(m chi.Router) {
@@ -146,7 +168,7 @@ func (o *oni) setupActivityPubRoutes(m chi.Router) {
 		})
 		debugRequestMw := processing.RequestToDiskMw(o.StoragePath, InDebugMode.Load)
 		m.With(debugRequestMw).Group(func(m chi.Router) {
-			m.Method(http.MethodPost, "/*", o.ProcessActivity())
+			m.With(o.ValidateUploads).Method(http.MethodPost, "/*", o.ProcessActivity())
 			m.Method(http.MethodPost, "/proxyUrl", o.ProxyURL())
 		})
 	})
@@ -154,49 +176,68 @@ func (o *oni) setupActivityPubRoutes(m chi.Router) {
 
 var TimeNow = func() time.Time { return time.Now().Truncate(time.Millisecond).UTC() }
 
-func binDataFromItem(it vocab.Item, w io.Writer) (contentType ct.MediaType, updatedAt time.Time, err error) {
-	updatedAt = TimeNow()
-	err = vocab.OnObject(it, func(ob *vocab.Object) error {
+// binData is the decoded binary content of a media object.
+type binData struct {
+	io.ReadSeekCloser
+	contentType ct.MediaType
+	updatedAt   time.Time
+	eTag        string
+}
+
+func (c *Control) binDataFromItem(it vocab.Item) (*binData, error) {
+	bin := binData{updatedAt: TimeNow()}
+	err := vocab.OnObject(it, func(ob *vocab.Object) error {
 		if !mediaTypes.Match(ob.Type) {
 			return errors.UnsupportedMediaTypef("invalid object type: %s", ob.Type)
 		}
 		if len(ob.Content) == 0 {
 			return errors.BadRequestf("invalid object content")
 		}
-		typ, raw, err := getBinData(ob.Content, ob.MediaType)
-		if err != nil {
-			return err
-		}
-		_, err = w.Write(raw)
+		typ, r, err := c.binDataReader(ob.Content, ob.MediaType)
 		if err != nil {
 			return err
 		}
-		contentType, err = ct.ParseMediaType(typ)
+		contentType, err := ct.ParseMediaType(typ)
 		if err != nil {
+			_ = r.Close()
 			return err
 		}
-		updatedAt = ob.Published
+		bin.ReadSeekCloser = r
+		bin.contentType = contentType
+		// NOTE(marius): the ETag is computed from the data URI or the blob reference,
+		// so we don't need to read the content
+		bin.eTag = fmt.Sprintf(`"%2x"`, md5.Sum(ob.Content.First()))
+		bin.updatedAt = ob.Published
 		if !ob.Updated.IsZero() {
-			updatedAt = ob.Updated
+			bin.updatedAt = ob.Updated
 		}
 		return nil
 	})
-	return contentType, updatedAt, err
+	if err != nil {
+		return nil, err
+	}
+	return &bin, nil
 }
 
+// ServeBinData streams the content of the media object "it",
+// http.ServeContent handles the Range, If-Range and the other conditional request headers.
 func (o *oni) ServeBinData(it vocab.Item) http.HandlerFunc {
 	if vocab.IsNil(it) {
 		return o.Error(errors.NotFoundf("not found"))
 	}
-	buf := bytes.Buffer{}
-	contentType, updatedAt, err := binDataFromItem(it, &buf)
+	bin, err := o.binDataFromItem(it)
 	if err != nil {
 		return o.Error(err)
 	}
 
-	raw := buf.Bytes()
-	eTag := fmt.Sprintf(`"%2x"`, md5.Sum(raw))
-	return writeResponse(raw, it.GetType(), updatedAt, contentType.String(), eTag)
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer bin.Close()
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(objectCacheDuration.Seconds())))
+		w.Header().Set("Vary", "Accept")
+		w.Header().Set("Content-Type", bin.contentType.String())
+		w.Header().Set("ETag", bin.eTag)
+		http.ServeContent(w, r, "", bin.updatedAt, bin)
+	}
 }
 
 func sameishIRI(check, colIRI vocab.IRI) bool {
@@ -385,7 +426,7 @@ func cleanupMediaObjectFromActivity(act *vocab.Activity) error {
 
 func contentHasBinaryData(nlv vocab.NaturalLanguageValues) bool {
 	for _, nv := range nlv {
-		if bytes.HasPrefix(nv, []byte("data:")) {
+		if bytes.HasPrefix(nv, []byte("data:")) || isBlobRef(nv) {
 			return true
 		}
 	}
@@ -396,20 +437,23 @@ func cleanupMediaObject(o *vocab.Object) error {
 	if contentHasBinaryData(o.Content) {
 		// NOTE(marius): remove inline content from media ActivityPub objects
 		o.Content = make(vocab.NaturalLanguageValues)
-		_ = vocab.OnItem(o.URL, func(u vocab.Item) error {
-			if _, ok := u.(vocab.IRI); ok {
-				o.URL = o.ID
-			}
-			_ = vocab.OnObject(u, func(uu *vocab.Object) error {
-				uu.ID = o.ID
-				return nil
-			})
-			_ = vocab.OnLink(u, func(uu *vocab.Link) error {
-				uu.Href = o.ID
+		// NOTE(marius): the images with resized copies already link to them, and to the original, in their URL
+		if !vocab.IsItemCollection(o.URL) {
+			_ = vocab.OnItem(o.URL, func(u vocab.Item) error {
+				if _, ok := u.(vocab.IRI); ok {
+					o.URL = o.ID
+				}
+				_ = vocab.OnObject(u, func(uu *vocab.Object) error {
+					uu.ID = o.ID
+					return nil
+				})
+				_ = vocab.OnLink(u, func(uu *vocab.Link) error {
+					uu.Href = o.ID
+					return nil
+				})
 				return nil
 			})
-			return nil
-		})
+		}
 	}
 	var err error
 	o.Attachment, err = cleanupMediaObjectFromItem(o.Attachment)
@@ -424,7 +468,13 @@ const (
 func (o *oni) ServeActivityPubItem(it vocab.Item) http.HandlerFunc {
 	it, _ = cleanupMediaObjectFromItem(it)
 
-	dat, err := jsonld.WithContext(jsonld.IRI(vocab.ActivityBaseURI), jsonld.IRI(vocab.SecurityContextURI)).Marshal(it)
+	contexts := []jsonld.Collapsible{jsonld.IRI(vocab.ActivityBaseURI), jsonld.IRI(vocab.SecurityContextURI)}
+	var toMarshal any = it
+	if vocab.ActorTypes.Match(it.GetType()) && o.ManuallyApprovesFollowers(it.GetLink()) {
+		contexts = append(contexts, manuallyApprovesFollowersContext)
+		toMarshal = manualApprovalActor{Item: it}
+	}
+	dat, err := jsonld.WithContext(contexts...).Marshal(toMarshal)
 	if err != nil {
 		return o.Error(err)
 	}
@@ -499,7 +549,7 @@ func (o *oni) ValidateRequest(r *http.Request) (vocab.Actor, error) {
 	}
 
 	baseIRIs := make(vocab.IRIs, 0)
-	for _, act := range o.a {
+	for _, act := range o.actors() {
 		_ = baseIRIs.Append(act.GetID())
 	}
 
@@ -558,6 +608,7 @@ var iriNotFound = func(iri vocab.IRI) error {
 
 func getRequestAcceptedContentType(r *http.Request) func(...ct.MediaType) bool {
 	acceptableMediaTypes := []ct.MediaType{applicationJsonLD, applicationJsonActivity, applicationJson, fallbackHTML}
+	acceptableMediaTypes = append(acceptableMediaTypes, feedMediaTypes...)
 	accepted, _, _ := ct.GetAcceptableMediaType(r, acceptableMediaTypes)
 	return checkAcceptMediaType(accepted)
 }
@@ -702,8 +753,9 @@ func (o *oni) ServeHTML(it vocab.Item) http.HandlerFunc {
 			"ONI":   func() vocab.Actor { return oniActor },
 			"URLS":  actorURLs(oniActor),
 			"Title": titleFromItem(oniActor, it, r),
+			"Feeds": feedLinks(oniActor),
 			"CurrentURL": func() template.HTMLAttr {
-				return template.HTMLAttr(fmt.Sprintf("https://%s%s", r.Host, r.RequestURI))
+				return template.HTMLAttr(fmt.Sprintf("%s://%s%s", requestScheme(r), r.Host, r.RequestURI))
 			},
 			"oniCollectionParent": func() vocab.IRI {
 				if maybeParent, col := vocab.Split(it.GetID()); col != vocab.Unknown {
@@ -807,7 +859,7 @@ func (o *oni) loadBlockedActors(of vocab.Item) vocab.IRIs {
 }
 
 func requestRootIRI(r *http.Request) vocab.IRI {
-	return vocab.IRI("https://" + r.Host + "/")
+	return vocab.IRI(requestScheme(r) + "://" + r.Host + "/")
 }
 
 func uriRootIRI(u *url.URL) vocab.IRI {
@@ -843,6 +895,7 @@ func (o *oni) StopBlocked(next http.Handler) http.Handler {
 				for _, blockedIRI := range blocked {
 					if blockedIRI.Contains(act.ID, false) {
 						o.Logger.WithContext(lw.Ctx{"actor": act.ID, "by": oniActor.ID}).Warnf("Blocked")
+						blockedRequests.Inc()
 						o.Error(errors.NotFoundf("nothing to see here, please move along")).ServeHTTP(w, r)
 						return
 					}
@@ -867,6 +920,14 @@ func (o *oni) ActivityPubItem(w http.ResponseWriter, r *http.Request) {
 	iri := irif(r)
 
 	authActor, _ := o.loadAuthorizedActor(r, o.oniActor(r))
+	if err := o.checkScopes(r, ScopeRead); err != nil {
+		if _, col := vocab.Split(iri); col == vocab.Inbox {
+			o.Error(err).ServeHTTP(w, r)
+			return
+		}
+		// NOTE(marius): without the read scope the token gives access only to the public items
+		authActor = auth.AnonymousActor
+	}
 
 	colFilters := make(filters.Checks, 0)
 	if vocab.ValidCollectionIRI(iri) {
@@ -875,7 +936,10 @@ func (o *oni) ActivityPubItem(w http.ResponseWriter, r *http.Request) {
 		colFilters = filters.FromValues(r.URL.Query())
 		if vocab.ValidActivityCollection(whichCollection) {
 			accepts := getRequestAcceptedContentType(r)
-			if accepts(fallbackHTML) && (vocab.CollectionPaths{vocab.Outbox, vocab.Inbox}).Contains(whichCollection) {
+			_, feedRequested := requestedFeedType(r)
+			// NOTE(marius): the feeds use the same filters as the HTML representation of the outbox
+			if (accepts(fallbackHTML) && (vocab.CollectionPaths{vocab.Outbox, vocab.Inbox}).Contains(whichCollection)) ||
+				((accepts(feedMediaTypes...) || feedRequested) && whichCollection == vocab.Outbox) {
 				obFilters := make(filters.Checks, 0)
 				obFilters = append(obFilters, filters.NotNilItem)
 				if vocab.Outbox == whichCollection {
@@ -915,8 +979,8 @@ func (o *oni) ActivityPubItem(w http.ResponseWriter, r *http.Request) {
 
 	it, err := loadItemFromStorage(o.Storage, iri, colFilters...)
 	if err != nil {
-		if errors.IsNotFound(err) && len(o.a) == 1 && !hasPath(iri) {
-			if a := o.a[0]; !a.ID.Equals(iri, true) {
+		if actors := o.actors(); errors.IsNotFound(err) && len(actors) == 1 && !hasPath(iri) {
+			if a := actors[0]; !a.ID.Equals(iri, true) {
 				if _, cerr := checkIRIResolvesLocally(a.ID); cerr == nil {
 					err = errors.NewTemporaryRedirect(err, a.ID.String())
 				}
@@ -927,6 +991,10 @@ func (o *oni) ActivityPubItem(w http.ResponseWriter, r *http.Request) {
 	}
 
 	it = vocab.CleanRecipients(it)
+	if mt, ok := acceptedFeedType(it, r); ok {
+		o.ServeFeed(it, mt).ServeHTTP(w, r)
+		return
+	}
 	accepts := getItemAcceptedContentType(it, r)
 	switch {
 	case !accepts(html) && accepts(imageAny, audioAny, videoAny, pdfDocument):
@@ -942,7 +1010,7 @@ func (o *oni) ActivityPubItem(w http.ResponseWriter, r *http.Request) {
 
 func (o *oni) oniActor(r *http.Request) vocab.Actor {
 	reqIRI := baseIRI(r)
-	for _, a := range o.a {
+	for _, a := range o.actors() {
 		if reqIRI.Contains(a.ID, false) {
 			return a
 		}
@@ -952,7 +1020,9 @@ func (o *oni) oniActor(r *http.Request) vocab.Actor {
 	if err == nil {
 		if actor, err := vocab.ToActor(maybeActor); err == nil && !auth.AnonymousActor.Equals(actor) {
 			result = *actor
+			o.mu.Lock()
 			o.a = append(o.a, result)
+			o.mu.Unlock()
 		}
 	}
 	return result
@@ -1019,7 +1089,7 @@ const MaxItems = 20
 
 func acceptFollows(o oni, f vocab.Follow, p processing.P) error {
 	var accepter vocab.Actor
-	for _, act := range o.a {
+	for _, act := range o.actors() {
 		if toBeFollowed := f.Object.GetID(); act.ID.Equals(toBeFollowed, true) {
 			accepter = act
 			break
@@ -1040,16 +1110,11 @@ func acceptFollows(o oni, f vocab.Follow, p processing.P) error {
 		}
 	}
 
-	accept := new(vocab.Accept)
-	accept.Type = vocab.AcceptType
-	_ = accept.To.Append(follower)
-	accept.InReplyTo = f.GetID()
-	accept.Object = f.GetID()
+	accept := followResponse(vocab.AcceptType, accepter, f)
 
 	l := lw.Ctx{"from": follower.GetLink(), "to": accepter.GetLink()}
 
 	f.AttributedTo = accepter.GetLink()
-	accept.Actor = accepter
 	oniOutbox := vocab.Outbox.IRI(accepter)
 	_, err := p.ProcessClientActivity(accept, accepter, oniOutbox)
 	if err != nil {
@@ -1060,6 +1125,17 @@ func acceptFollows(o oni, f vocab.Follow, p processing.P) error {
 	return nil
 }
 
+func (o *oni) followIsManuallyApproved(follow vocab.Item) bool {
+	manual := false
+	_ = vocab.OnActivity(follow, func(f *vocab.Activity) error {
+		if !vocab.IsNil(f.Object) {
+			manual = o.ManuallyApprovesFollowers(f.Object.GetLink())
+		}
+		return nil
+	})
+	return manual
+}
+
 func (c *Control) IRIHasLocalParent() func(i vocab.IRI) bool {
 	return func(i vocab.IRI) bool {
 		u, err := i.URL()
@@ -1092,6 +1168,9 @@ func runWithRetry(fn ssm.Fn) ssm.Fn {
 
 // actorsCacheClean replaces the matching actor in the cached list oni uses
 func (o *oni) actorsCacheClean(which vocab.Item) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
 	for i, a := range o.a {
 		if !a.ID.Equals(which.GetID(), true) {
 			continue
@@ -1107,13 +1186,25 @@ func (o *oni) actorsCacheClean(which vocab.Item) error {
 // ProcessActivity handles POST requests to an ActivityPub actor's inbox/outbox, based on the CollectionType
 func (o *oni) ProcessActivity() processing.ActivityHandlerFn {
 	baseIRIs := make(vocab.IRIs, 0)
-	for _, act := range o.a {
+	for _, act := range o.actors() {
 		_ = baseIRIs.Append(act.GetID())
 	}
 
-	return func(receivedIn vocab.IRI, r *http.Request) (vocab.Item, int, error) {
-		var it vocab.Item
+	return func(receivedIn vocab.IRI, r *http.Request) (it vocab.Item, status int, err error) {
 		lctx := lw.Ctx{}
+		if processing.IsInbox(receivedIn) {
+			defer func() {
+				typ := "unknown"
+				if !vocab.IsNil(it) {
+					typ = typeToString(it.GetType())
+				}
+				result := "accepted"
+				if err != nil {
+					result = "rejected"
+				}
+				inboundActivities.Inc(typ, result)
+			}()
+		}
 
 		actor := o.oniActor(r)
 		lctx["oni"] = actor.GetLink()
@@ -1144,11 +1235,26 @@ func (o *oni) ProcessActivity() processing.ActivityHandlerFn {
 		if vocab.IsNil(it) {
 			return it, http.StatusInternalServerError, errors.BadRequestf("unable to unmarshal JSON request")
 		}
+		if err = o.checkScopes(r, o.activityScopes(it)...); err != nil {
+			lctx["err"] = err.Error()
+			o.Logger.WithContext(lctx).Warnf("Insufficient scope")
+			return it, errors.HttpStatus(err), err
+		}
+		if processing.IsOutbox(receivedIn) {
+			// NOTE(marius): the uploaded media is moved to the blob store, and only a reference to it is saved
+			if _, err = o.storeMedia(it); err != nil {
+				lctx["err"] = err.Error()
+				o.Logger.WithContext(lctx).Errorf("Failed storing media")
+				return it, http.StatusInternalServerError, err
+			}
+		}
+		newObject := processing.IsOutbox(receivedIn) && createsNewObject(it)
 
+		// NOTE(marius): the outbound deliveries are persisted to the delivery queue,
+		// and are sent to the remote inboxes by the RunDeliveryQueue worker.
 		processor := processing.New(
-			processing.Async,
 			processing.WithLogger(o.Logger.WithContext(lctx, lw.Ctx{"log": "processing"})),
-			processing.WithClient(o.Client(actor, lctx)), processing.WithStorage(o.Storage),
+			processing.WithClient(o.DeliveryClient(actor, lctx)), processing.WithStorage(o.Storage),
 			processing.WithIDGenerator(GenerateID), processing.WithLocalIRIChecker(o.IRIHasLocalParent()),
 		)
 
@@ -1157,8 +1263,13 @@ func (o *oni) ProcessActivity() processing.ActivityHandlerFn {
 			return it, http.StatusBadRequest, errors.Annotatef(err, "Can't save %q activity to %s", it.GetType(), receivedIn)
 		}
 
-		// NOTE(marius): if we received a Follow from a remote actor we automatically Accept
-		if processing.IsInbox(receivedIn) && it.GetType() == vocab.FollowType {
+		// NOTE(marius): if we received a Follow from a remote actor we automatically Accept,
+		// unless the followed actor approves its followers manually.
+		if processing.IsInbox(receivedIn) && it.GetType() == vocab.FollowType && o.followIsManuallyApproved(it) {
+			if err := o.AddFollowRequest(it); err != nil {
+				o.Logger.WithContext(lctx, lw.Ctx{"err": err.Error()}).Errorf("Unable to save follow request")
+			}
+		} else if processing.IsInbox(receivedIn) && it.GetType() == vocab.FollowType {
 			defer func() {
 				go ssm.Run(context.Background(), runWithRetry(func(ctx context.Context) ssm.Fn {
 					l := lw.Ctx{}
@@ -1175,6 +1286,14 @@ func (o *oni) ProcessActivity() processing.ActivityHandlerFn {
 				}))
 			}()
 		}
+		if newObject {
+			// NOTE(marius): the resized copies are saved under the IRI of the image, so we generate them only
+			// after the activity has been processed, and the ID of its object has been generated.
+			_ = vocab.OnActivity(it, func(act *vocab.Activity) error {
+				o.saveImageDerivatives(act.Object, lctx)
+				return nil
+			})
+		}
 		if processing.IsOutbox(receivedIn) && it.GetType() == vocab.UpdateType {
 			// NOTE(marius): if we updated one of the main actors, we replace it in the array
 			_ = vocab.OnActivity(it, func(upd *vocab.Activity) error {
@@ -1182,7 +1301,7 @@ func (o *oni) ProcessActivity() processing.ActivityHandlerFn {
 			})
 		}
 
-		status := http.StatusCreated
+		status = http.StatusCreated
 		if it.GetType() == vocab.DeleteType {
 			status = http.StatusGone
 		}
@@ -1216,6 +1335,10 @@ func (o *oni) ProxyURL() http.Handler {
 			errors.HandleError(errors.UnsupportedMediaTypef("content type is not supported by the proxy")).ServeHTTP(w, r)
 			return
 		}
+		if err := o.checkScopes(r, ScopeRead); err != nil {
+			errors.HandleError(err).ServeHTTP(w, r)
+			return
+		}
 		lctx := lw.Ctx{}
 		id := r.FormValue("id")
 		if id == "" {
@@ -7,10 +7,14 @@ import (
 	"encoding/base64"
 	"encoding/pem"
 	"fmt"
+	"io"
 	"net/http"
+	"net/url"
 	"path/filepath"
+	"strings"
 
 	vocab "github.com/go-ap/activitypub"
+	"github.com/go-ap/errors"
 )
 
 func DefaultValue(name string) vocab.NaturalLanguageValues {
@@ -107,6 +111,11 @@ func pemEncodePublicKey(prvKey *rsa.PrivateKey) string {
 	return string(pem.EncodeToMemory(&p))
 }
 
+// newActivityID returns the IRI of a new activity in the outbox of "author".
+func newActivityID(author vocab.Item) vocab.ID {
+	return vocab.Outbox.IRI(author).AddPath(fmt.Sprintf("%d", TimeNow().UnixMilli()))
+}
+
 func GenerateID(it vocab.Item, by vocab.Item) (vocab.ID, error) {
 	if it.GetID() != "" {
 		return it.GetID(), nil
@@ -114,12 +123,10 @@ func GenerateID(it vocab.Item, by vocab.Item) (vocab.ID, error) {
 
 	typ := it.GetType()
 
-	uuid := fmt.Sprintf("%d", TimeNow().UnixMilli())
-
 	if vocab.ActivityTypes.Match(typ) || vocab.IntransitiveActivityTypes.Match(typ) {
 		err := vocab.OnActivity(it, func(a *vocab.Activity) error {
 			return vocab.OnActor(a.Actor, func(author *vocab.Actor) error {
-				a.ID = vocab.Outbox.IRI(author).AddPath(uuid)
+				a.ID = newActivityID(author)
 				return nil
 			})
 		})
@@ -144,46 +151,86 @@ func GenerateID(it vocab.Item, by vocab.Item) (vocab.ID, error) {
 	return id, nil
 }
 
-func getBinData(nlVal vocab.NaturalLanguageValues, mt vocab.MimeType) (string, []byte, error) {
-	val := nlVal.First()
+// base64ReadSeeker decodes the base64 data on the fly, starting from the closest 4 byte block
+// before the current position, so it can be used for serving byte ranges.
+type base64ReadSeeker struct {
+	enc  []byte
+	size int64
+	off  int64
+	r    io.Reader
+}
 
+func newBase64ReadSeeker(enc []byte) *base64ReadSeeker {
+	// NOTE(marius): we decode using the unpadded encoding, so we can compute the size without decoding
+	enc = bytes.TrimRight(enc, "=")
+	return &base64ReadSeeker{enc: enc, size: int64(base64.RawStdEncoding.DecodedLen(len(enc)))}
+}
+
+func (b *base64ReadSeeker) Read(p []byte) (int, error) {
+	if b.off >= b.size {
+		return 0, io.EOF
+	}
+	if b.r == nil {
+		block := b.off / 3
+		b.r = base64.NewDecoder(base64.RawStdEncoding, bytes.NewReader(b.enc[block*4:]))
+		if skip := b.off - block*3; skip > 0 {
+			if _, err := io.CopyN(io.Discard, b.r, skip); err != nil {
+				return 0, err
+			}
+		}
+	}
+	n, err := b.r.Read(p)
+	b.off += int64(n)
+	return n, err
+}
+
+func (b *base64ReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += b.off
+	case io.SeekEnd:
+		offset += b.size
+	default:
+		return b.off, errors.Newf("invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return b.off, errors.Newf("negative position %d", offset)
+	}
+	if offset != b.off {
+		b.off = offset
+		b.r = nil
+	}
+	return offset, nil
+}
+
+// dataURIReader returns the content type of the data URI in "val", and a reader for its data,
+// which decodes the base64 encoded data on the fly. The data which is not base64 encoded is percent-decoded.
+//
+// https://datatracker.ietf.org/doc/html/rfc2397
+func dataURIReader(val []byte, mt vocab.MimeType) (string, io.ReadSeeker) {
 	contentType := "application/octet-stream"
 	if mt != "" {
 		contentType = string(mt)
 	}
-	colPos := bytes.Index(val, []byte{':'})
-	if colPos < 0 {
-		colPos = 0
+	header, data, ok := bytes.Cut(bytes.TrimPrefix(val, []byte("data:")), []byte{','})
+	if !ok {
+		return contentType, bytes.NewReader(val)
 	}
 
-	semicolPos := bytes.Index(val, []byte{';'})
-	if semicolPos > 0 {
-		contentType = string(val[colPos+1 : semicolPos])
+	params := bytes.Split(header, []byte{';'})
+	if len(params[0]) > 0 {
+		contentType = string(params[0])
 	}
-	comPos := bytes.Index(val, []byte{','})
-	var raw []byte
-	if semicolPos > 0 && comPos > 0 {
-		decType := val[semicolPos+1 : comPos]
-
-		switch string(decType) {
-		case "base64":
-			data := val[comPos+1:]
-
-			dec := base64.RawStdEncoding
-			raw = make([]byte, dec.DecodedLen(len(data)))
-			cnt, err := dec.Decode(raw, data)
-			if err != nil {
-				return contentType, raw, err
-			}
-			if cnt != len(data) {
-				// something wrong
-			}
-		}
-	} else {
-		raw = val
+	if len(params) > 1 && string(params[len(params)-1]) == "base64" {
+		return contentType, newBase64ReadSeeker(data)
 	}
-
-	return contentType, raw, nil
+	decoded, err := url.PathUnescape(string(data))
+	if err != nil {
+		// NOTE(marius): we keep the data as it is, if it's not correctly escaped
+		return contentType, bytes.NewReader(data)
+	}
+	return contentType, strings.NewReader(decoded)
 }
 
 func isData(nlVal vocab.NaturalLanguageValues) bool {
@@ -191,9 +238,9 @@ func isData(nlVal vocab.NaturalLanguageValues) bool {
 }
 
 func irif(r *http.Request) vocab.IRI {
-	return vocab.IRI("https://" + filepath.Join(r.Host, r.RequestURI))
+	return vocab.IRI(requestScheme(r) + "://" + filepath.Join(r.Host, r.RequestURI))
 }
 
 func baseIRI(r *http.Request) vocab.IRI {
-	return vocab.IRI("https://" + r.Host)
+	return vocab.IRI(requestScheme(r) + "://" + r.Host)
 }
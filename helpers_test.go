@@ -0,0 +1,107 @@
+package oni
+
+import (
+	"io"
+	"testing"
+
+	vocab "github.com/go-ap/activitypub"
+)
+
+func Test_dataURIReader(t *testing.T) {
+	tests := []struct {
+		name     string
+		val      string
+		mt       vocab.MimeType
+		wantType string
+		wantData string
+	}{
+		{
+			name:     "base64",
+			val:      "data:image/png;base64,iVBORw0KGgo=",
+			wantType: "image/png",
+			wantData: "\x89PNG\r\n\x1a\n",
+		},
+		{
+			name:     "base64 with parameters",
+			val:      "data:text/plain;charset=utf-8;base64,aGVsbG8gd29ybGQ=",
+			wantType: "text/plain",
+			wantData: "hello world",
+		},
+		{
+			name:     "base64 without padding",
+			val:      "data:text/plain;base64,aGVsbG8",
+			wantType: "text/plain",
+			wantData: "hello",
+		},
+		{
+			name:     "percent encoded",
+			val:      "data:text/plain,hello%20world%21",
+			wantType: "text/plain",
+			wantData: "hello world!",
+		},
+		{
+			name:     "percent encoded svg",
+			val:      "data:image/svg+xml,%3Csvg%20xmlns%3D%22http%3A%2F%2Fwww.w3.org%2F2000%2Fsvg%22%2F%3E",
+			wantType: "image/svg+xml",
+			wantData: `<svg xmlns="http://www.w3.org/2000/svg"/>`,
+		},
+		{
+			name:     "invalid escape is kept",
+			val:      "data:text/plain,100%",
+			wantType: "text/plain",
+			wantData: "100%",
+		},
+		{
+			name:     "without type uses the media type",
+			val:      "data:;base64,aGk=",
+			mt:       "text/markdown",
+			wantType: "text/markdown",
+			wantData: "hi",
+		},
+		{
+			name:     "without type or media type",
+			val:      "data:,hi",
+			wantType: "application/octet-stream",
+			wantData: "hi",
+		},
+		{
+			name:     "not a data URI",
+			val:      "hello",
+			mt:       "text/plain",
+			wantType: "text/plain",
+			wantData: "hello",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			typ, r := dataURIReader([]byte(tt.val), tt.mt)
+			if typ != tt.wantType {
+				t.Errorf("dataURIReader() type = %q, want %q", typ, tt.wantType)
+			}
+			data, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatalf("dataURIReader() read error = %s", err)
+			}
+			if string(data) != tt.wantData {
+				t.Errorf("dataURIReader() data = %q, want %q", data, tt.wantData)
+			}
+
+			size, err := r.Seek(0, io.SeekEnd)
+			if err != nil {
+				t.Fatalf("dataURIReader() seek error = %s", err)
+			}
+			if size != int64(len(tt.wantData)) {
+				t.Errorf("dataURIReader() size = %d, want %d", size, len(tt.wantData))
+			}
+			if len(tt.wantData) < 2 {
+				return
+			}
+			if _, err = r.Seek(1, io.SeekStart); err != nil {
+				t.Fatalf("dataURIReader() seek error = %s", err)
+			}
+			if rest, _ := io.ReadAll(r); string(rest) != tt.wantData[1:] {
+				t.Errorf("dataURIReader() data from offset 1 = %q, want %q", rest, tt.wantData[1:])
+			}
+		})
+	}
+}
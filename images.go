@@ -0,0 +1,423 @@
+package oni
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"strconv"
+
+	"git.sr.ht/~mariusor/lw"
+	ct "github.com/elnormous/contenttype"
+	vocab "github.com/go-ap/activitypub"
+	"github.com/go-ap/errors"
+	"github.com/nfnt/resize"
+)
+
+// derivativeWidths are the widths of the resized copies generated for the uploaded images.
+var derivativeWidths = []uint{320, 640, 1280}
+
+const jpegQuality = 90
+
+func decodeImage(contentType ct.MediaType, r io.Reader) (image.Image, error) {
+	switch {
+	case contentType.Matches(imageJpeg):
+		return jpeg.Decode(r)
+	case contentType.Matches(imagePng):
+		return png.Decode(r)
+	case contentType.Matches(imageGif):
+		return gif.Decode(r)
+	case contentType.Matches(imageSvg):
+		return svgDecode(r)
+	}
+	return nil, errors.Newf("invalid image type: %s", contentType)
+}
+
+// encodeImage encodes JPEG images as JPEG, and all the others as PNG, as we have no GIF animations to keep.
+func encodeImage(contentType ct.MediaType, img image.Image) (string, []byte, error) {
+	buf := bytes.Buffer{}
+	if contentType.Matches(imageJpeg) {
+		err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: jpegQuality})
+		return imageJpeg.String(), buf.Bytes(), err
+	}
+	err := png.Encode(&buf, img)
+	return imagePng.String(), buf.Bytes(), err
+}
+
+// exifOrientation returns the value of the Orientation tag from the TIFF structure of the EXIF data.
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var bo binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		bo = binary.LittleEndian
+	case "MM":
+		bo = binary.BigEndian
+	default:
+		return 1
+	}
+	off := int(bo.Uint32(tiff[4:8]))
+	if off+2 > len(tiff) {
+		return 1
+	}
+	entries := int(bo.Uint16(tiff[off:]))
+	for i := 0; i < entries; i++ {
+		e := off + 2 + i*12
+		if e+12 > len(tiff) {
+			break
+		}
+		if bo.Uint16(tiff[e:]) == 0x0112 {
+			if v := int(bo.Uint16(tiff[e+8:])); v >= 1 && v <= 8 {
+				return v
+			}
+			break
+		}
+	}
+	return 1
+}
+
+var exifHeader = []byte("Exif\x00\x00")
+
+// jpegStripMetadata removes the EXIF, XMP, IPTC and comment segments from the JPEG "data",
+// and returns the EXIF orientation, as the image needs to be rotated for it to be displayed correctly.
+func jpegStripMetadata(data []byte) ([]byte, int, error) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil, 0, errors.Newf("invalid JPEG data")
+	}
+	orientation := 1
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:2])
+	for i := 2; i < len(data); {
+		if data[i] != 0xFF || i+1 >= len(data) {
+			return nil, 0, errors.Newf("invalid JPEG marker at %d", i)
+		}
+		marker := data[i+1]
+		switch {
+		case marker == 0xFF:
+			// NOTE(marius): fill bytes
+			i++
+			continue
+		case marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7):
+			out.Write(data[i : i+2])
+			i += 2
+			continue
+		case marker == 0xDA:
+			// NOTE(marius): the entropy coded data follows the start of scan, we keep everything from here on
+			out.Write(data[i:])
+			return out.Bytes(), orientation, nil
+		}
+		if i+4 > len(data) {
+			return nil, 0, errors.Newf("truncated JPEG segment at %d", i)
+		}
+		end := i + 2 + int(binary.BigEndian.Uint16(data[i+2:]))
+		if end > len(data) {
+			return nil, 0, errors.Newf("truncated JPEG segment at %d", i)
+		}
+		segment := data[i:end]
+		switch {
+		case marker == 0xE1:
+			if payload := segment[4:]; bytes.HasPrefix(payload, exifHeader) {
+				orientation = exifOrientation(payload[len(exifHeader):])
+			}
+		case marker == 0xE0, marker == 0xE2, marker == 0xEE:
+			// NOTE(marius): JFIF, ICC color profile and Adobe segments are needed for rendering
+			out.Write(segment)
+		case marker >= 0xE3 && marker <= 0xEF, marker == 0xFE:
+			// NOTE(marius): the other application segments and the comments can contain metadata
+		default:
+			out.Write(segment)
+		}
+		i = end
+	}
+	return out.Bytes(), orientation, nil
+}
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// pngStripMetadata removes the text, time and EXIF chunks from the PNG "data", and returns the EXIF orientation.
+func pngStripMetadata(data []byte) ([]byte, int, error) {
+	if !bytes.HasPrefix(data, pngSignature) {
+		return nil, 0, errors.Newf("invalid PNG data")
+	}
+	orientation := 1
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(pngSignature)
+	for i := len(pngSignature); i < len(data); {
+		if i+8 > len(data) {
+			return nil, 0, errors.Newf("truncated PNG chunk at %d", i)
+		}
+		end := i + 12 + int(binary.BigEndian.Uint32(data[i:]))
+		if end > len(data) || end < i {
+			return nil, 0, errors.Newf("truncated PNG chunk at %d", i)
+		}
+		switch string(data[i+4 : i+8]) {
+		case "eXIf":
+			orientation = exifOrientation(data[i+8 : end-4])
+		case "tEXt", "zTXt", "iTXt", "tIME":
+		default:
+			out.Write(data[i:end])
+		}
+		i = end
+	}
+	return out.Bytes(), orientation, nil
+}
+
+// applyOrientation transforms "src" according to the EXIF orientation "o".
+func applyOrientation(src image.Image, o int) image.Image {
+	if o < 2 || o > 8 {
+		return src
+	}
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if o >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch o {
+			case 2:
+				dx, dy = w-1-x, y
+			case 3:
+				dx, dy = w-1-x, h-1-y
+			case 4:
+				dx, dy = x, h-1-y
+			case 5:
+				dx, dy = y, x
+			case 6:
+				dx, dy = h-1-y, x
+			case 7:
+				dx, dy = h-1-y, w-1-x
+			case 8:
+				dx, dy = y, w-1-x
+			}
+			dst.Set(dx, dy, src.At(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+	return dst
+}
+
+// sanitizeImage removes the metadata from JPEG and PNG images, which can contain the location where a photo
+// was taken, and applies the EXIF orientation, which would be lost otherwise.
+// The image is re-encoded only if it needs to be rotated.
+func sanitizeImage(contentType ct.MediaType, data []byte) ([]byte, error) {
+	var strip func([]byte) ([]byte, int, error)
+	switch {
+	case contentType.Matches(imageJpeg):
+		strip = jpegStripMetadata
+	case contentType.Matches(imagePng):
+		strip = pngStripMetadata
+	default:
+		return data, nil
+	}
+	stripped, orientation, err := strip(data)
+	if err != nil {
+		return nil, err
+	}
+	if orientation == 1 {
+		return stripped, nil
+	}
+	img, err := decodeImage(contentType, bytes.NewReader(stripped))
+	if err != nil {
+		return nil, err
+	}
+	_, raw, err := encodeImage(contentType, applyOrientation(img, orientation))
+	return raw, err
+}
+
+// imageDerivatives generates the resized copies of the Image objects in "it", and of the images attached to it.
+// The copies are saved as separate objects, and are linked from the "url" and "preview" properties of the image.
+// It returns if anything has been changed.
+func (c *Control) imageDerivatives(it vocab.Item) (bool, error) {
+	if vocab.IsNil(it) || vocab.IsIRI(it) {
+		return false, nil
+	}
+	changed := false
+	if vocab.IsItemCollection(it) {
+		err := vocab.OnItemCollection(it, func(col *vocab.ItemCollection) error {
+			for _, ob := range *col {
+				ch, err := c.imageDerivatives(ob)
+				if err != nil {
+					return err
+				}
+				changed = changed || ch
+			}
+			return nil
+		})
+		return changed, err
+	}
+	err := vocab.OnObject(it, func(ob *vocab.Object) error {
+		if ob.ID == "" {
+			return nil
+		}
+		ch, err := c.attachmentDerivatives(ob)
+		if err != nil {
+			return err
+		}
+		changed = ch
+		if ob.Type != vocab.ImageType || !isBlobRef(ob.Content.First()) || vocab.IsItemCollection(ob.URL) {
+			return nil
+		}
+		if err = c.saveDerivatives(ob); err != nil {
+			return errors.Annotatef(err, "unable to generate resized images for %s", ob.ID)
+		}
+		changed = true
+		return nil
+	})
+	return changed, err
+}
+
+// attachmentDerivatives generates the resized copies of the images attached to "ob".
+// The embedded images don't have IDs, so they get ones under the IRI of "ob", and are saved as separate objects,
+// with the recipients of "ob", so the original image can be served too.
+// NOTE(marius): the attachments which already have IDs are skipped, as they're not necessarily ours to save over.
+func (c *Control) attachmentDerivatives(ob *vocab.Object) (bool, error) {
+	var attachments vocab.ItemCollection
+	if vocab.IsItemCollection(ob.Attachment) {
+		_ = vocab.OnItemCollection(ob.Attachment, func(col *vocab.ItemCollection) error {
+			attachments = *col
+			return nil
+		})
+	} else if !vocab.IsNil(ob.Attachment) {
+		attachments = vocab.ItemCollection{ob.Attachment}
+	}
+
+	changed := false
+	for i, att := range attachments {
+		if vocab.IsNil(att) || vocab.IsIRI(att) || att.GetID() != "" {
+			continue
+		}
+		err := vocab.OnObject(att, func(img *vocab.Object) error {
+			if img.Type != vocab.ImageType || !isBlobRef(img.Content.First()) || vocab.IsItemCollection(img.URL) {
+				return nil
+			}
+			img.ID = ob.ID.AddPath("attachment", strconv.Itoa(i))
+			img.AttributedTo = ob.AttributedTo
+			img.To, img.CC, img.Bto, img.BCC, img.Audience = ob.To, ob.CC, ob.Bto, ob.BCC, ob.Audience
+			img.Published = ob.Published
+			if err := c.saveDerivatives(img); err != nil {
+				return errors.Annotatef(err, "unable to generate resized images for %s", img.ID)
+			}
+			if _, err := c.Storage.Save(img); err != nil {
+				return errors.Annotatef(err, "unable to save %s", img.ID)
+			}
+			changed = true
+			return nil
+		})
+		if err != nil {
+			return changed, err
+		}
+	}
+	return changed, nil
+}
+
+func (c *Control) saveDerivatives(ob *vocab.Object) error {
+	typ, raw, err := c.getBinData(ob.Content, ob.MediaType)
+	if err != nil {
+		return err
+	}
+	contentType, err := ct.ParseMediaType(typ)
+	if err != nil {
+		return err
+	}
+	if contentType.Matches(imageSvg) {
+		return nil
+	}
+	img, err := decodeImage(contentType, bytes.NewReader(raw))
+	if err != nil {
+		return err
+	}
+	size := img.Bounds().Size()
+
+	urls := vocab.ItemCollection{
+		&vocab.Link{Type: vocab.LinkType, Href: ob.ID, MediaType: vocab.MimeType(typ), Width: uint(size.X), Height: uint(size.Y)},
+	}
+	var preview vocab.Item
+	for _, width := range derivativeWidths {
+		if width >= uint(size.X) {
+			break
+		}
+		resized := resize.Resize(width, 0, img, resize.Lanczos3)
+		mediaType, data, err := encodeImage(contentType, resized)
+		if err != nil {
+			return err
+		}
+		derivative := &vocab.Object{
+			ID:           ob.ID.AddPath("size", strconv.Itoa(int(width))),
+			Type:         vocab.ImageType,
+			AttributedTo: ob.AttributedTo,
+			To:           ob.To,
+			CC:           ob.CC,
+			Bto:          ob.Bto,
+			BCC:          ob.BCC,
+			Audience:     ob.Audience,
+			Published:    ob.Published,
+			Name:         ob.Name,
+		}
+		if err = c.saveMedia(derivative, mediaType, bytes.NewReader(data)); err != nil {
+			return err
+		}
+		if _, err = c.Storage.Save(derivative); err != nil {
+			return errors.Annotatef(err, "unable to save %s", derivative.ID)
+		}
+
+		rs := resized.Bounds().Size()
+		link := &vocab.Link{
+			Type:      vocab.LinkType,
+			Href:      derivative.ID,
+			MediaType: vocab.MimeType(mediaType),
+			Width:     uint(rs.X),
+			Height:    uint(rs.Y),
+		}
+		if preview == nil {
+			preview = link
+		}
+		urls = append(urls, link)
+	}
+	ob.URL = urls
+	if preview != nil {
+		ob.Preview = preview
+	}
+	return nil
+}
+
+// createsNewObject returns if "it" is a Create activity for an object which doesn't have an ID yet,
+// which means that the ID, and the ones of the resized copies of its images, are generated by us.
+func createsNewObject(it vocab.Item) bool {
+	created := false
+	_ = vocab.OnActivity(it, func(act *vocab.Activity) error {
+		created = act.Type == vocab.CreateType && !vocab.IsNil(act.Object) && !vocab.IsIRI(act.Object) &&
+			!vocab.IsItemCollection(act.Object) && act.Object.GetID() == ""
+		return nil
+	})
+	return created
+}
+
+// saveImageDerivatives generates the resized copies for the images in the object "ob" which has just been saved.
+// Failing to do so is not fatal, as the original image can be used.
+func (o *oni) saveImageDerivatives(ob vocab.Item, lctx lw.Ctx) {
+	if vocab.IsNil(ob) {
+		return
+	}
+	it, err := o.Storage.Load(ob.GetLink())
+	if err != nil {
+		return
+	}
+	changed, err := o.imageDerivatives(it)
+	if err != nil {
+		o.Logger.WithContext(lctx, lw.Ctx{"iri": ob.GetLink(), "err": err.Error()}).Warnf("Unable to generate resized images")
+	}
+	if !changed {
+		return
+	}
+	if _, err = o.Storage.Save(it); err != nil {
+		o.Logger.WithContext(lctx, lw.Ctx{"iri": ob.GetLink(), "err": err.Error()}).Warnf("Unable to save resized images")
+	}
+}
@@ -0,0 +1,205 @@
+package oni
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+// tiffOrientation returns a TIFF structure with a single IFD entry, for the tag with the "value".
+func tiffOrientation(bo binary.ByteOrder, tag uint16, value uint16) []byte {
+	buf := bytes.Buffer{}
+	if bo == binary.LittleEndian {
+		buf.WriteString("II")
+	} else {
+		buf.WriteString("MM")
+	}
+	_ = binary.Write(&buf, bo, uint16(42))
+	_ = binary.Write(&buf, bo, uint32(8))
+	_ = binary.Write(&buf, bo, uint16(1))
+	_ = binary.Write(&buf, bo, tag)
+	_ = binary.Write(&buf, bo, uint16(3))
+	_ = binary.Write(&buf, bo, uint32(1))
+	_ = binary.Write(&buf, bo, value)
+	_ = binary.Write(&buf, bo, uint16(0))
+	_ = binary.Write(&buf, bo, uint32(0))
+	return buf.Bytes()
+}
+
+func testImage() image.Image {
+	img := image.NewNRGBA(image.Rect(0, 0, 4, 2))
+	for x := 0; x < 4; x++ {
+		img.Set(x, 0, color.NRGBA{R: 255, A: 255})
+		img.Set(x, 1, color.NRGBA{B: 255, A: 255})
+	}
+	return img
+}
+
+// jpegSegment returns a JPEG marker segment with the "payload".
+func jpegSegment(marker byte, payload []byte) []byte {
+	seg := []byte{0xFF, marker, 0, 0}
+	binary.BigEndian.PutUint16(seg[2:], uint16(len(payload)+2))
+	return append(seg, payload...)
+}
+
+// pngChunk returns a PNG chunk of type "typ" with the "data".
+func pngChunk(typ string, data []byte) []byte {
+	chunk := make([]byte, 8, 12+len(data))
+	binary.BigEndian.PutUint32(chunk, uint32(len(data)))
+	copy(chunk[4:], typ)
+	chunk = append(chunk, data...)
+	return binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+}
+
+func Test_exifOrientation(t *testing.T) {
+	tests := []struct {
+		name string
+		tiff []byte
+		want int
+	}{
+		{name: "empty", tiff: nil, want: 1},
+		{name: "invalid byte order", tiff: []byte("XX\x00\x2a\x00\x00\x00\x08\x00\x00"), want: 1},
+		{name: "little endian", tiff: tiffOrientation(binary.LittleEndian, 0x0112, 6), want: 6},
+		{name: "big endian", tiff: tiffOrientation(binary.BigEndian, 0x0112, 8), want: 8},
+		{name: "out of range value", tiff: tiffOrientation(binary.BigEndian, 0x0112, 9), want: 1},
+		{name: "other tag", tiff: tiffOrientation(binary.LittleEndian, 0x010F, 6), want: 1},
+		{name: "truncated entry", tiff: tiffOrientation(binary.LittleEndian, 0x0112, 6)[:16], want: 1},
+		{name: "offset outside the data", tiff: []byte("II\x2a\x00\xff\x00\x00\x00"), want: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := exifOrientation(tt.tiff); got != tt.want {
+				t.Errorf("exifOrientation() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_jpegStripMetadata(t *testing.T) {
+	buf := bytes.Buffer{}
+	if err := jpeg.Encode(&buf, testImage(), nil); err != nil {
+		t.Fatalf("unable to encode JPEG: %s", err)
+	}
+	plain := buf.Bytes()
+
+	withMetadata := func(segments ...[]byte) []byte {
+		data := append([]byte{}, plain[:2]...)
+		for _, seg := range segments {
+			data = append(data, seg...)
+		}
+		return append(data, plain[2:]...)
+	}
+	exif := jpegSegment(0xE1, append(append([]byte{}, exifHeader...), tiffOrientation(binary.BigEndian, 0x0112, 6)...))
+	xmp := jpegSegment(0xE1, []byte("http://ns.adobe.com/xap/1.0/\x00<x:xmpmeta/>"))
+	iptc := jpegSegment(0xED, []byte("Photoshop 3.0\x00location"))
+	comment := jpegSegment(0xFE, []byte("taken at home"))
+
+	tests := []struct {
+		name            string
+		data            []byte
+		wantOrientation int
+		wantRemoved     [][]byte
+		wantErr         bool
+	}{
+		{name: "not a JPEG", data: []byte("GIF89a"), wantErr: true},
+		{name: "without metadata", data: plain, wantOrientation: 1},
+		{
+			name:            "with metadata",
+			data:            withMetadata(exif, xmp, iptc, comment),
+			wantOrientation: 6,
+			wantRemoved:     [][]byte{exif, xmp, iptc, comment},
+		},
+		{name: "truncated segment", data: append([]byte{0xFF, 0xD8}, jpegSegment(0xFE, []byte("comment"))[:6]...), wantErr: true},
+		{name: "invalid marker", data: []byte{0xFF, 0xD8, 0x00, 0x00}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, orientation, err := jpegStripMetadata(tt.data)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("jpegStripMetadata() error = %v, wantErr %t", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if orientation != tt.wantOrientation {
+				t.Errorf("jpegStripMetadata() orientation = %d, want %d", orientation, tt.wantOrientation)
+			}
+			for _, seg := range tt.wantRemoved {
+				if bytes.Contains(got, seg) {
+					t.Errorf("jpegStripMetadata() kept the %X segment", seg[:2])
+				}
+			}
+			if _, err = jpeg.Decode(bytes.NewReader(got)); err != nil {
+				t.Errorf("jpegStripMetadata() returned an invalid JPEG: %s", err)
+			}
+		})
+	}
+}
+
+func Test_pngStripMetadata(t *testing.T) {
+	buf := bytes.Buffer{}
+	if err := png.Encode(&buf, testImage()); err != nil {
+		t.Fatalf("unable to encode PNG: %s", err)
+	}
+	plain := buf.Bytes()
+	// NOTE(marius): the IHDR chunk, which needs to be first, has 13 bytes of data
+	afterHeader := len(pngSignature) + 12 + 13
+
+	withChunks := func(chunks ...[]byte) []byte {
+		data := append([]byte{}, plain[:afterHeader]...)
+		for _, c := range chunks {
+			data = append(data, c...)
+		}
+		return append(data, plain[afterHeader:]...)
+	}
+	exif := pngChunk("eXIf", tiffOrientation(binary.LittleEndian, 0x0112, 3))
+	text := pngChunk("tEXt", []byte("Comment\x00taken at home"))
+	itxt := pngChunk("iTXt", []byte("XML:com.adobe.xmp\x00\x00\x00\x00\x00<x:xmpmeta/>"))
+	tm := pngChunk("tIME", []byte{0x07, 0xE9, 1, 2, 3, 4, 5})
+
+	tests := []struct {
+		name            string
+		data            []byte
+		wantOrientation int
+		wantRemoved     [][]byte
+		wantErr         bool
+	}{
+		{name: "not a PNG", data: []byte("GIF89a"), wantErr: true},
+		{name: "without metadata", data: plain, wantOrientation: 1},
+		{
+			name:            "with metadata",
+			data:            withChunks(exif, text, itxt, tm),
+			wantOrientation: 3,
+			wantRemoved:     [][]byte{exif, text, itxt, tm},
+		},
+		{name: "truncated chunk", data: plain[:afterHeader+4], wantErr: true},
+		{name: "chunk longer than the data", data: append(append([]byte{}, pngSignature...), pngChunk("tEXt", []byte("x"))[:10]...), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, orientation, err := pngStripMetadata(tt.data)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("pngStripMetadata() error = %v, wantErr %t", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if orientation != tt.wantOrientation {
+				t.Errorf("pngStripMetadata() orientation = %d, want %d", orientation, tt.wantOrientation)
+			}
+			for _, c := range tt.wantRemoved {
+				if bytes.Contains(got, c) {
+					t.Errorf("pngStripMetadata() kept the %s chunk", c[4:8])
+				}
+			}
+			if _, err = png.Decode(bytes.NewReader(got)); err != nil {
+				t.Errorf("pngStripMetadata() returned an invalid PNG: %s", err)
+			}
+		})
+	}
+}
@@ -10,6 +10,7 @@ import (
 const (
 	XdgRuntimeDir = "XDG_RUNTIME_DIR"
 	XdgDataDir    = "XDG_DATA_HOME"
+	XdgConfigDir  = "XDG_CONFIG_HOME"
 	XdgHome       = "HOME"
 )
 
@@ -27,6 +28,18 @@ func DataPath(appName string) string {
 	return filepath.Join(dh, appName)
 }
 
+func ConfigPath(appName string) string {
+	ch := os.Getenv(XdgConfigDir)
+	if ch == "" {
+		if userPath := os.Getenv(XdgHome); userPath == "" {
+			ch = "/etc"
+		} else {
+			ch = filepath.Join(userPath, ".config")
+		}
+	}
+	return filepath.Join(ch, appName)
+}
+
 func RuntimePath() string {
 	path := BaseRuntimeDir
 	if runtimeDir := os.Getenv(XdgRuntimeDir); runtimeDir != "" {
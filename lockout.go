@@ -0,0 +1,248 @@
+package oni
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"git.sr.ht/~mariusor/lw"
+	vocab "github.com/go-ap/activitypub"
+	"github.com/go-ap/errors"
+)
+
+const (
+	// DefaultMaxAuthFailures is the number of failed authentication attempts after which an address gets locked out.
+	DefaultMaxAuthFailures = 5
+	// DefaultAuthLockout is how long the first lockout lasts, every following one lasts twice as long.
+	DefaultAuthLockout = time.Minute
+
+	maxAuthLockout = 24 * time.Hour
+	// maxTrackedAttempts is the limit for the actor and address pairs for which we keep the failed attempts.
+	maxTrackedAttempts = 10_000
+
+	factorPassword = "password"
+	factorOTP      = "otp"
+)
+
+// Lockout is the state of the failed authentication attempts for an actor from a client address.
+type Lockout struct {
+	Actor    vocab.IRI `json:"actor"`
+	IP       string    `json:"ip"`
+	Factor   string    `json:"factor"`
+	Failures int       `json:"failures"`
+	Last     time.Time `json:"last"`
+	Until    time.Time `json:"until,omitempty"`
+}
+
+func (l Lockout) Locked(t time.Time) bool {
+	return l.Until.After(t)
+}
+
+type lockoutKey struct {
+	actor  vocab.IRI
+	ip     string
+	factor string
+}
+
+// authLimiter limits the password authentication attempts for the login page, the OAuth2 password grant and SSH.
+// After the configured number of failures for an actor from the same address, the address is locked out
+// for that actor, and each new failure doubles the duration of the lockout.
+type authLimiter struct {
+	mu       sync.Mutex
+	attempts map[lockoutKey]*Lockout
+}
+
+func newAuthLimiter() *authLimiter {
+	return &authLimiter{attempts: make(map[lockoutKey]*Lockout)}
+}
+
+// addrIP returns the IP address without the port.
+func addrIP(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// lockedOut is returned for the attempts made while the address is locked out.
+type lockedOut struct {
+	until time.Time
+}
+
+func (l lockedOut) Error() string {
+	return "too many failed authentication attempts, retry after " + l.until.UTC().Format(time.RFC3339)
+}
+
+func (l lockedOut) RetryAfter() time.Duration {
+	return time.Until(l.until).Round(time.Second)
+}
+
+func isLockedOut(err error) (lockedOut, bool) {
+	l := lockedOut{}
+	return l, errors.As(err, &l)
+}
+
+// prune forgets the failures older than the longest lockout, expected to be called with the lock held.
+func (a *authLimiter) prune(now time.Time) {
+	for k, l := range a.attempts {
+		if !l.Locked(now) && now.Sub(l.Last) > maxAuthLockout {
+			delete(a.attempts, k)
+		}
+	}
+}
+
+// evictOldest forgets the oldest failures which haven't resulted in a lockout, to make room for new ones.
+// It returns false if all the tracked addresses are locked out.
+func (a *authLimiter) evictOldest(now time.Time) bool {
+	var oldest *lockoutKey
+	var last time.Time
+	for k, l := range a.attempts {
+		if l.Locked(now) || (oldest != nil && !l.Last.Before(last)) {
+			continue
+		}
+		oldest = &k
+		last = l.Last
+	}
+	if oldest == nil {
+		return false
+	}
+	delete(a.attempts, *oldest)
+	return true
+}
+
+// Check returns a lockedOut error if the address in "key" is locked out for its actor.
+func (a *authLimiter) Check(key lockoutKey) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if l, ok := a.attempts[key]; ok && l.Locked(time.Now()) {
+		return lockedOut{until: l.Until}
+	}
+	return nil
+}
+
+// Fail records a failed attempt, and returns the lockout if the address got locked out by it.
+func (a *authLimiter) Fail(key lockoutKey, maxFailures int, lockout time.Duration) (Lockout, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now()
+	a.prune(now)
+
+	l, ok := a.attempts[key]
+	if !ok {
+		if len(a.attempts) >= maxTrackedAttempts && !a.evictOldest(now) {
+			return Lockout{}, false
+		}
+		l = &Lockout{Actor: key.actor, IP: key.ip, Factor: key.factor}
+		a.attempts[key] = l
+	}
+	l.Failures++
+	l.Last = now
+	if l.Failures < maxFailures {
+		return *l, false
+	}
+	d := lockout << (l.Failures - maxFailures)
+	if d <= 0 || d > maxAuthLockout {
+		d = maxAuthLockout
+	}
+	l.Until = now.Add(d)
+	return *l, true
+}
+
+// Success forgets the failed attempts for the actor and address in "key".
+func (a *authLimiter) Success(key lockoutKey) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	delete(a.attempts, key)
+}
+
+// List returns the addresses with failed attempts, the locked out ones first.
+func (a *authLimiter) List() []Lockout {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now()
+	a.prune(now)
+	res := make([]Lockout, 0, len(a.attempts))
+	for _, l := range a.attempts {
+		res = append(res, *l)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Locked(now) != res[j].Locked(now) {
+			return res[i].Locked(now)
+		}
+		return res[i].Last.After(res[j].Last)
+	})
+	return res
+}
+
+// Clear removes the failed attempts and lockouts for "actor", or for all actors if it's empty.
+func (a *authLimiter) Clear(actor vocab.IRI) int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	cnt := 0
+	for k := range a.attempts {
+		if actor == "" || k.actor.Equals(actor, true) {
+			delete(a.attempts, k)
+			cnt++
+		}
+	}
+	return cnt
+}
+
+// checkPassword runs the password "check" for "actor" with the attempts made from "addr" limited by the authLimiter.
+// The "method" is used for logging and counting the lockouts.
+func (o *oni) checkPassword(method string, actor vocab.IRI, addr string, check func() error) error {
+	return o.limitAttempts(lockoutKey{actor: actor, ip: addrIP(addr), factor: factorPassword}, method, check)
+}
+
+// checkOTP runs the second factor "check" for "actor", limited separately from the passwords,
+// as a correct password would otherwise reset the failed attempts of guessing the code.
+func (o *oni) checkOTP(method string, actor vocab.IRI, addr string, check func() error) error {
+	return o.limitAttempts(lockoutKey{actor: actor, ip: addrIP(addr), factor: factorOTP}, method, check)
+}
+
+// isLocalActor returns if "iri" belongs to an actor in our storage.
+func (o *oni) isLocalActor(iri vocab.IRI) bool {
+	if iri == "" {
+		return false
+	}
+	it, err := o.Storage.Load(iri)
+	return err == nil && !vocab.IsNil(it) && vocab.ActorTypes.Match(it.GetType())
+}
+
+func (o *oni) limitAttempts(key lockoutKey, method string, check func() error) error {
+	if err := o.limiter.Check(key); err != nil {
+		return err
+	}
+	if err := check(); err != nil {
+		conf := o.config().Auth
+		if conf.FailureDelay > 0 {
+			time.Sleep(conf.FailureDelay)
+		}
+		// NOTE(marius): the actors come from the requests, so we don't keep track of the attempts for
+		// the ones which don't exist, as they would only fill up the limiter.
+		if !o.isLocalActor(key.actor) {
+			return err
+		}
+		maxFailures, lockout := conf.MaxFailures, conf.Lockout
+		if maxFailures <= 0 {
+			maxFailures = DefaultMaxAuthFailures
+		}
+		if lockout <= 0 {
+			lockout = DefaultAuthLockout
+		}
+		if l, locked := o.limiter.Fail(key, maxFailures, lockout); locked {
+			authLockouts.Inc(method)
+			lctx := lw.Ctx{"actor": key.actor, "ip": key.ip, "factor": key.factor, "method": method, "failures": l.Failures, "until": l.Until}
+			o.Logger.WithContext(lctx).Warnf("Locked out after failed authentication attempts")
+		}
+		return err
+	}
+	o.limiter.Success(key)
+	return nil
+}
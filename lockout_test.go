@@ -0,0 +1,143 @@
+package oni
+
+import (
+	"testing"
+	"time"
+
+	vocab "github.com/go-ap/activitypub"
+)
+
+func Test_authLimiter_Fail(t *testing.T) {
+	key := lockoutKey{actor: "https://example.com", ip: "192.0.2.1", factor: factorPassword}
+	tests := []struct {
+		name         string
+		failures     int
+		maxFailures  int
+		lockout      time.Duration
+		wantLocked   bool
+		wantDuration time.Duration
+	}{
+		{name: "below the limit", failures: 4, maxFailures: 5, lockout: time.Minute},
+		{name: "at the limit", failures: 5, maxFailures: 5, lockout: time.Minute, wantLocked: true, wantDuration: time.Minute},
+		{name: "doubles after the limit", failures: 7, maxFailures: 5, lockout: time.Minute, wantLocked: true, wantDuration: 4 * time.Minute},
+		{name: "capped", failures: 20, maxFailures: 5, lockout: time.Minute, wantLocked: true, wantDuration: maxAuthLockout},
+		{name: "capped on overflow", failures: 100, maxFailures: 1, lockout: time.Minute, wantLocked: true, wantDuration: maxAuthLockout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newAuthLimiter()
+			var l Lockout
+			var locked bool
+			for i := 0; i < tt.failures; i++ {
+				l, locked = a.Fail(key, tt.maxFailures, tt.lockout)
+			}
+			if locked != tt.wantLocked {
+				t.Fatalf("Fail() locked = %t, want %t", locked, tt.wantLocked)
+			}
+			if l.Failures != tt.failures {
+				t.Errorf("Fail() failures = %d, want %d", l.Failures, tt.failures)
+			}
+			if !tt.wantLocked {
+				return
+			}
+			if d := l.Until.Sub(l.Last); d != tt.wantDuration {
+				t.Errorf("Fail() lockout = %s, want %s", d, tt.wantDuration)
+			}
+		})
+	}
+}
+
+func Test_authLimiter_Check(t *testing.T) {
+	locked := lockoutKey{actor: "https://example.com", ip: "192.0.2.1", factor: factorPassword}
+	tests := []struct {
+		name       string
+		key        lockoutKey
+		wantLocked bool
+	}{
+		{name: "locked out", key: locked, wantLocked: true},
+		{name: "other address", key: lockoutKey{actor: locked.actor, ip: "192.0.2.2", factor: locked.factor}},
+		{name: "other actor", key: lockoutKey{actor: "https://example.com/jdoe", ip: locked.ip, factor: locked.factor}},
+		{name: "other factor", key: lockoutKey{actor: locked.actor, ip: locked.ip, factor: factorOTP}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newAuthLimiter()
+			for i := 0; i < DefaultMaxAuthFailures; i++ {
+				a.Fail(locked, DefaultMaxAuthFailures, DefaultAuthLockout)
+			}
+			err := a.Check(tt.key)
+			l, ok := isLockedOut(err)
+			if ok != tt.wantLocked {
+				t.Fatalf("Check() error = %v, want locked out %t", err, tt.wantLocked)
+			}
+			if ok && (l.RetryAfter() <= 0 || l.RetryAfter() > DefaultAuthLockout) {
+				t.Errorf("Check() retry after = %s, want at most %s", l.RetryAfter(), DefaultAuthLockout)
+			}
+		})
+	}
+}
+
+func Test_authLimiter_Success(t *testing.T) {
+	key := lockoutKey{actor: "https://example.com", ip: "192.0.2.1", factor: factorPassword}
+	a := newAuthLimiter()
+	for i := 0; i < DefaultMaxAuthFailures-1; i++ {
+		a.Fail(key, DefaultMaxAuthFailures, DefaultAuthLockout)
+	}
+	a.Success(key)
+	if l, locked := a.Fail(key, DefaultMaxAuthFailures, DefaultAuthLockout); locked || l.Failures != 1 {
+		t.Errorf("Fail() after Success() = %d failures, locked %t, want 1 failure and not locked", l.Failures, locked)
+	}
+}
+
+func Test_authLimiter_Clear(t *testing.T) {
+	keys := []lockoutKey{
+		{actor: "https://example.com", ip: "192.0.2.1", factor: factorPassword},
+		{actor: "https://example.com", ip: "192.0.2.2", factor: factorOTP},
+		{actor: "https://example.com/jdoe", ip: "192.0.2.1", factor: factorPassword},
+	}
+	tests := []struct {
+		name     string
+		actor    vocab.IRI
+		want     int
+		wantLeft int
+	}{
+		{name: "one actor", actor: "https://example.com", want: 2, wantLeft: 1},
+		{name: "one actor with trailing slash", actor: "https://example.com/jdoe/", want: 1, wantLeft: 2},
+		{name: "unknown actor", actor: "https://example.org", want: 0, wantLeft: 3},
+		{name: "all actors", actor: "", want: 3, wantLeft: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newAuthLimiter()
+			for _, k := range keys {
+				a.Fail(k, DefaultMaxAuthFailures, DefaultAuthLockout)
+			}
+			if got := a.Clear(tt.actor); got != tt.want {
+				t.Errorf("Clear() = %d, want %d", got, tt.want)
+			}
+			if left := len(a.List()); left != tt.wantLeft {
+				t.Errorf("List() after Clear() = %d items, want %d", left, tt.wantLeft)
+			}
+		})
+	}
+}
+
+func Test_addrIP(t *testing.T) {
+	tests := []struct {
+		addr string
+		want string
+	}{
+		{addr: "192.0.2.1:4711", want: "192.0.2.1"},
+		{addr: "192.0.2.1", want: "192.0.2.1"},
+		{addr: "[2001:db8::1]:4711", want: "2001:db8::1"},
+		{addr: "2001:db8::1", want: "2001:db8::1"},
+		{addr: "@", want: "@"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			if got := addrIP(tt.addr); got != tt.want {
+				t.Errorf("addrIP(%q) = %q, want %q", tt.addr, got, tt.want)
+			}
+		})
+	}
+}
@@ -3,11 +3,13 @@ package oni
 import (
 	"bytes"
 	"net/http"
+	"strconv"
 	"time"
 
 	"git.sr.ht/~mariusor/lw"
 	bfmt "git.sr.ht/~mariusor/sizefmt"
 	ct "github.com/elnormous/contenttype"
+	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 )
 
@@ -27,6 +29,14 @@ func Log(l lw.Logger) func(next http.Handler) http.Handler {
 			t1 := time.Now().Truncate(time.Millisecond).UTC()
 			defer func() {
 				entry.Write(ww.Status(), ww.BytesWritten(), ww.Header(), time.Since(t1), nil)
+
+				route := "unmatched"
+				if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+					route = rctx.RoutePattern()
+				}
+				status := strconv.Itoa(ww.Status())
+				httpRequests.Inc(route, r.Method, status)
+				httpDuration.ObserveSince(t1, route, r.Method, status)
 			}()
 
 			next.ServeHTTP(ww, middleware.WithLogEntry(r, entry))
@@ -74,6 +84,9 @@ func req(l lw.Logger, r *http.Request) reqLogger {
 		"method": r.Method,
 		"iri":    irif(r),
 	}
+	if r.RemoteAddr != "" {
+		ctx["addr"] = r.RemoteAddr
+	}
 
 	if acc := r.Header.Get("Accept"); acc != "" {
 		want, _, _ := ct.GetAcceptableMediaTypeFromHeader(acc, allMediaTypes)
@@ -0,0 +1,341 @@
+package oni
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"io"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.sr.ht/~mariusor/lw"
+	vocab "github.com/go-ap/activitypub"
+	"github.com/go-ap/errors"
+)
+
+const (
+	mastodonOutbox         = "outbox.json"
+	mastodonActor          = "actor.json"
+	mastodonBlockedDomains = "blocked_domains.csv"
+	mastodonFollowing      = "following_accounts.csv"
+)
+
+// MastodonImport holds the results of importing a Mastodon account archive.
+type MastodonImport struct {
+	Activities int
+	Media      int
+	Blocked    int
+	Skipped    int
+	// Following are the accounts from the archive, which need to be followed manually,
+	// as resolving them requires WebFinger requests to the remote servers.
+	Following []string
+}
+
+type mastodonArchive struct {
+	*zip.Reader
+	files map[string]*zip.File
+}
+
+func (m mastodonArchive) read(name string) ([]byte, error) {
+	f, ok := m.files[strings.TrimPrefix(name, "/")]
+	if !ok {
+		return nil, errors.NotFoundf("%s not found in archive", name)
+	}
+	r, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+func (m mastodonArchive) readCSV(name string) ([][]string, error) {
+	raw, err := m.read(name)
+	if err != nil {
+		return nil, err
+	}
+	r := csv.NewReader(strings.NewReader(string(raw)))
+	r.FieldsPerRecord = -1
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, errors.Annotatef(err, "invalid %s", name)
+	}
+	// NOTE(marius): some of the Mastodon CSV exports have a header row, some don't
+	if len(records) > 0 && len(records[0]) > 0 && strings.Contains(records[0][0], " ") {
+		records = records[1:]
+	}
+	return records, nil
+}
+
+// mastodonImporter rewrites the items from the archive to belong to the ONI actor.
+type mastodonImporter struct {
+	c     *Control
+	actor vocab.Actor
+	from  vocab.IRI
+	zip   mastodonArchive
+	used  map[vocab.IRI]struct{}
+	res   *MastodonImport
+}
+
+func (m *mastodonImporter) rewriteIRI(iri vocab.IRI) vocab.IRI {
+	switch {
+	case iri.Equals(m.from, true):
+		return m.actor.ID
+	case iri.Equals(vocab.Followers.IRI(m.from), true):
+		return vocab.Followers.IRI(m.actor)
+	case iri.Equals(vocab.Following.IRI(m.from), true):
+		return vocab.Following.IRI(m.actor)
+	}
+	return iri
+}
+
+func (m *mastodonImporter) rewriteRecipients(col vocab.ItemCollection) vocab.ItemCollection {
+	res := make(vocab.ItemCollection, 0, len(col))
+	for _, it := range col {
+		res = append(res, m.rewriteIRI(it.GetLink()))
+	}
+	return res
+}
+
+// generateID uses GenerateID for a new local IRI for "it",
+// waiting for the next millisecond if the IRI has already been used during the import.
+func (m *mastodonImporter) generateID(it vocab.Item, by vocab.Item) (vocab.ID, error) {
+	for {
+		id, err := GenerateID(it, by)
+		if err != nil {
+			return id, err
+		}
+		if _, ok := m.used[id]; !ok {
+			m.used[id] = struct{}{}
+			return id, nil
+		}
+		_ = vocab.OnObject(it, func(ob *vocab.Object) error {
+			ob.ID = ""
+			return nil
+		})
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func mediaObjectType(mediaType string) vocab.ActivityVocabularyType {
+	switch {
+	case strings.HasPrefix(mediaType, "image/"):
+		return vocab.ImageType
+	case strings.HasPrefix(mediaType, "video/"):
+		return vocab.VideoType
+	case strings.HasPrefix(mediaType, "audio/"):
+		return vocab.AudioType
+	}
+	return vocab.DocumentType
+}
+
+// importAttachment saves the media file referenced by "att" as a local Image, Video or Audio object,
+// and returns the object without its inline content, to be used as an attachment.
+func (m *mastodonImporter) importAttachment(att vocab.Item, parent *vocab.Object, idx int) (vocab.Item, error) {
+	ob, err := vocab.ToObject(att)
+	if err != nil {
+		return att, nil
+	}
+	if vocab.IsNil(ob.URL) {
+		return att, nil
+	}
+	u, err := ob.URL.GetLink().URL()
+	if err != nil {
+		return att, nil
+	}
+	data, err := m.zip.read(u.Path)
+	if err != nil {
+		m.c.Logger.WithContext(lw.Ctx{"path": u.Path, "err": err.Error()}).Warnf("Unable to load media attachment")
+		return nil, nil
+	}
+
+	media := new(vocab.Object)
+	media.ID = parent.ID.AddPath("attachment", strconv.Itoa(idx))
+	media.Type = mediaObjectType(string(ob.MediaType))
+	media.MediaType = ob.MediaType
+	media.Name = ob.Name
+	media.Summary = ob.Summary
+	media.AttributedTo = m.actor.ID
+	media.To = parent.To
+	media.CC = parent.CC
+	media.Published = parent.Published
+	media.URL = media.ID
+	if err = m.c.saveMedia(media, string(ob.MediaType), bytes.NewReader(data)); err != nil {
+		return nil, err
+	}
+	if _, err = m.c.Storage.Save(media); err != nil {
+		return nil, errors.Annotatef(err, "unable to save media %s", media.ID)
+	}
+	m.res.Media++
+
+	cl := *media
+	cl.Content = nil
+	return &cl, nil
+}
+
+func (m *mastodonImporter) importActivity(it vocab.Item) error {
+	act, err := vocab.ToActivity(it)
+	if err != nil || (act.Type != vocab.CreateType && act.Type != vocab.AnnounceType) {
+		m.res.Skipped++
+		return nil
+	}
+
+	published := act.Published
+	imported := new(vocab.Activity)
+	imported.Type = act.Type
+	imported.To = m.rewriteRecipients(act.To)
+	imported.CC = m.rewriteRecipients(act.CC)
+	imported.Published = published
+	imported.Updated = published
+
+	// NOTE(marius): GenerateID needs the full actor to build the outbox IRI
+	imported.Actor = &m.actor
+	if _, err = m.generateID(imported, &m.actor); err != nil {
+		return err
+	}
+	imported.Actor = m.actor.ID
+
+	if act.Type == vocab.CreateType {
+		ob, err := vocab.ToObject(act.Object)
+		if err != nil {
+			m.res.Skipped++
+			return nil
+		}
+		obj := *ob
+		obj.ID = ""
+		if _, err = GenerateID(&obj, imported); err != nil {
+			return err
+		}
+		obj.URL = obj.ID
+		obj.AttributedTo = m.actor.ID
+		obj.To = imported.To
+		obj.CC = imported.CC
+		obj.Replies = nil
+		obj.Likes = nil
+		obj.Shares = nil
+		if obj.Published.IsZero() {
+			obj.Published = published
+		}
+		var toImport vocab.ItemCollection
+		if vocab.IsItemCollection(ob.Attachment) {
+			_ = vocab.OnItemCollection(ob.Attachment, func(col *vocab.ItemCollection) error {
+				toImport = *col
+				return nil
+			})
+		} else if !vocab.IsNil(ob.Attachment) {
+			toImport = vocab.ItemCollection{ob.Attachment}
+		}
+		attachments := make(vocab.ItemCollection, 0, len(toImport))
+		for i, att := range toImport {
+			a, err := m.importAttachment(att, &obj, i)
+			if err != nil {
+				return err
+			}
+			if a != nil {
+				attachments = append(attachments, a)
+			}
+		}
+		obj.Attachment = nil
+		if len(attachments) > 0 {
+			obj.Attachment = attachments
+		}
+		if _, err = m.c.Storage.Save(&obj); err != nil {
+			return errors.Annotatef(err, "unable to save object %s", obj.ID)
+		}
+		imported.Object = obj.ID
+	} else {
+		imported.Object = act.Object.GetLink()
+	}
+
+	if _, err = m.c.Storage.Save(imported); err != nil {
+		return errors.Annotatef(err, "unable to save activity %s", imported.ID)
+	}
+	if err = m.c.Storage.AddTo(vocab.Outbox.IRI(m.actor), imported.ID); err != nil {
+		return errors.Annotatef(err, "unable to add activity %s to outbox", imported.ID)
+	}
+	m.res.Activities++
+	return nil
+}
+
+// ImportMastodon imports the posts, media and blocked domains from the Mastodon account archive at "archivePath"
+// into the outbox of "actor". The activities are saved directly to storage, so nothing is sent to remote servers.
+func (c *Control) ImportMastodon(actor vocab.Actor, archivePath string) (*MastodonImport, error) {
+	zr, err := zip.OpenReader(archivePath)
+	if err != nil {
+		return nil, errors.Annotatef(err, "unable to open archive")
+	}
+	defer zr.Close()
+
+	arch := mastodonArchive{Reader: &zr.Reader, files: make(map[string]*zip.File)}
+	for _, f := range zr.File {
+		arch.files[path.Clean(f.Name)] = f
+	}
+
+	m := mastodonImporter{c: c, actor: actor, zip: arch, used: make(map[vocab.IRI]struct{}), res: new(MastodonImport)}
+	if raw, err := arch.read(mastodonActor); err == nil {
+		if it, err := vocab.UnmarshalJSON(raw); err == nil {
+			m.from = it.GetLink()
+		}
+	}
+
+	raw, err := arch.read(mastodonOutbox)
+	if err != nil {
+		return nil, err
+	}
+	it, err := vocab.UnmarshalJSON(raw)
+	if err != nil {
+		return nil, errors.Annotatef(err, "invalid %s", mastodonOutbox)
+	}
+	if err = c.ensureCollection(vocab.Outbox.IRI(actor), actor); err != nil {
+		return nil, err
+	}
+	err = vocab.OnCollectionIntf(it, func(col vocab.CollectionInterface) error {
+		items := col.Collection()
+		// NOTE(marius): we import the oldest items first, so the IDs follow the same order as the original ones
+		published := func(it vocab.Item) time.Time {
+			var t time.Time
+			_ = vocab.OnObject(it, func(ob *vocab.Object) error {
+				t = ob.Published
+				return nil
+			})
+			return t
+		}
+		sorted := slices.Clone(items)
+		slices.SortStableFunc(sorted, func(a, b vocab.Item) int {
+			return published(a).Compare(published(b))
+		})
+		for _, it := range sorted {
+			if err := m.importActivity(it); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return m.res, err
+	}
+
+	if records, err := arch.readCSV(mastodonBlockedDomains); err == nil {
+		urls := make([]string, 0, len(records))
+		for _, rec := range records {
+			if len(rec) == 0 || strings.TrimSpace(rec[0]) == "" {
+				continue
+			}
+			urls = append(urls, "https://"+strings.TrimSpace(rec[0]))
+		}
+		c.BlockFor(actor, urls...)
+		m.res.Blocked = len(urls)
+	}
+
+	if records, err := arch.readCSV(mastodonFollowing); err == nil {
+		for _, rec := range records {
+			if len(rec) > 0 && strings.TrimSpace(rec[0]) != "" {
+				m.res.Following = append(m.res.Following, strings.TrimSpace(rec[0]))
+			}
+		}
+	}
+	return m.res, nil
+}
@@ -0,0 +1,247 @@
+package oni
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"git.sr.ht/~mariusor/storage-all"
+	vocab "github.com/go-ap/activitypub"
+	"github.com/go-ap/filters"
+)
+
+// NOTE(marius): this is a minimal implementation of the Prometheus text exposition format,
+// as we only need counters and histograms, and we don't want to pull in the whole client library for that.
+
+const (
+	counterType   = "counter"
+	histogramType = "histogram"
+)
+
+var defaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type series struct {
+	labels []string
+	value  float64
+	counts []uint64
+}
+
+type metric struct {
+	name    string
+	help    string
+	typ     string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+func newCounter(name, help string, labels ...string) *metric {
+	return &metric{name: name, help: help, typ: counterType, labels: labels, series: make(map[string]*series)}
+}
+
+func newHistogram(name, help string, labels ...string) *metric {
+	m := newCounter(name, help, labels...)
+	m.typ = histogramType
+	m.buckets = defaultBuckets
+	return m
+}
+
+func (m *metric) get(values []string) *series {
+	key := strings.Join(values, "\xff")
+	s, ok := m.series[key]
+	if !ok {
+		s = &series{labels: slices.Clone(values), counts: make([]uint64, len(m.buckets)+1)}
+		m.series[key] = s
+	}
+	return s
+}
+
+// Inc increments the counter for the label "values".
+func (m *metric) Inc(values ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.get(values).value++
+}
+
+// Observe adds "v" to the histogram for the label "values".
+func (m *metric) Observe(v float64, values ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.get(values)
+	s.value += v
+	i, _ := slices.BinarySearch(m.buckets, v)
+	s.counts[i]++
+}
+
+// ObserveSince adds the seconds elapsed since "t" to the histogram.
+func (m *metric) ObserveSince(t time.Time, values ...string) {
+	m.Observe(time.Since(t).Seconds(), values...)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names, values []string, extra ...string) string {
+	pieces := make([]string, 0, len(names)+1)
+	for i, n := range names {
+		pieces = append(pieces, n+`="`+labelEscaper.Replace(values[i])+`"`)
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pieces = append(pieces, extra[i]+`="`+extra[i+1]+`"`)
+	}
+	if len(pieces) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pieces, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func (m *metric) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, _ = fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.typ)
+	keys := make([]string, 0, len(m.series))
+	for k := range m.series {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	for _, k := range keys {
+		s := m.series[k]
+		if m.typ == counterType {
+			_, _ = fmt.Fprintf(w, "%s%s %s\n", m.name, formatLabels(m.labels, s.labels), formatFloat(s.value))
+			continue
+		}
+		cnt := uint64(0)
+		for i, b := range m.buckets {
+			cnt += s.counts[i]
+			_, _ = fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, formatLabels(m.labels, s.labels, "le", formatFloat(b)), cnt)
+		}
+		cnt += s.counts[len(m.buckets)]
+		_, _ = fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, formatLabels(m.labels, s.labels, "le", "+Inf"), cnt)
+		_, _ = fmt.Fprintf(w, "%s_sum%s %s\n", m.name, formatLabels(m.labels, s.labels), formatFloat(s.value))
+		_, _ = fmt.Fprintf(w, "%s_count%s %d\n", m.name, formatLabels(m.labels, s.labels), cnt)
+	}
+}
+
+var (
+	httpRequests = newCounter("oni_http_requests_total",
+		"Number of HTTP requests by route, method and status.", "route", "method", "status")
+	httpDuration = newHistogram("oni_http_request_duration_seconds",
+		"Duration of HTTP requests by route, method and status.", "route", "method", "status")
+	inboundActivities = newCounter("oni_inbound_activities_total",
+		"Number of activities received in inboxes by type and result.", "type", "result")
+	outboundDeliveries = newCounter("oni_outbound_deliveries_total",
+		"Number of deliveries to remote inboxes by host and result.", "host", "result")
+	blockedRequests = newCounter("oni_blocked_requests_total",
+		"Number of requests refused because they were authorized by a blocked actor.")
+	authLockouts = newCounter("oni_auth_lockouts_total",
+		"Number of lockouts after failed password authentication attempts by method.", "method")
+	storageDuration = newHistogram("oni_storage_operation_duration_seconds",
+		"Duration of storage operations by type.", "op")
+
+	allMetrics = []*metric{httpRequests, httpDuration, inboundActivities, outboundDeliveries, blockedRequests, authLockouts, storageDuration}
+)
+
+// Metrics serves the collected metrics in the Prometheus text format.
+func (o *oni) Metrics(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	buf := bufio.NewWriter(w)
+	for _, m := range allMetrics {
+		m.write(buf)
+	}
+
+	pending, dead := o.Queue().Count()
+	_, _ = fmt.Fprintf(buf, "# HELP oni_delivery_queue_jobs Number of jobs in the outbound delivery queue by state.\n")
+	_, _ = fmt.Fprintf(buf, "# TYPE oni_delivery_queue_jobs gauge\n")
+	_, _ = fmt.Fprintf(buf, "oni_delivery_queue_jobs{state=\"pending\"} %d\n", pending)
+	_, _ = fmt.Fprintf(buf, "oni_delivery_queue_jobs{state=\"dead\"} %d\n", dead)
+	_ = buf.Flush()
+}
+
+// metricsTransport counts the outbound POST requests, which are the deliveries to remote inboxes.
+type metricsTransport struct {
+	http.RoundTripper
+}
+
+func (t metricsTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	res, err := t.RoundTripper.RoundTrip(r)
+	if r.Method != http.MethodPost {
+		return res, err
+	}
+	result := "success"
+	if err != nil || res.StatusCode >= http.StatusBadRequest {
+		result = "failure"
+	}
+	outboundDeliveries.Inc(r.URL.Host, result)
+	return res, err
+}
+
+// timedStorage records the duration of the storage operations used by the ActivityPub processing.
+type timedStorage struct {
+	storage.FullStorage
+}
+
+// Unwrap returns the storage backend, for checking the optional interfaces it implements.
+func (s timedStorage) Unwrap() storage.FullStorage {
+	return s.FullStorage
+}
+
+func instrumentStorage(st storage.FullStorage) storage.FullStorage {
+	if st == nil {
+		return nil
+	}
+	return timedStorage{st}
+}
+
+// storageAs returns the storage as T, looking through the wrappers, like timedStorage,
+// which hide the optional interfaces of the storage backend.
+func storageAs[T any](st any) (T, bool) {
+	for st != nil {
+		if t, ok := st.(T); ok {
+			return t, true
+		}
+		w, ok := st.(interface{ Unwrap() storage.FullStorage })
+		if !ok {
+			break
+		}
+		st = w.Unwrap()
+	}
+	var t T
+	return t, false
+}
+
+func (s timedStorage) Load(iri vocab.IRI, checks ...filters.Check) (vocab.Item, error) {
+	defer storageDuration.ObserveSince(time.Now(), "load")
+	return s.FullStorage.Load(iri, checks...)
+}
+
+func (s timedStorage) Save(it vocab.Item) (vocab.Item, error) {
+	defer storageDuration.ObserveSince(time.Now(), "save")
+	return s.FullStorage.Save(it)
+}
+
+func (s timedStorage) Delete(it vocab.Item) error {
+	defer storageDuration.ObserveSince(time.Now(), "delete")
+	return s.FullStorage.Delete(it)
+}
+
+func (s timedStorage) AddTo(col vocab.IRI, it ...vocab.Item) error {
+	defer storageDuration.ObserveSince(time.Now(), "add-to")
+	return s.FullStorage.AddTo(col, it...)
+}
+
+func (s timedStorage) RemoveFrom(col vocab.IRI, it ...vocab.Item) error {
+	defer storageDuration.ObserveSince(time.Now(), "remove-from")
+	return s.FullStorage.RemoveFrom(col, it...)
+}
@@ -0,0 +1,323 @@
+package oni
+
+import (
+	"fmt"
+	"net/url"
+
+	"git.sr.ht/~mariusor/lw"
+	vocab "github.com/go-ap/activitypub"
+	"github.com/go-ap/errors"
+	"github.com/go-ap/processing"
+	"github.com/openshift/osin"
+)
+
+// TokenLister is implemented by the storage backends which can enumerate their OAuth2 authorize and access records.
+type TokenLister interface {
+	ListAuthorize() ([]*osin.AuthorizeData, error)
+	ListAccess() ([]*osin.AccessData, error)
+}
+
+// actorCollections are the collections of the local actors which are not part of the vocab.Actor properties.
+var actorCollections = vocab.CollectionPaths{
+	processing.BlockedCollection, processing.IgnoredCollection, FollowRequestsCollection,
+}
+
+// Migration copies the contents of one storage to another.
+//
+// As the storage backends can't list all the items they contain, the items are found by walking the
+// properties and collections of the actors owning the OAuth2 clients.
+// Every step checks first if the destination already has the data, so an interrupted migration
+// can be resumed by running it again.
+type Migration struct {
+	From *Control
+	To   *Control
+
+	visited map[vocab.IRI]struct{}
+	queue   vocab.IRIs
+	cols    vocab.IRIs
+
+	Items       int
+	Collections int
+	Clients     int
+	Tokens      int
+}
+
+func itemIRIs(items ...vocab.Item) vocab.IRIs {
+	iris := make(vocab.IRIs, 0)
+	for _, it := range items {
+		if vocab.IsNil(it) {
+			continue
+		}
+		if vocab.IsItemCollection(it) {
+			_ = vocab.OnItemCollection(it, func(col *vocab.ItemCollection) error {
+				iris = append(iris, itemIRIs(*col...)...)
+				return nil
+			})
+			continue
+		}
+		iris = append(iris, it.GetLink())
+	}
+	return iris
+}
+
+// references returns the IRIs of the items referenced by "it" which need to be migrated too.
+func references(it vocab.Item) vocab.IRIs {
+	refs := make(vocab.IRIs, 0)
+	_ = vocab.OnObject(it, func(ob *vocab.Object) error {
+		refs = append(refs, itemIRIs(ob.AttributedTo, ob.InReplyTo, ob.Attachment, ob.Icon, ob.Image,
+			ob.Tag, ob.Replies, ob.Likes, ob.Shares, ob.Context, ob.Generator, ob.Preview)...)
+		return nil
+	})
+	if vocab.ActivityTypes.Match(it.GetType()) || vocab.IntransitiveActivityTypes.Match(it.GetType()) {
+		_ = vocab.OnIntransitiveActivity(it, func(act *vocab.IntransitiveActivity) error {
+			refs = append(refs, itemIRIs(act.Actor, act.Target, act.Origin, act.Instrument, act.Result)...)
+			return nil
+		})
+		_ = vocab.OnActivity(it, func(act *vocab.Activity) error {
+			refs = append(refs, itemIRIs(act.Object)...)
+			return nil
+		})
+	}
+	if vocab.ActorTypes.Match(it.GetType()) {
+		_ = vocab.OnActor(it, func(act *vocab.Actor) error {
+			refs = append(refs, itemIRIs(act.Inbox, act.Outbox, act.Followers, act.Following, act.Liked, act.Streams)...)
+			for _, col := range actorCollections {
+				refs = append(refs, col.IRI(act))
+			}
+			return nil
+		})
+	}
+	return refs
+}
+
+func (m *Migration) enqueue(iris ...vocab.IRI) {
+	for _, iri := range iris {
+		if iri == "" || iri.Equals(vocab.PublicNS, true) {
+			continue
+		}
+		if _, ok := m.visited[iri]; ok {
+			continue
+		}
+		m.visited[iri] = struct{}{}
+		m.queue = append(m.queue, iri)
+	}
+}
+
+func (m *Migration) copyCollection(iri vocab.IRI, it vocab.Item) error {
+	members := make(vocab.IRIs, 0)
+	err := vocab.OnCollectionIntf(it, func(col vocab.CollectionInterface) error {
+		members = col.Collection().IRIs()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	m.enqueue(members...)
+
+	existing, err := m.To.loadCollectionItems(iri)
+	if err != nil {
+		if !errors.IsNotFound(err) {
+			return err
+		}
+		// NOTE(marius): we save the collection object without its items, which are added below
+		var empty vocab.Item
+		_ = vocab.OnOrderedCollection(it, func(col *vocab.OrderedCollection) error {
+			cl := *col
+			cl.OrderedItems = nil
+			cl.TotalItems = 0
+			empty = &cl
+			return nil
+		})
+		if empty == nil {
+			_ = vocab.OnCollection(it, func(col *vocab.Collection) error {
+				cl := *col
+				cl.Items = nil
+				cl.TotalItems = 0
+				empty = &cl
+				return nil
+			})
+		}
+		if empty == nil {
+			return errors.Newf("unsupported collection type %s", typeToString(it.GetType()))
+		}
+		if _, err = m.To.Storage.Save(empty); err != nil {
+			return err
+		}
+	}
+	for _, member := range members {
+		if existing.Contains(member) {
+			continue
+		}
+		if err = m.To.Storage.AddTo(iri, member); err != nil {
+			return errors.Annotatef(err, "unable to add %s", member)
+		}
+	}
+	m.cols = append(m.cols, iri)
+	m.Collections++
+	return nil
+}
+
+func (m *Migration) copyItem(iri vocab.IRI) error {
+	it, err := m.From.Storage.Load(iri)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			// NOTE(marius): remote items which we don't have a local copy of
+			return nil
+		}
+		return err
+	}
+	if vocab.IsNil(it) {
+		return nil
+	}
+	if vocab.CollectionTypes.Match(it.GetType()) {
+		return m.copyCollection(iri, it)
+	}
+	m.enqueue(references(it)...)
+
+	if _, err = m.To.Storage.Load(iri); err != nil {
+		if _, err = m.To.Storage.Save(it); err != nil {
+			return err
+		}
+	}
+	for _, ref := range blobRefs(it) {
+		if err = m.copyBlob(ref); err != nil {
+			return err
+		}
+	}
+	md := new(Metadata)
+	if err = m.From.Storage.LoadMetadata(iri, md); err == nil {
+		if err = m.To.Storage.SaveMetadata(iri, md); err != nil {
+			return errors.Annotatef(err, "unable to save metadata")
+		}
+	}
+	m.Items++
+	return nil
+}
+
+func (m *Migration) copyBlob(ref []byte) error {
+	if f, err := m.To.Blobs().Open(ref); err == nil {
+		return f.Close()
+	}
+	f, err := m.From.Blobs().Open(ref)
+	if err != nil {
+		return errors.Annotatef(err, "unable to load media")
+	}
+	defer f.Close()
+	_, err = m.To.Blobs().Put(f)
+	return err
+}
+
+func (m *Migration) copyClients() error {
+	clients, err := m.From.Storage.ListClients()
+	if err != nil {
+		return errors.Annotatef(err, "unable to list OAuth2 clients")
+	}
+	for _, cl := range clients {
+		if _, err = m.To.Storage.GetClient(cl.GetId()); err != nil {
+			if err = m.To.Storage.SaveClient(cl); err != nil {
+				return errors.Annotatef(err, "unable to save OAuth2 client %s", cl.GetId())
+			}
+		}
+		m.Clients++
+
+		// NOTE(marius): the clients are identified by the IRIs of their actors
+		if u, err := url.Parse(cl.GetId()); err == nil && u.Host != "" {
+			m.enqueue(vocab.IRI(cl.GetId()))
+		}
+		if iri, ok := cl.GetUserData().(vocab.IRI); ok {
+			m.enqueue(iri)
+		}
+	}
+	return nil
+}
+
+func (m *Migration) copyTokens() error {
+	src, ok := storageAs[TokenLister](m.From.Storage)
+	if !ok {
+		m.From.Logger.Warnf("The source storage can't list OAuth2 tokens, they need to be authorized again")
+		return nil
+	}
+	authorizations, err := src.ListAuthorize()
+	if err != nil {
+		return errors.Annotatef(err, "unable to list OAuth2 authorizations")
+	}
+	for _, a := range authorizations {
+		if _, err = m.To.Storage.LoadAuthorize(a.Code); err == nil {
+			continue
+		}
+		if err = m.To.Storage.SaveAuthorize(a); err != nil {
+			return errors.Annotatef(err, "unable to save OAuth2 authorization")
+		}
+		m.Tokens++
+	}
+	accesses, err := src.ListAccess()
+	if err != nil {
+		return errors.Annotatef(err, "unable to list OAuth2 access tokens")
+	}
+	for _, a := range accesses {
+		if _, err = m.To.Storage.LoadAccess(a.AccessToken); err == nil {
+			continue
+		}
+		if err = m.To.Storage.SaveAccess(a); err != nil {
+			return errors.Annotatef(err, "unable to save OAuth2 access token")
+		}
+		m.Tokens++
+	}
+	return nil
+}
+
+// Run copies the clients, the items reachable from their actors, the collections and the OAuth2 tokens.
+func (m *Migration) Run() error {
+	m.visited = make(map[vocab.IRI]struct{})
+
+	if err := m.copyClients(); err != nil {
+		return err
+	}
+	for i := 1; len(m.queue) > 0; i++ {
+		iri := m.queue[0]
+		m.queue = m.queue[1:]
+		if err := m.copyItem(iri); err != nil {
+			return errors.Annotatef(err, "unable to migrate %s", iri)
+		}
+		if i%1000 == 0 {
+			m.From.Logger.WithContext(lw.Ctx{"items": m.Items, "collections": m.Collections}).Infof("Migrating")
+		}
+	}
+	return m.copyTokens()
+}
+
+// Verify checks that all the migrated items and collection members can be loaded from the destination storage.
+func (m *Migration) Verify() error {
+	missing := 0
+	for iri := range m.visited {
+		if _, err := m.From.Storage.Load(iri); err != nil {
+			continue
+		}
+		if _, err := m.To.Storage.Load(iri); err != nil {
+			m.To.Logger.WithContext(lw.Ctx{"iri": iri, "err": err.Error()}).Warnf("Missing from destination")
+			missing++
+		}
+	}
+	for _, iri := range m.cols {
+		from, _ := m.From.loadCollectionItems(iri)
+		to, _ := m.To.loadCollectionItems(iri)
+		if len(to) < len(from) {
+			m.To.Logger.WithContext(lw.Ctx{"iri": iri, "from": len(from), "to": len(to)}).Warnf("Collection count mismatch")
+			missing++
+		}
+	}
+	fromClients, _ := m.From.Storage.ListClients()
+	toClients, _ := m.To.Storage.ListClients()
+	if len(toClients) < len(fromClients) {
+		m.To.Logger.WithContext(lw.Ctx{"from": len(fromClients), "to": len(toClients)}).Warnf("OAuth2 clients count mismatch")
+		missing++
+	}
+	if missing > 0 {
+		return errors.Newf("verification failed, %d mismatches found", missing)
+	}
+	return nil
+}
+
+func (m *Migration) String() string {
+	return fmt.Sprintf("%d items, %d collections, %d OAuth2 clients, %d OAuth2 tokens", m.Items, m.Collections, m.Clients, m.Tokens)
+}
@@ -9,6 +9,7 @@ import (
 	"io"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 
 	"git.sr.ht/~mariusor/lw"
@@ -26,6 +27,13 @@ type authModel struct {
 	State        string `json:"state"`
 }
 
+// challengeModel is the response to a correct password for the clients which asked for JSON,
+// when the actor has to send the second factor next.
+type challengeModel struct {
+	Challenge string `json:"challenge"`
+	State     string `json:"state,omitempty"`
+}
+
 func AuthorizeURL(actor vocab.Actor, state string) string {
 	clientIRI := actor.ID
 	u, _ := clientIRI.URL()
@@ -47,7 +55,67 @@ func (o *oni) loadAccountFromPost(actor vocab.Actor, r *http.Request) error {
 
 	o.Logger.WithContext(lw.Ctx{"pass": mask.S(pw)}).Infof("Received")
 
-	return o.Storage.PasswordCheck(actor.GetLink(), []byte(pw))
+	return o.checkPassword("login", actor.GetLink(), r.RemoteAddr, func() error {
+		return o.Storage.PasswordCheck(actor.GetLink(), []byte(pw))
+	})
+}
+
+// loadSecondFactorFromPost checks the TOTP or recovery code from the second step of the login page,
+// for the login identified by "challenge".
+func (o *oni) loadSecondFactorFromPost(actor vocab.Actor, challenge string, r *http.Request) error {
+	iri, ok := o.challenges.Take(challenge)
+	if !ok || !iri.Equals(actor.GetLink(), true) {
+		return errors.Unauthorizedf("the login has expired, please sign in again")
+	}
+	return o.checkOTP("login", iri, r.RemoteAddr, func() error {
+		return o.CheckSecondFactor(iri, r.PostFormValue("_otp"))
+	})
+}
+
+// renderLogin renders the login page for the authorization request, which asks for the password, or when
+// "challenge" is not empty, for the second factor.
+func (o *oni) renderLogin(w http.ResponseWriter, r *http.Request, resp *osin.Response, ar *osin.AuthorizeRequest, challenge string) {
+	m := login{title: "Login"}
+	m.backURL = backURL(r)
+
+	clientIRI := ar.Client.GetId()
+	if !strings.HasPrefix(clientIRI, "http") {
+		clientIRI = fmt.Sprintf("https://%s", clientIRI)
+	}
+	it, err := o.Storage.Load(vocab.IRI(clientIRI))
+	if err != nil {
+		o.Logger.WithContext(lw.Ctx{"err": err, "iri": clientIRI}).Errorf("Invalid client")
+		errors.HandleError(errors.Unauthorizedf("Invalid client")).ServeHTTP(w, r)
+		return
+	}
+	if vocab.IsNil(it) {
+		resp.SetError(osin.E_INVALID_REQUEST, fmt.Sprintf("Invalid client: %v", err))
+		o.redirectOrOutput(resp, w, r)
+		return
+	}
+	m.client = it
+	m.state = ar.State
+	m.scopes = describeScopes(ar.Scope)
+	if challenge != "" {
+		m.title = "Two-factor authentication"
+		m.challenge = challenge
+	} else if keys, _ := o.Passkeys(o.oniActor(r).ID); len(keys) > 0 {
+		m.passkeys = true
+	}
+
+	o.renderTemplate(r, w, "login", m)
+}
+
+// setLockedOut changes the OAuth2 error response to a 429 status, with the time the client can retry after.
+func setLockedOut(resp *osin.Response, err error) bool {
+	l, ok := isLockedOut(err)
+	if !ok {
+		return false
+	}
+	resp.StatusCode = http.StatusTooManyRequests
+	resp.ErrorStatusCode = http.StatusTooManyRequests
+	resp.Headers.Set("Retry-After", strconv.Itoa(int(l.RetryAfter().Seconds())))
+	return true
 }
 
 func actorIRIFromRequest(r *http.Request) vocab.IRI {
@@ -104,7 +172,7 @@ func (l logger) Printf(format string, v ...any) {
 }
 
 func authServer(o *oni) *osin.Server {
-	s := osin.NewServer(&DefaultConfig, o.Storage)
+	s := osin.NewServer(&DefaultConfig, o.clientStorage())
 	s.Logger = logger{Logger: o.Logger.WithContext(lw.Ctx{"log": "auth"})}
 	return s
 }
@@ -146,38 +214,37 @@ func (o *oni) Authorize(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if ar := os.HandleAuthorizeRequest(resp, r); ar != nil {
+		if ar.Scope, err = negotiateScopes(ar.Scope); err != nil {
+			resp.SetErrorState(osin.E_INVALID_SCOPE, err.Error(), ar.State)
+			o.redirectOrOutput(resp, w, r)
+			return
+		}
 		if r.Method == http.MethodGet {
 			// this is basically the login page, with client being set
-			m := login{title: "Login"}
-			m.backURL = backURL(r)
-
-			clientIRI := ar.Client.GetId()
-			if !strings.HasPrefix(clientIRI, "http") {
-				clientIRI = fmt.Sprintf("https://%s", clientIRI)
-			}
-			it, err := o.Storage.Load(vocab.IRI(clientIRI))
-			if err != nil {
-				o.Logger.WithContext(lw.Ctx{"err": err, "iri": clientIRI}).Errorf("Invalid client")
-				errors.HandleError(errors.Unauthorizedf("Invalid client")).ServeHTTP(w, r)
-				return
-			}
-			if !vocab.IsNil(it) {
-				m.client = it
-				m.state = ar.State
-			} else {
-				resp.SetError(osin.E_INVALID_REQUEST, fmt.Sprintf("Invalid client: %v", err))
-				o.redirectOrOutput(resp, w, r)
+			o.renderLogin(w, r, resp, ar, "")
+			return
+		}
+		if r.PostFormValue("_passkey") != "" {
+			err = o.loadPasskeyFromPost(a, r)
+		} else if challenge := r.PostFormValue("_challenge"); challenge != "" {
+			err = o.loadSecondFactorFromPost(a, challenge, r)
+		} else if err = o.loadAccountFromPost(a, r); err == nil && o.TOTPEnabled(a.ID) {
+			// NOTE(marius): the password is correct, and we ask for the second factor on the same page
+			challenge := o.challenges.Add(a.ID)
+			if acc.Equal(applicationJson) {
+				w.Header().Set("Content-Type", "application/json")
+				_ = json.NewEncoder(w).Encode(challengeModel{Challenge: challenge, State: ar.State})
 				return
 			}
-
-			o.renderTemplate(r, w, "login", m)
+			o.renderLogin(w, r, resp, ar, challenge)
 			return
 		}
-		if err := o.loadAccountFromPost(a, r); err != nil {
+		if err != nil {
 			o.Logger.WithContext(lw.Ctx{"err": err.Error()}).Errorf("wrong password")
 			resp.IsError = true
 			resp.ErrorStatusCode = errors.HttpStatus(err)
 			resp.SetErrorUri(osin.E_ACCESS_DENIED, "Wrong password", resp.URL, ar.State)
+			setLockedOut(resp, err)
 		} else {
 			ar.Authorized = true
 			ar.UserData = a.ID
@@ -207,12 +274,60 @@ func (o *oni) Token(w http.ResponseWriter, r *http.Request) {
 	}
 
 	resp := os.NewResponse()
+	if ba := clientCredentials(r, os.Config.AllowClientSecretInParams); ba != nil {
+		// NOTE(marius): the OAuth2 server checks the client secret again, but it doesn't limit the attempts
+		if _, err = o.checkClient("token", ba.Username, ba.Password, r.RemoteAddr); err != nil {
+			o.Logger.WithContext(lw.Ctx{"client": ba.Username, "err": err.Error()}).Warnf("wrong client secret")
+			resp.SetError(osin.E_INVALID_CLIENT, "Invalid client credentials")
+			if !setLockedOut(resp, err) {
+				resp.StatusCode = http.StatusUnauthorized
+			}
+			resp.Type = osin.DATA
+			o.redirectOrOutput(resp, w, r)
+			return
+		}
+	}
 	actor := &auth.AnonymousActor
 	if ar := os.HandleAccessRequest(resp, r); ar != nil {
+		// NOTE(marius): the authorization codes and the refresh tokens keep the scopes they have been granted with
+		if ar.Type != osin.AUTHORIZATION_CODE && ar.Type != osin.REFRESH_TOKEN {
+			if ar.Scope, err = negotiateScopes(ar.Scope); err != nil {
+				resp.SetError(osin.E_INVALID_SCOPE, err.Error())
+				o.redirectOrOutput(resp, w, r)
+				return
+			}
+		}
 		actorIRI := oniActor.ID
 		if iri, ok := ar.UserData.(string); ok {
 			actorIRI = vocab.IRI(iri)
 		}
+		if ar.Type == osin.PASSWORD {
+			// NOTE(marius): the username of the password grant is the actor's IRI, the root actor being the default
+			if ar.Username != "" && ar.Username != oniActor.ID.String() {
+				actorIRI = vocab.IRI(ar.Username)
+			}
+			err = o.checkPassword("token", actorIRI, r.RemoteAddr, func() error {
+				return o.Storage.PasswordCheck(actorIRI, []byte(ar.Password))
+			})
+		}
+		// NOTE(marius): besides the password grant, the client credentials of the root client are the password
+		// of the root actor, so only the authorization codes, which the second factor has already been checked for,
+		// and the refresh tokens issued from them, don't need the code.
+		if err == nil && ar.Type != osin.AUTHORIZATION_CODE && ar.Type != osin.REFRESH_TOKEN && o.TOTPEnabled(actorIRI) {
+			// NOTE(marius): the actors with two-factor authentication send the code in the "otp" parameter
+			err = o.checkOTP("token", actorIRI, r.RemoteAddr, func() error {
+				return o.CheckSecondFactor(actorIRI, r.PostFormValue("otp"))
+			})
+		}
+		if err != nil {
+			o.Logger.WithContext(lw.Ctx{"iri": actorIRI, "err": err.Error()}).Warnf("wrong password")
+			resp.SetError(osin.E_ACCESS_DENIED, "Wrong password")
+			if !setLockedOut(resp, err) {
+				resp.StatusCode = http.StatusUnauthorized
+			}
+			o.redirectOrOutput(resp, w, r)
+			return
+		}
 		it, err := o.Storage.Load(actorIRI)
 		if err != nil {
 			o.Logger.Errorf("%s", errUnauthorized)
@@ -284,8 +399,10 @@ func (o *oni) redirectOrOutput(rs *osin.Response, w http.ResponseWriter, r *http
 	http.Redirect(w, r, u, http.StatusFound)
 }
 
-// DefaultOAuth2ClientPw is the default password used by the main actor
-var DefaultOAuth2ClientPw = rand.Text()
+// GenerateSecret returns a new random value to be used as a password or OAuth2 client secret.
+func GenerateSecret() string {
+	return rand.Text()
+}
 
 var ExtraRedirectURL = ""
 
@@ -321,7 +438,7 @@ func (o *oni) renderTemplate(r *http.Request, w http.ResponseWriter, name string
 		"URLS":  actorURLs(actor),
 		"Title": m.Title,
 		"CurrentURL": func() template.URL {
-			return template.URL(fmt.Sprintf("https://%s%s", r.Host, r.RequestURI))
+			return template.URL(fmt.Sprintf("%s://%s%s", requestScheme(r), r.Host, r.RequestURI))
 		},
 	}
 
@@ -334,10 +451,13 @@ func (o *oni) renderTemplate(r *http.Request, w http.ResponseWriter, name string
 }
 
 type login struct {
-	title   string
-	state   string
-	client  vocab.Item
-	backURL template.URL
+	title     string
+	state     string
+	client    vocab.Item
+	scopes    []scopeDescription
+	backURL   template.URL
+	challenge string
+	passkeys  bool
 }
 
 func (l login) Title() string {
@@ -356,6 +476,20 @@ func (l login) Client() vocab.Item {
 	return l.client
 }
 
+func (l login) Scopes() []scopeDescription {
+	return l.scopes
+}
+
+// Passkeys returns if the actor can sign in with a passkey instead of the password.
+func (l login) Passkeys() bool {
+	return l.passkeys
+}
+
+// Challenge identifies the login waiting for the second factor, it's empty while asking for the password.
+func (l login) Challenge() string {
+	return l.challenge
+}
+
 type model interface {
 	Title() string
 }
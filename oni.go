@@ -7,8 +7,10 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -18,6 +20,7 @@ import (
 	"git.sr.ht/~mariusor/storage-all"
 	w "git.sr.ht/~mariusor/wrapper"
 	vocab "github.com/go-ap/activitypub"
+	"github.com/go-chi/chi/v5"
 )
 
 var (
@@ -30,33 +33,72 @@ var (
 type oni struct {
 	Control
 
-	Listen  string
+	Listen  []string
 	TimeOut time.Duration
 
 	mu *sync.Mutex
 	a  []vocab.Actor
 	pw string
-	m  http.Handler
+	m  *atomic.Pointer[chi.Mux]
+
+	configPath string
+	conf       *atomic.Pointer[Config]
+	verbose    int
+
+	started time.Time
+
+	certs        *certStore
+	httpRedirect string
+
+	limiter    *authLimiter
+	challenges *secondFactorChallenges
+	ceremonies *passkeyCeremonies
 }
 
+const DefaultListen = "127.0.0.1:60123"
+
 type optionFn func(o *oni)
 
 func Oni(initFns ...optionFn) *oni {
 	o := new(oni)
+	o.started = time.Now()
+	o.conf = new(atomic.Pointer[Config])
 
 	for _, fn := range initFns {
 		fn(o)
 	}
+	o.setLogLevel()
 
 	o.mu = &sync.Mutex{}
-	if opener, ok := o.Storage.(interface{ Open() error }); ok {
+	o.m = new(atomic.Pointer[chi.Mux])
+	o.limiter = newAuthLimiter()
+	o.challenges = newSecondFactorChallenges()
+	o.ceremonies = newPasskeyCeremonies()
+	if opener, ok := storageAs[interface{ Open() error }](o.Storage); ok {
 		if err := opener.Open(); err != nil {
 			o.Logger.WithContext(lw.Ctx{"err": err.Error()}).Errorf("Unable to open storage")
 			return o
 		}
 	}
 
-	localURLs := make(vocab.IRIs, 0, len(o.a))
+	if len(o.Listen) == 0 {
+		o.Listen = []string{DefaultListen}
+	}
+	o.loadRootActors()
+
+	// NOTE(marius): we set the debug mode value based on static IsDev
+	InDebugMode.Store(IsDev)
+
+	o.setupRoutes()
+	return o
+}
+
+// loadRootActors loads the root actors from storage and makes sure they have the OAuth2 clients,
+// key pairs and blocked items corresponding to the current configuration.
+func (o *oni) loadRootActors() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
 	for i, act := range o.a {
 		it, err := o.Storage.Load(act.GetLink())
 		if err != nil {
@@ -68,9 +110,12 @@ func Oni(initFns ...optionFn) *oni {
 			o.Logger.WithContext(lw.Ctx{"err": err, "id": act.GetLink()}).Errorf("Unable to load Actor")
 			continue
 		}
-		_ = localURLs.Append(actor.GetLink())
 
-		if err = o.CreateOAuth2ClientAlways(actor.ID, o.pw); err != nil {
+		// NOTE(marius): only a password set explicitly in the configuration file changes the secret
+		// of an existing OAuth2 client, otherwise we keep the one already in storage.
+		cfg := o.config()
+		conf := cfg.Actor(actor.ID)
+		if err = o.CreateOAuth2Client(actor.ID, conf.Password, cfg.RedirectURLs...); err != nil {
 			o.Logger.WithContext(lw.Ctx{"err": err, "id": actor.ID}).Errorf("Unable to save OAuth2 Client")
 		}
 
@@ -82,23 +127,28 @@ func Oni(initFns ...optionFn) *oni {
 		}
 
 		if actor != nil {
+			if err = o.applyConfigBlocks(*actor, conf.Block); err != nil {
+				o.Logger.WithContext(lw.Ctx{"err": err, "id": actor.ID}).Errorf("Unable to save the blocked items")
+			}
 			o.a[i] = *actor
 		}
 	}
+}
 
-	// NOTE(marius): we set the debug mode value based on static IsDev
-	InDebugMode.Store(IsDev)
-
-	o.setupRoutes()
-	return o
+// actors returns a copy of the root actors, which can change while the handlers run, when the configuration
+// gets reloaded, or when new actors are created.
+func (o *oni) actors() []vocab.Actor {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return slices.Clone(o.a)
 }
 
 func WithLogger(l lw.Logger) optionFn {
 	return func(o *oni) { o.Control.Logger = l }
 }
 
+// WithPassword sets the password for the root actors created at runtime which don't have one in the configuration file.
 func WithPassword(pw string) optionFn {
-	// TODO(marius): this needs a password mechanism per IRI
 	return func(o *oni) { o.pw = pw }
 }
 
@@ -122,7 +172,7 @@ func Actor(a ...vocab.Actor) optionFn {
 	}
 }
 
-func ListenOn(listen string) optionFn {
+func ListenOn(listen ...string) optionFn {
 	return func(o *oni) {
 		o.Listen = listen
 	}
@@ -147,9 +197,10 @@ func ParseStorageDSN(s string) (storage.Type, string) {
 	return storage.Type(sto[1]), string(sto[2])
 }
 
-func WithStorage(st storage.FullStorage, path string) optionFn {
+func WithStorage(st storage.FullStorage, typ storage.Type, path string) optionFn {
 	return func(o *oni) {
-		o.Storage = st
+		o.Storage = instrumentStorage(st)
+		o.StorageType = typ
 		o.StoragePath = path
 	}
 }
@@ -159,13 +210,18 @@ func (o *oni) Pause() error {
 		// restart everything
 		o.Storage.Close()
 	} else {
-		if storageWithOpen, ok := o.Storage.(interface{ Open() error }); ok {
+		if storageWithOpen, ok := storageAs[interface{ Open() error }](o.Storage); ok {
 			return storageWithOpen.Open()
 		}
 	}
 	return nil
 }
 
+// ServeHTTP dispatches the requests to the current router, which gets replaced when reloading the configuration.
+func (o *oni) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	o.m.Load().ServeHTTP(w, r)
+}
+
 const defaultGraceWait = 1500 * time.Millisecond
 
 // Run is the wrapper for starting the web-server and handling signals
@@ -178,34 +234,68 @@ func (o *oni) Run(c context.Context) error {
 		o.Logger.Warnf("Unable to write pid file: %s", err)
 		o.Logger.Warnf("Some CLI commands relying on it will not work")
 	}
-	sockType := ""
-	setters := []m.SetFn{m.Handler(o.m)}
+	muxSetters := []m.MuxFn{m.GracefulWait(defaultGraceWait)}
 
 	if os.Getenv("LISTEN_FDS") != "" {
-		sockType = "Systemd"
-		setters = append(setters, m.OnSystemd())
-	} else if filepath.IsAbs(o.Listen) {
-		dir := filepath.Dir(o.Listen)
-		if _, err := os.Stat(dir); err == nil {
-			sockType = "socket"
-			setters = append(setters, m.OnSocket(o.Listen))
-			defer func() { _ = os.RemoveAll(o.Listen) }()
+		httpSrv, err := m.HttpServer(m.Handler(o), m.OnSystemd())
+		if err != nil {
+			return err
 		}
+		o.Logger.WithContext(lw.Ctx{"type": "Systemd"}).Debugf("Accepting HTTP requests")
+		muxSetters = append(muxSetters, m.WithServer(httpSrv))
 	} else {
-		sockType = "TCP"
-		setters = append(setters, m.OnTCP(o.Listen))
-	}
-	logCtx := lw.Ctx{"version": Version, "path": o.StoragePath}
+		if o.certs != nil {
+			o.certs.Load()
+			go o.certs.Watch(ctx)
+		}
+		tlsListen := ""
+		for _, listen := range o.Listen {
+			if o.certs != nil && !filepath.IsAbs(listen) {
+				tlsSrv, err := o.tlsServer(listen)
+				if err != nil {
+					return err
+				}
+				if tlsListen == "" {
+					tlsListen = listen
+				}
+				o.Logger.WithContext(lw.Ctx{"socket": listen, "type": "TLS"}).Debugf("Accepting HTTPS requests")
+				muxSetters = append(muxSetters, m.WithServer(tlsSrv))
+				continue
+			}
+			sockType := ""
+			setters := []m.SetFn{m.Handler(o)}
+			if filepath.IsAbs(listen) {
+				dir := filepath.Dir(listen)
+				if _, err := os.Stat(dir); err == nil {
+					sockType = "socket"
+					setters = append(setters, m.OnSocket(listen))
+					defer func() { _ = os.RemoveAll(listen) }()
+				}
+			} else {
+				sockType = "TCP"
+				setters = append(setters, m.OnTCP(listen))
+			}
 
-	// Get start/stop functions for the http server
-	httpSrv, err := m.HttpServer(setters...)
-	if err != nil {
-		return err
-	}
-	if sockType != "" {
-		o.Logger.WithContext(lw.Ctx{"socket": o.Listen, "type": sockType}).Debugf("Accepting HTTP requests")
+			// Get start/stop functions for the http server
+			httpSrv, err := m.HttpServer(setters...)
+			if err != nil {
+				return err
+			}
+			if sockType != "" {
+				o.Logger.WithContext(lw.Ctx{"socket": listen, "type": sockType}).Debugf("Accepting HTTP requests")
+			}
+			muxSetters = append(muxSetters, m.WithServer(httpSrv))
+		}
+		if o.httpRedirect != "" && tlsListen != "" {
+			redirectSrv, err := o.redirectServer(o.httpRedirect, tlsListen)
+			if err != nil {
+				return err
+			}
+			o.Logger.WithContext(lw.Ctx{"socket": o.httpRedirect, "type": "TCP"}).Debugf("Redirecting HTTP requests to HTTPS")
+			muxSetters = append(muxSetters, m.WithServer(redirectSrv))
+		}
 	}
-	muxSetters := []m.MuxFn{m.WithServer(httpSrv), m.GracefulWait(defaultGraceWait)}
+	logCtx := lw.Ctx{"version": Version, "path": o.StoragePath}
 
 	sshServ, err := initSSHServer(o)
 	if err != nil {
@@ -224,6 +314,9 @@ func (o *oni) Run(c context.Context) error {
 		o.Logger.WithContext(logCtx).Infof("Started")
 	}
 
+	go o.RunDeliveryQueue(ctx)
+	go o.serveControl(ctx)
+
 	stopFn := func(ctx context.Context) error {
 		if closer, ok := o.Storage.(interface{ Close() }); ok {
 			closer.Close()
@@ -244,11 +337,17 @@ func (o *oni) Run(c context.Context) error {
 	}
 
 	err = w.RegisterSignalHandlers(w.SignalHandlers{
+		syscall.SIGHUP: func(_ chan<- error) {
+			logFn := o.Logger.WithContext(lw.Ctx{"config": o.configPath}).Infof
+			if err := o.Reload(); err != nil {
+				logFn = o.Logger.WithContext(lw.Ctx{"config": o.configPath, "err": err.Error()}).Warnf
+			}
+			logFn("SIGHUP received, reloaded configuration")
+		},
 		syscall.SIGUSR1: func(_ chan<- error) {
 			maintenance := InMaintenanceMode.Load()
-			InMaintenanceMode.Store(!maintenance)
 			logFn := o.Logger.WithContext(lw.Ctx{"maintenance": !maintenance}).Debugf
-			if err := o.Pause(); err != nil {
+			if err := o.setMaintenance(!maintenance); err != nil {
 				logFn = o.Logger.WithContext(lw.Ctx{"err": err.Error()}).Warnf
 			}
 			if o.Logger != nil {
@@ -0,0 +1,492 @@
+package oni
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"git.sr.ht/~mariusor/lw"
+	vocab "github.com/go-ap/activitypub"
+	"github.com/go-ap/errors"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// passkeyLinkTimeout is how long the one-time link for adding a passkey, created from the command line, is valid.
+	passkeyLinkTimeout = time.Hour
+	// passkeyCeremonyTimeout is how long we wait for the browser between the two steps of registering or using a passkey.
+	passkeyCeremonyTimeout = 5 * time.Minute
+	// maxPendingCeremonies is the limit for the passkey ceremonies waiting for the browser,
+	// and maxPendingCeremoniesPerIP the limit for the ones started from the same address.
+	maxPendingCeremonies      = 1000
+	maxPendingCeremoniesPerIP = 5
+)
+
+var (
+	errNoPasskeys        = errors.NotFoundf("no passkeys found")
+	errTooManyCeremonies = errors.Newf("too many pending passkey requests, please try again later")
+
+	// NOTE(marius): the passkeys are updated in the actor's metadata after each use,
+	// and we don't want concurrent logins to overwrite each other's changes.
+	passkeysMu sync.Mutex
+)
+
+// passkey is a WebAuthn credential of an actor, which gets saved JSON encoded in its metadata.
+type passkey struct {
+	Name       string              `json:"name"`
+	Created    time.Time           `json:"created"`
+	Credential webauthn.Credential `json:"credential"`
+}
+
+func (p passkey) ID() string {
+	return base64.RawURLEncoding.EncodeToString(p.Credential.ID)
+}
+
+// passkeyUser is the WebAuthn user for an actor.
+type passkeyUser struct {
+	actor vocab.Actor
+	keys  []passkey
+}
+
+// WebAuthnID returns the user handle, which can't be longer than 64 bytes, so we can't use the IRI directly.
+func (u passkeyUser) WebAuthnID() []byte {
+	sum := sha256.Sum256([]byte(u.actor.ID))
+	return sum[:]
+}
+
+func (u passkeyUser) WebAuthnName() string {
+	if name := u.actor.PreferredUsername.First().String(); name != "" {
+		return name
+	}
+	return u.actor.ID.String()
+}
+
+func (u passkeyUser) WebAuthnDisplayName() string {
+	return vocab.PreferredNameOf(&u.actor)
+}
+
+func (u passkeyUser) WebAuthnCredentials() []webauthn.Credential {
+	creds := make([]webauthn.Credential, 0, len(u.keys))
+	for _, k := range u.keys {
+		creds = append(creds, k.Credential)
+	}
+	return creds
+}
+
+// webAuthn returns the WebAuthn relying party for the root actor, which is the host it's served from.
+func webAuthn(actor vocab.Actor) (*webauthn.WebAuthn, error) {
+	u, err := actor.ID.URL()
+	if err != nil {
+		return nil, err
+	}
+	return webauthn.New(&webauthn.Config{
+		RPID:          u.Hostname(),
+		RPDisplayName: vocab.PreferredNameOf(&actor),
+		RPOrigins:     []string{u.Scheme + "://" + u.Host},
+	})
+}
+
+func loadPasskeys(m *Metadata) ([]passkey, error) {
+	keys := make([]passkey, 0, len(m.Passkeys))
+	for _, raw := range m.Passkeys {
+		k := passkey{}
+		if err := json.Unmarshal(raw, &k); err != nil {
+			return nil, errors.Annotatef(err, "invalid passkey")
+		}
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+func savePasskeys(m *Metadata, keys []passkey) error {
+	m.Passkeys = make([][]byte, 0, len(keys))
+	for _, k := range keys {
+		raw, err := json.Marshal(k)
+		if err != nil {
+			return err
+		}
+		m.Passkeys = append(m.Passkeys, raw)
+	}
+	return nil
+}
+
+// Passkeys returns the passkeys of the actor with "iri".
+func (c *Control) Passkeys(iri vocab.IRI) ([]passkey, error) {
+	m := new(Metadata)
+	if err := c.Storage.LoadMetadata(iri, m); err != nil {
+		if errors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return loadPasskeys(m)
+}
+
+// updatePasskeys loads the passkeys of the actor with "iri", and saves them after they've been changed by "fn".
+func (c *Control) updatePasskeys(iri vocab.IRI, fn func(m *Metadata, keys []passkey) ([]passkey, error)) error {
+	passkeysMu.Lock()
+	defer passkeysMu.Unlock()
+
+	m := new(Metadata)
+	if err := c.Storage.LoadMetadata(iri, m); err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	keys, err := loadPasskeys(m)
+	if err != nil {
+		return err
+	}
+	if keys, err = fn(m, keys); err != nil {
+		return err
+	}
+	if err = savePasskeys(m, keys); err != nil {
+		return err
+	}
+	return c.Storage.SaveMetadata(iri, m)
+}
+
+// RemovePasskey removes the passkey with "id", or "name", of the actor with "iri".
+func (c *Control) RemovePasskey(iri vocab.IRI, id string) error {
+	return c.updatePasskeys(iri, func(_ *Metadata, keys []passkey) ([]passkey, error) {
+		for i, k := range keys {
+			if k.ID() == id || k.Name == id {
+				return append(keys[:i], keys[i+1:]...), nil
+			}
+		}
+		return nil, errors.NotFoundf("passkey %q not found", id)
+	})
+}
+
+// NewPasskeyLink returns a one-time link for adding a passkey to the actor, for when it isn't already signed in.
+func (c *Control) NewPasskeyLink(actor vocab.Actor) (string, error) {
+	tok := GenerateSecret()
+	hash, err := bcrypt.GenerateFromPassword([]byte(tok), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	m := new(Metadata)
+	if err = c.Storage.LoadMetadata(actor.ID, m); err != nil && !errors.IsNotFound(err) {
+		return "", err
+	}
+	m.PasskeyLink = hash
+	m.PasskeyLinkExpires = time.Now().Add(passkeyLinkTimeout).Unix()
+	if err = c.Storage.SaveMetadata(actor.ID, m); err != nil {
+		return "", err
+	}
+	return actor.ID.AddPath("oauth/passkey").String() + "?token=" + tok, nil
+}
+
+func validPasskeyLink(m *Metadata, tok string) bool {
+	if tok == "" || len(m.PasskeyLink) == 0 || time.Now().Unix() > m.PasskeyLinkExpires {
+		return false
+	}
+	return bcrypt.CompareHashAndPassword(m.PasskeyLink, []byte(tok)) == nil
+}
+
+func (c *Control) checkPasskeyLink(iri vocab.IRI, tok string) bool {
+	m := new(Metadata)
+	if err := c.Storage.LoadMetadata(iri, m); err != nil {
+		return false
+	}
+	return validPasskeyLink(m, tok)
+}
+
+// passkeyCeremony is a passkey registration or login which waits for the response of the browser.
+type passkeyCeremony struct {
+	actor   vocab.IRI
+	session webauthn.SessionData
+	// link is the one-time link token the registration was started with, which gets used up when it finishes.
+	link string
+	// ip is the address the ceremony was started from.
+	ip      string
+	expires time.Time
+}
+
+type passkeyCeremonies struct {
+	mu      sync.Mutex
+	pending map[string]passkeyCeremony
+}
+
+func newPasskeyCeremonies() *passkeyCeremonies {
+	return &passkeyCeremonies{pending: make(map[string]passkeyCeremony)}
+}
+
+// Add returns the token the browser sends back to finish the ceremony.
+// NOTE(marius): the login ceremonies can be started by anyone, so we limit how many can wait for the browser,
+// in total and from the same address.
+func (p *passkeyCeremonies) Add(c passkeyCeremony) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	fromIP := 0
+	for tok, pc := range p.pending {
+		if now.After(pc.expires) {
+			delete(p.pending, tok)
+			continue
+		}
+		if pc.ip == c.ip {
+			fromIP++
+		}
+	}
+	if len(p.pending) >= maxPendingCeremonies || fromIP >= maxPendingCeremoniesPerIP {
+		return "", errTooManyCeremonies
+	}
+	tok := GenerateSecret()
+	c.expires = now.Add(passkeyCeremonyTimeout)
+	p.pending[tok] = c
+	return tok, nil
+}
+
+// Take returns the ceremony identified by "tok", which can be finished only once.
+func (p *passkeyCeremonies) Take(tok string) (passkeyCeremony, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	c, ok := p.pending[tok]
+	if !ok {
+		return c, false
+	}
+	delete(p.pending, tok)
+	return c, time.Now().Before(c.expires)
+}
+
+// passkeyOptions are the options for navigator.credentials.create() or get(), with the token identifying the ceremony.
+type passkeyOptions struct {
+	Ceremony  string `json:"ceremony"`
+	PublicKey any    `json:"publicKey"`
+}
+
+// writeTooManyCeremonies asks the browser to retry after the pending ceremonies expire.
+func writeTooManyCeremonies(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(passkeyCeremonyTimeout.Seconds())))
+	writePasskeyJSON(w, http.StatusTooManyRequests, map[string]string{"error": errTooManyCeremonies.Error()})
+}
+
+func writePasskeyJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// passkeyPage is the page from which a passkey can be added.
+type passkeyPage struct {
+	token     string
+	twoFactor bool
+}
+
+func (p passkeyPage) Title() string {
+	return "Add a passkey"
+}
+
+// Token is the one-time link token, it's empty when adding the passkey from a signed in session.
+func (p passkeyPage) Token() string {
+	return p.token
+}
+
+// TwoFactor returns if adding the passkey from a signed in session needs the authentication code.
+func (p passkeyPage) TwoFactor() bool {
+	return p.twoFactor
+}
+
+// PasskeyPage renders the page for adding a passkey, opened either from the one-time link,
+// or by the signed in actor.
+func (o *oni) PasskeyPage(w http.ResponseWriter, r *http.Request) {
+	oniActor := o.oniActor(r)
+	o.renderTemplate(r, w, "passkey", passkeyPage{token: r.URL.Query().Get("token"), twoFactor: o.TOTPEnabled(oniActor.ID)})
+}
+
+// canAddPasskey checks if the request can register a passkey for the root actor, and returns the link token it used.
+// Without a link, the request needs to be authorized by the root actor, and to confirm its password,
+// and the authentication code if it uses two-factor authentication.
+// NOTE(marius): the tokens of the web client don't have the admin scope, and the password confirmation
+// is what protects against a leaked token being used for adding a passkey.
+func (o *oni) canAddPasskey(r *http.Request, oniActor vocab.Actor) (string, error) {
+	if tok := r.PostFormValue("token"); tok != "" {
+		if !o.checkPasskeyLink(oniActor.ID, tok) {
+			return "", errors.Unauthorizedf("the link for adding a passkey is not valid")
+		}
+		return tok, nil
+	}
+	act, err := o.loadAuthorizedActor(r, oniActor)
+	if err != nil || !act.ID.Equals(oniActor.ID, true) {
+		return "", errors.Unauthorizedf("adding a passkey needs to be authorized")
+	}
+	err = o.checkPassword("passkey", oniActor.ID, r.RemoteAddr, func() error {
+		return o.Storage.PasswordCheck(oniActor.ID, []byte(r.PostFormValue("_pw")))
+	})
+	if err != nil {
+		return "", err
+	}
+	if o.TOTPEnabled(oniActor.ID) {
+		err = o.checkOTP("passkey", oniActor.ID, r.RemoteAddr, func() error {
+			return o.CheckSecondFactor(oniActor.ID, r.PostFormValue("_otp"))
+		})
+	}
+	return "", err
+}
+
+// BeginPasskeyRegistration returns the options for creating a new passkey for the root actor.
+func (o *oni) BeginPasskeyRegistration(w http.ResponseWriter, r *http.Request) {
+	oniActor := o.oniActor(r)
+	link, err := o.canAddPasskey(r, oniActor)
+	if l, ok := isLockedOut(err); ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(l.RetryAfter().Seconds())))
+		writePasskeyJSON(w, http.StatusTooManyRequests, map[string]string{"error": l.Error()})
+		return
+	}
+	if err != nil {
+		o.Error(err).ServeHTTP(w, r)
+		return
+	}
+	wa, err := webAuthn(oniActor)
+	if err != nil {
+		o.Error(err).ServeHTTP(w, r)
+		return
+	}
+	keys, err := o.Passkeys(oniActor.ID)
+	if err != nil {
+		o.Error(err).ServeHTTP(w, r)
+		return
+	}
+
+	user := passkeyUser{actor: oniActor, keys: keys}
+	exclude := make([]protocol.CredentialDescriptor, 0, len(keys))
+	for _, k := range keys {
+		exclude = append(exclude, k.Credential.Descriptor())
+	}
+	creation, session, err := wa.BeginRegistration(user,
+		webauthn.WithExclusions(exclude),
+		webauthn.WithResidentKeyRequirement(protocol.ResidentKeyRequirementPreferred),
+		webauthn.WithAuthenticatorSelection(protocol.AuthenticatorSelection{UserVerification: protocol.VerificationRequired}),
+	)
+	if err != nil {
+		o.Error(errors.Annotatef(err, "unable to start the passkey registration")).ServeHTTP(w, r)
+		return
+	}
+	tok, err := o.ceremonies.Add(passkeyCeremony{actor: oniActor.ID, session: *session, link: link, ip: addrIP(r.RemoteAddr)})
+	if err != nil {
+		writeTooManyCeremonies(w)
+		return
+	}
+	writePasskeyJSON(w, http.StatusOK, passkeyOptions{Ceremony: tok, PublicKey: creation.Response})
+}
+
+// FinishPasskeyRegistration verifies the new credential created by the browser, and saves it as a passkey of the actor.
+func (o *oni) FinishPasskeyRegistration(w http.ResponseWriter, r *http.Request) {
+	oniActor := o.oniActor(r)
+	ceremony, ok := o.ceremonies.Take(chi.URLParam(r, "ceremony"))
+	if !ok || !ceremony.actor.Equals(oniActor.ID, true) {
+		o.Error(errors.BadRequestf("the passkey registration has expired, please try again")).ServeHTTP(w, r)
+		return
+	}
+	parsed, err := protocol.ParseCredentialCreationResponseBody(r.Body)
+	if err != nil {
+		o.Error(errors.NewBadRequest(err, "invalid passkey")).ServeHTTP(w, r)
+		return
+	}
+	wa, err := webAuthn(oniActor)
+	if err != nil {
+		o.Error(err).ServeHTTP(w, r)
+		return
+	}
+
+	name := strings.TrimSpace(r.URL.Query().Get("name"))
+	err = o.updatePasskeys(oniActor.ID, func(m *Metadata, keys []passkey) ([]passkey, error) {
+		if ceremony.link != "" {
+			// NOTE(marius): the link can be used only once
+			if !validPasskeyLink(m, ceremony.link) {
+				return nil, errors.Unauthorizedf("the link for adding a passkey is not valid anymore")
+			}
+			m.PasskeyLink = nil
+			m.PasskeyLinkExpires = 0
+		}
+		cred, err := wa.CreateCredential(passkeyUser{actor: oniActor, keys: keys}, ceremony.session, parsed)
+		if err != nil {
+			return nil, errors.NewBadRequest(err, "invalid passkey")
+		}
+		if name == "" {
+			name = "Passkey " + TimeNow().Format(time.DateOnly)
+		}
+		return append(keys, passkey{Name: name, Created: TimeNow(), Credential: *cred}), nil
+	})
+	if err != nil {
+		o.Error(err).ServeHTTP(w, r)
+		return
+	}
+	o.Logger.WithContext(lw.Ctx{"actor": oniActor.ID, "name": name}).Infof("Added passkey")
+	writePasskeyJSON(w, http.StatusCreated, map[string]string{"name": name})
+}
+
+// BeginPasskeyLogin returns the options for signing in with one of the passkeys of the root actor.
+func (o *oni) BeginPasskeyLogin(w http.ResponseWriter, r *http.Request) {
+	oniActor := o.oniActor(r)
+	keys, err := o.Passkeys(oniActor.ID)
+	if err != nil {
+		o.Error(err).ServeHTTP(w, r)
+		return
+	}
+	if len(keys) == 0 {
+		o.Error(errNoPasskeys).ServeHTTP(w, r)
+		return
+	}
+	wa, err := webAuthn(oniActor)
+	if err != nil {
+		o.Error(err).ServeHTTP(w, r)
+		return
+	}
+	assertion, session, err := wa.BeginLogin(passkeyUser{actor: oniActor, keys: keys},
+		webauthn.WithUserVerification(protocol.VerificationRequired))
+	if err != nil {
+		o.Error(errors.Annotatef(err, "unable to start the passkey login")).ServeHTTP(w, r)
+		return
+	}
+	tok, err := o.ceremonies.Add(passkeyCeremony{actor: oniActor.ID, session: *session, ip: addrIP(r.RemoteAddr)})
+	if err != nil {
+		writeTooManyCeremonies(w)
+		return
+	}
+	writePasskeyJSON(w, http.StatusOK, passkeyOptions{Ceremony: tok, PublicKey: assertion.Response})
+}
+
+// loadPasskeyFromPost checks the passkey assertion posted from the login page, and updates the signature counter
+// of the passkey which was used.
+// NOTE(marius): the passkeys require user verification, so they replace both the password and the second factor.
+func (o *oni) loadPasskeyFromPost(actor vocab.Actor, r *http.Request) error {
+	ceremony, ok := o.ceremonies.Take(r.PostFormValue("_ceremony"))
+	if !ok || !ceremony.actor.Equals(actor.ID, true) {
+		return errors.Unauthorizedf("the passkey login has expired, please sign in again")
+	}
+	parsed, err := protocol.ParseCredentialRequestResponseBytes([]byte(r.PostFormValue("_passkey")))
+	if err != nil {
+		return errors.NewUnauthorized(err, "invalid passkey")
+	}
+	wa, err := webAuthn(actor)
+	if err != nil {
+		return err
+	}
+	return o.updatePasskeys(actor.ID, func(_ *Metadata, keys []passkey) ([]passkey, error) {
+		cred, err := wa.ValidateLogin(passkeyUser{actor: actor, keys: keys}, ceremony.session, parsed)
+		if err != nil {
+			return nil, errors.NewUnauthorized(err, "invalid passkey")
+		}
+		if cred.Authenticator.CloneWarning {
+			o.Logger.WithContext(lw.Ctx{"actor": actor.ID}).Warnf("The signature counter of the passkey went back, it might have been cloned")
+			return nil, errors.Unauthorizedf("invalid passkey")
+		}
+		for i, k := range keys {
+			if string(k.Credential.ID) == string(cred.ID) {
+				keys[i].Credential = *cred
+			}
+		}
+		return keys, nil
+	})
+}
@@ -0,0 +1,182 @@
+package oni
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/go-ap/errors"
+)
+
+// trustUnixSockets is the value of the trusted_proxies setting which trusts the peers connecting
+// through Unix domain sockets, which is how the reverse proxies on the same machine usually connect.
+const trustUnixSockets = "unix"
+
+var forwardingHeaders = []string{"Forwarded", "X-Forwarded-Proto", "X-Forwarded-Host", "X-Forwarded-For"}
+
+// trustedProxies are the reverse proxies from which we accept the scheme, host and client address
+// in the Forwarded and X-Forwarded-* headers.
+type trustedProxies struct {
+	nets []*net.IPNet
+	unix bool
+}
+
+func parseTrustedProxies(values ...string) (trustedProxies, error) {
+	t := trustedProxies{}
+	for _, v := range values {
+		if v == trustUnixSockets {
+			t.unix = true
+			continue
+		}
+		if !strings.Contains(v, "/") {
+			ip := net.ParseIP(v)
+			if ip == nil {
+				return t, errors.Newf("invalid trusted proxy address %q", v)
+			}
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			t.nets = append(t.nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return t, errors.Annotatef(err, "invalid trusted proxy network %q", v)
+		}
+		t.nets = append(t.nets, n)
+	}
+	return t, nil
+}
+
+func (t trustedProxies) empty() bool {
+	return !t.unix && len(t.nets) == 0
+}
+
+func (t trustedProxies) trustsIP(ip net.IP) bool {
+	for _, n := range t.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// trusts returns if the peer with "remoteAddr" is a trusted proxy.
+// The connections on Unix domain sockets don't have a remote IP address.
+func (t trustedProxies) trusts(remoteAddr string) bool {
+	host := remoteAddr
+	if h, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		host = h
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return t.trustsIP(ip)
+	}
+	return t.unix
+}
+
+// forwardedParams returns the parameters of the last element of the RFC 7239 Forwarded header, which is the one
+// added by the proxy connecting to us, as the ones before it can be set by the client, and the "for" parameters
+// of all of them.
+func forwardedParams(header string) (map[string]string, []string) {
+	var last map[string]string
+	fors := make([]string, 0)
+	for _, element := range strings.Split(header, ",") {
+		last = make(map[string]string)
+		for _, pair := range strings.Split(element, ";") {
+			k, v, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if !ok {
+				continue
+			}
+			k, v = strings.ToLower(k), strings.Trim(v, `"`)
+			last[k] = v
+			if k == "for" {
+				fors = append(fors, v)
+			}
+		}
+	}
+	return last, fors
+}
+
+// lastValue returns the rightmost value of a comma separated header which can be sent multiple times.
+func lastValue(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	all := strings.Split(strings.Join(values, ","), ",")
+	return strings.TrimSpace(all[len(all)-1])
+}
+
+// forwardedIP returns the IP address from a "for" value of the Forwarded header, or from X-Forwarded-For,
+// which can have a port, and IPv6 addresses between brackets.
+func forwardedIP(v string) net.IP {
+	if h, _, err := net.SplitHostPort(v); err == nil {
+		v = h
+	}
+	return net.ParseIP(strings.Trim(v, "[]"))
+}
+
+// clientIP returns the rightmost address from the chain of proxies which is not a trusted proxy itself,
+// as the values to the left of it can be set by the client.
+func (t trustedProxies) clientIP(chain []string) string {
+	for i := len(chain) - 1; i >= 0; i-- {
+		ip := forwardedIP(strings.TrimSpace(chain[i]))
+		if ip == nil {
+			continue
+		}
+		if !t.trustsIP(ip) || i == 0 {
+			return ip.String()
+		}
+	}
+	return ""
+}
+
+// Proxied replaces the scheme, host and remote address of the requests received from trusted proxies
+// with the ones from the Forwarded, or the X-Forwarded-Proto, X-Forwarded-Host and X-Forwarded-For headers.
+// For the other requests the forwarding headers are removed, so they can't be used further down the chain.
+func Proxied(t trustedProxies) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if t.empty() || !t.trusts(r.RemoteAddr) {
+				for _, h := range forwardingHeaders {
+					r.Header.Del(h)
+				}
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			var proto, host string
+			var chain []string
+			if fwd := r.Header.Get("Forwarded"); fwd != "" {
+				var params map[string]string
+				params, chain = forwardedParams(strings.Join(r.Header.Values("Forwarded"), ","))
+				proto, host = params["proto"], params["host"]
+			} else {
+				proto = lastValue(r.Header.Values("X-Forwarded-Proto"))
+				host = lastValue(r.Header.Values("X-Forwarded-Host"))
+				if xff := r.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+					chain = strings.Split(strings.Join(xff, ","), ",")
+				}
+			}
+			if proto = strings.ToLower(proto); proto == "http" || proto == "https" {
+				r.URL.Scheme = proto
+			}
+			if host != "" {
+				r.Host = host
+			}
+			if ip := t.clientIP(chain); ip != "" {
+				r.RemoteAddr = ip
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// requestScheme returns the scheme the client used for the request, which, unless set by a trusted proxy,
+// we assume is HTTPS, as ActivityPub servers need to be served over TLS.
+func requestScheme(r *http.Request) string {
+	if r.URL != nil && r.URL.Scheme != "" {
+		return r.URL.Scheme
+	}
+	return "https"
+}
@@ -0,0 +1,171 @@
+package oni
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func Test_forwardedParams(t *testing.T) {
+	tests := []struct {
+		name     string
+		header   string
+		wantLast map[string]string
+		wantFors []string
+	}{
+		{
+			name:     "single element",
+			header:   `for=192.0.2.60;proto=https;host=example.com`,
+			wantLast: map[string]string{"for": "192.0.2.60", "proto": "https", "host": "example.com"},
+			wantFors: []string{"192.0.2.60"},
+		},
+		{
+			name:     "spoofed element before the proxy's",
+			header:   `for=10.0.0.1;proto=http;host=evil.example, for=192.0.2.60;proto=https;host=example.com`,
+			wantLast: map[string]string{"for": "192.0.2.60", "proto": "https", "host": "example.com"},
+			wantFors: []string{"10.0.0.1", "192.0.2.60"},
+		},
+		{
+			name:     "last element without host",
+			header:   `host=evil.example;proto=http, for="[2001:db8::1]:4711"`,
+			wantLast: map[string]string{"for": "[2001:db8::1]:4711"},
+			wantFors: []string{"[2001:db8::1]:4711"},
+		},
+		{
+			name:     "case insensitive keys",
+			header:   `For=192.0.2.43;Proto=HTTPS`,
+			wantLast: map[string]string{"for": "192.0.2.43", "proto": "HTTPS"},
+			wantFors: []string{"192.0.2.43"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			last, fors := forwardedParams(tt.header)
+			if !reflect.DeepEqual(last, tt.wantLast) {
+				t.Errorf("forwardedParams() params = %v, want %v", last, tt.wantLast)
+			}
+			if !reflect.DeepEqual(fors, tt.wantFors) {
+				t.Errorf("forwardedParams() fors = %v, want %v", fors, tt.wantFors)
+			}
+		})
+	}
+}
+
+func TestProxied(t *testing.T) {
+	trusted, err := parseTrustedProxies("127.0.0.1", "10.0.0.0/8")
+	if err != nil {
+		t.Fatalf("parseTrustedProxies() error = %v", err)
+	}
+	tests := []struct {
+		name       string
+		trusted    trustedProxies
+		remoteAddr string
+		headers    map[string][]string
+		wantScheme string
+		wantHost   string
+		wantAddr   string
+	}{
+		{
+			name:       "untrusted peer",
+			trusted:    trusted,
+			remoteAddr: "203.0.113.5:1234",
+			headers: map[string][]string{
+				"X-Forwarded-Proto": {"http"},
+				"X-Forwarded-Host":  {"evil.example"},
+				"X-Forwarded-For":   {"10.0.0.1"},
+			},
+			wantHost: "example.com",
+			wantAddr: "203.0.113.5:1234",
+		},
+		{
+			name:       "no trusted proxies",
+			remoteAddr: "127.0.0.1:1234",
+			headers:    map[string][]string{"Forwarded": {`for=192.0.2.60;host=evil.example`}},
+			wantHost:   "example.com",
+			wantAddr:   "127.0.0.1:1234",
+		},
+		{
+			name:       "forwarded",
+			trusted:    trusted,
+			remoteAddr: "127.0.0.1:1234",
+			headers:    map[string][]string{"Forwarded": {`for=192.0.2.60;proto=http;host=proxied.example`}},
+			wantScheme: "http",
+			wantHost:   "proxied.example",
+			wantAddr:   "192.0.2.60",
+		},
+		{
+			name:       "spoofed forwarded chain",
+			trusted:    trusted,
+			remoteAddr: "127.0.0.1:1234",
+			headers: map[string][]string{
+				"Forwarded": {`for=10.0.0.1;proto=http;host=evil.example`, `for=192.0.2.60;proto=https;host=proxied.example`},
+			},
+			wantScheme: "https",
+			wantHost:   "proxied.example",
+			wantAddr:   "192.0.2.60",
+		},
+		{
+			name:       "spoofed x-forwarded chain",
+			trusted:    trusted,
+			remoteAddr: "127.0.0.1:1234",
+			headers: map[string][]string{
+				"X-Forwarded-Proto": {"http, https"},
+				"X-Forwarded-Host":  {"evil.example", "proxied.example"},
+				"X-Forwarded-For":   {"10.0.0.1, 192.0.2.60", "10.1.1.1"},
+			},
+			wantScheme: "https",
+			wantHost:   "proxied.example",
+			wantAddr:   "192.0.2.60",
+		},
+		{
+			name:       "only trusted addresses",
+			trusted:    trusted,
+			remoteAddr: "127.0.0.1:1234",
+			headers:    map[string][]string{"X-Forwarded-For": {"10.0.0.2, 10.0.0.1"}},
+			wantHost:   "example.com",
+			wantAddr:   "10.0.0.2",
+		},
+		{
+			name:       "invalid proto",
+			trusted:    trusted,
+			remoteAddr: "127.0.0.1:1234",
+			headers:    map[string][]string{"X-Forwarded-Proto": {"gopher"}},
+			wantHost:   "example.com",
+			wantAddr:   "127.0.0.1:1234",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for k, vv := range tt.headers {
+				for _, v := range vv {
+					r.Header.Add(k, v)
+				}
+			}
+
+			var got *http.Request
+			Proxied(tt.trusted)(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+				got = r
+			})).ServeHTTP(httptest.NewRecorder(), r)
+
+			if got.URL.Scheme != tt.wantScheme {
+				t.Errorf("Proxied() scheme = %q, want %q", got.URL.Scheme, tt.wantScheme)
+			}
+			if got.Host != tt.wantHost {
+				t.Errorf("Proxied() host = %q, want %q", got.Host, tt.wantHost)
+			}
+			if got.RemoteAddr != tt.wantAddr {
+				t.Errorf("Proxied() remote address = %q, want %q", got.RemoteAddr, tt.wantAddr)
+			}
+			if !tt.trusted.trusts(tt.remoteAddr) {
+				for _, h := range forwardingHeaders {
+					if got.Header.Get(h) != "" {
+						t.Errorf("Proxied() kept the %s header from an untrusted peer", h)
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,377 @@
+package oni
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"git.sr.ht/~mariusor/lw"
+	"git.sr.ht/~mariusor/ssm"
+	vocab "github.com/go-ap/activitypub"
+	"github.com/go-ap/client"
+	"github.com/go-ap/errors"
+)
+
+const (
+	queueFolder   = "queue"
+	pendingFolder = "pending"
+	deadFolder    = "dead"
+
+	// deliveryBaseWait is the delay before the first retry of a failed delivery,
+	// it grows using the same strategy as runWithRetry.
+	deliveryBaseWait = 30 * baseWaitTime
+	// deliveryAttempts is the number of failed deliveries after which a job is moved to the dead-letter state.
+	deliveryAttempts = 2 * retries
+
+	deliveryPollInterval = 10 * time.Second
+	deliveryWorkers      = 4
+)
+
+// DeliveryJob represents the delivery of an activity to a single recipient inbox.
+type DeliveryJob struct {
+	ID        string          `json:"id"`
+	Actor     vocab.IRI       `json:"actor"`
+	Inbox     vocab.IRI       `json:"inbox"`
+	Activity  json.RawMessage `json:"activity"`
+	Attempts  int             `json:"attempts"`
+	LastError string          `json:"lastError,omitempty"`
+	Created   time.Time       `json:"created"`
+	NextTry   time.Time       `json:"nextTry"`
+	Dead      bool            `json:"dead,omitempty"`
+}
+
+// DeliveryQueue is a persistent outbound delivery queue kept in the storage path.
+// Every job is a JSON file, which is moved to the dead-letter folder after deliveryAttempts failures.
+type DeliveryQueue struct {
+	path   string
+	notify chan struct{}
+}
+
+var queues = sync.Map{}
+
+// Queue returns the delivery queue corresponding to the current storage path.
+func (c *Control) Queue() *DeliveryQueue {
+	if q, ok := queues.Load(c.StoragePath); ok {
+		return q.(*DeliveryQueue)
+	}
+	q, _ := queues.LoadOrStore(c.StoragePath, &DeliveryQueue{
+		path:   filepath.Join(c.StoragePath, queueFolder),
+		notify: make(chan struct{}, 1),
+	})
+	return q.(*DeliveryQueue)
+}
+
+func (q *DeliveryQueue) folder(dead bool) string {
+	if dead {
+		return filepath.Join(q.path, deadFolder)
+	}
+	return filepath.Join(q.path, pendingFolder)
+}
+
+func (q *DeliveryQueue) jobPath(j DeliveryJob) string {
+	return filepath.Join(q.folder(j.Dead), j.ID+".json")
+}
+
+func jobID(inbox vocab.IRI, raw []byte, t time.Time) string {
+	h := sha256.New()
+	h.Write([]byte(inbox))
+	h.Write(raw)
+	return fmt.Sprintf("%d-%x", t.UnixNano(), h.Sum(nil)[:6])
+}
+
+// Enqueue saves a new job for delivering "it" to the "inbox" collection on behalf of "actor".
+func (q *DeliveryQueue) Enqueue(actor vocab.IRI, inbox vocab.IRI, it vocab.Item) (*DeliveryJob, error) {
+	raw, err := vocab.MarshalJSON(it)
+	if err != nil {
+		return nil, errors.Annotatef(err, "unable to marshal activity for delivery")
+	}
+	now := TimeNow()
+	j := DeliveryJob{
+		ID:       jobID(inbox, raw, now),
+		Actor:    actor,
+		Inbox:    inbox,
+		Activity: raw,
+		Created:  now,
+		NextTry:  now,
+	}
+	if err = q.save(j); err != nil {
+		return nil, err
+	}
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+	return &j, nil
+}
+
+func (q *DeliveryQueue) save(j DeliveryJob) error {
+	p := q.jobPath(j)
+	if err := os.MkdirAll(filepath.Dir(p), 0o700); err != nil {
+		return errors.Annotatef(err, "unable to create queue folder")
+	}
+	raw, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+	// NOTE(marius): we write to a temporary file first, so an interrupted write doesn't leave a broken job behind
+	tmp := p + ".tmp"
+	if err = os.WriteFile(tmp, raw, 0o600); err != nil {
+		return errors.Annotatef(err, "unable to save delivery job %s", j.ID)
+	}
+	return os.Rename(tmp, p)
+}
+
+func (q *DeliveryQueue) load(p string) (DeliveryJob, error) {
+	j := DeliveryJob{}
+	raw, err := os.ReadFile(p)
+	if err != nil {
+		return j, err
+	}
+	err = json.Unmarshal(raw, &j)
+	return j, err
+}
+
+// List returns the pending jobs, or the dead ones if "dead" is true, ordered by their creation time.
+func (q *DeliveryQueue) List(dead bool) ([]DeliveryJob, error) {
+	entries, err := os.ReadDir(q.folder(dead))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	jobs := make([]DeliveryJob, 0, len(entries))
+	for _, e := range entries {
+		if e.IsDir() || filepath.Ext(e.Name()) != ".json" {
+			continue
+		}
+		j, err := q.load(filepath.Join(q.folder(dead), e.Name()))
+		if err != nil {
+			continue
+		}
+		jobs = append(jobs, j)
+	}
+	slices.SortFunc(jobs, func(a, b DeliveryJob) int {
+		return a.Created.Compare(b.Created)
+	})
+	return jobs, nil
+}
+
+// Count returns the number of pending and dead jobs.
+func (q *DeliveryQueue) Count() (pending int, dead int) {
+	count := func(p string) int {
+		entries, _ := os.ReadDir(p)
+		cnt := 0
+		for _, e := range entries {
+			if filepath.Ext(e.Name()) == ".json" {
+				cnt++
+			}
+		}
+		return cnt
+	}
+	return count(q.folder(false)), count(q.folder(true))
+}
+
+func matchesJobIDs(j DeliveryJob, ids []string) bool {
+	if len(ids) == 0 {
+		return true
+	}
+	return slices.ContainsFunc(ids, func(id string) bool {
+		return strings.HasPrefix(j.ID, id)
+	})
+}
+
+// Retry moves the dead jobs matching "ids", or all of them if none were passed, back to the pending state.
+func (q *DeliveryQueue) Retry(ids ...string) (int, error) {
+	jobs, err := q.List(true)
+	if err != nil {
+		return 0, err
+	}
+	cnt := 0
+	for _, j := range jobs {
+		if !matchesJobIDs(j, ids) {
+			continue
+		}
+		deadPath := q.jobPath(j)
+		j.Dead = false
+		j.Attempts = 0
+		j.NextTry = TimeNow()
+		if err = q.save(j); err != nil {
+			return cnt, err
+		}
+		if err = os.RemoveAll(deadPath); err != nil {
+			return cnt, err
+		}
+		cnt++
+	}
+	if cnt > 0 {
+		select {
+		case q.notify <- struct{}{}:
+		default:
+		}
+	}
+	return cnt, nil
+}
+
+// Purge removes the jobs matching "ids", or all of them if none were passed.
+func (q *DeliveryQueue) Purge(dead bool, ids ...string) (int, error) {
+	jobs, err := q.List(dead)
+	if err != nil {
+		return 0, err
+	}
+	cnt := 0
+	for _, j := range jobs {
+		if !matchesJobIDs(j, ids) {
+			continue
+		}
+		if err = os.RemoveAll(q.jobPath(j)); err != nil {
+			return cnt, err
+		}
+		cnt++
+	}
+	return cnt, nil
+}
+
+// deliveryBackOff computes the wait time before the next delivery attempt,
+// using the same strategy as runWithRetry.
+func deliveryBackOff(attempts int) time.Duration {
+	incFn := ssm.Jitter(jitterDelay, ssm.Linear(multiplier))
+	d := deliveryBaseWait
+	for i := 1; i < attempts; i++ {
+		d = incFn(d)
+	}
+	return d
+}
+
+// failed updates the job after an unsuccessful delivery, moving it to the dead-letter state if needed.
+func (q *DeliveryQueue) failed(j DeliveryJob, err error) (DeliveryJob, error) {
+	pendingPath := q.jobPath(j)
+	j.Attempts++
+	j.LastError = err.Error()
+	j.NextTry = TimeNow().Add(deliveryBackOff(j.Attempts))
+	if j.Attempts >= deliveryAttempts {
+		j.Dead = true
+	}
+	if serr := q.save(j); serr != nil {
+		return j, serr
+	}
+	if j.Dead {
+		return j, os.RemoveAll(pendingPath)
+	}
+	return j, nil
+}
+
+func (q *DeliveryQueue) done(j DeliveryJob) error {
+	return os.RemoveAll(q.jobPath(j))
+}
+
+// queuedClient is a client that persists the outbound deliveries to the DeliveryQueue
+// instead of sending them immediately. All the other operations are passed through to the wrapped client.
+type queuedClient struct {
+	client.Basic
+
+	actor vocab.IRI
+	q     *DeliveryQueue
+}
+
+func (c queuedClient) ToCollection(inbox vocab.IRI, it vocab.Item) (vocab.IRI, vocab.Item, error) {
+	return c.CtxToCollection(context.Background(), inbox, it)
+}
+
+func (c queuedClient) CtxToCollection(_ context.Context, inbox vocab.IRI, it vocab.Item) (vocab.IRI, vocab.Item, error) {
+	if _, err := c.q.Enqueue(c.actor, inbox, it); err != nil {
+		return "", it, err
+	}
+	return it.GetLink(), it, nil
+}
+
+// DeliveryClient returns a client which queues the outbound deliveries done on behalf of the actor.
+func (c *Control) DeliveryClient(actor vocab.Actor, lctx lw.Ctx) client.Basic {
+	return queuedClient{Basic: c.Client(actor, lctx), actor: actor.GetLink(), q: c.Queue()}
+}
+
+func (c *Control) deliver(ctx context.Context, j DeliveryJob) error {
+	it, err := c.Storage.Load(j.Actor)
+	if err != nil {
+		return errors.Annotatef(err, "unable to load delivery actor %s", j.Actor)
+	}
+	actor, err := vocab.ToActor(it)
+	if err != nil {
+		return errors.Annotatef(err, "invalid delivery actor %s", j.Actor)
+	}
+	act, err := vocab.UnmarshalJSON(j.Activity)
+	if err != nil {
+		return errors.Annotatef(err, "unable to unmarshal delivery activity")
+	}
+	cl := c.Client(*actor, lw.Ctx{"log": "delivery"})
+	_, _, err = cl.CtxToCollection(ctx, j.Inbox, act)
+	return err
+}
+
+// RunDeliveryQueue delivers the due jobs from the queue until the context is canceled.
+func (c *Control) RunDeliveryQueue(ctx context.Context) {
+	q := c.Queue()
+	tick := time.NewTicker(deliveryPollInterval)
+	defer tick.Stop()
+
+	for {
+		c.deliverDueJobs(ctx, q)
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+		case <-q.notify:
+		}
+	}
+}
+
+func (c *Control) deliverDueJobs(ctx context.Context, q *DeliveryQueue) {
+	jobs, err := q.List(false)
+	if err != nil {
+		c.Logger.WithContext(lw.Ctx{"err": err.Error()}).Warnf("Unable to load delivery queue")
+		return
+	}
+
+	now := TimeNow()
+	sem := make(chan struct{}, deliveryWorkers)
+	wg := sync.WaitGroup{}
+	for _, j := range jobs {
+		if j.NextTry.After(now) {
+			continue
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		sem <- struct{}{}
+		wg.Go(func() {
+			defer func() { <-sem }()
+
+			l := c.Logger.WithContext(lw.Ctx{"job": j.ID, "inbox": j.Inbox, "attempts": j.Attempts + 1})
+			if err := c.deliver(ctx, j); err != nil {
+				j, err = q.failed(j, err)
+				if err != nil {
+					l.WithContext(lw.Ctx{"err": err.Error()}).Errorf("Unable to update delivery job")
+					return
+				}
+				if j.Dead {
+					l.WithContext(lw.Ctx{"err": j.LastError}).Warnf("Delivery failed, moved to dead-letter queue")
+				} else {
+					l.WithContext(lw.Ctx{"err": j.LastError, "next": j.NextTry}).Debugf("Delivery failed, will retry")
+				}
+				return
+			}
+			if err := q.done(j); err != nil {
+				l.WithContext(lw.Ctx{"err": err.Error()}).Errorf("Unable to remove delivered job")
+			}
+			l.Debugf("Delivered")
+		})
+	}
+	wg.Wait()
+}
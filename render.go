@@ -78,6 +78,7 @@ var (
 			},
 			"HTTPErrors":          errors.HttpErrors,
 			"CurrentURL":          func() template.HTMLAttr { return "" },
+			"Feeds":               func() []FeedLink { return nil },
 			"oniCollectionParent": func() vocab.IRI { return "" },
 		}},
 	}
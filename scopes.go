@@ -0,0 +1,201 @@
+package oni
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	vocab "github.com/go-ap/activitypub"
+	"github.com/go-ap/errors"
+	"golang.org/x/oauth2"
+)
+
+// The OAuth2 scopes which limit what a client can do with the access tokens it receives.
+const (
+	ScopeRead   = "read"
+	ScopeWrite  = "write"
+	ScopeFollow = "follow"
+	ScopeMedia  = "media"
+	ScopeAdmin  = "admin"
+)
+
+// Scopes are all the scopes supported, in the order they are shown to the user.
+var Scopes = []string{ScopeRead, ScopeWrite, ScopeFollow, ScopeMedia, ScopeAdmin}
+
+// DefaultScopes are granted to the clients which don't request any scope.
+var DefaultScopes = []string{ScopeRead, ScopeWrite, ScopeFollow, ScopeMedia}
+
+var scopeDescriptions = map[string]string{
+	ScopeRead:   "Read your inbox, and your private activities and collections",
+	ScopeWrite:  "Publish, update and delete activities and objects",
+	ScopeFollow: "Follow and block other actors, and approve your followers",
+	ScopeMedia:  "Upload images, audio and video",
+	ScopeAdmin:  "Access the status and the metrics of the server",
+}
+
+type scopes []string
+
+func parseScopes(s string) scopes {
+	return strings.Fields(s)
+}
+
+func (s scopes) Has(scope string) bool {
+	return slices.Contains(s, scope)
+}
+
+func (s scopes) String() string {
+	return strings.Join(s, " ")
+}
+
+// negotiateScopes validates the space separated scopes requested by a client, and returns them in canonical order.
+func negotiateScopes(requested string) (string, error) {
+	req := parseScopes(requested)
+	if len(req) == 0 {
+		return scopes(DefaultScopes).String(), nil
+	}
+	for _, sc := range req {
+		if !slices.Contains(Scopes, sc) {
+			return "", errors.BadRequestf("unknown scope %q", sc)
+		}
+	}
+	granted := make(scopes, 0, len(req))
+	for _, sc := range Scopes {
+		if req.Has(sc) {
+			granted = append(granted, sc)
+		}
+	}
+	return granted.String(), nil
+}
+
+// tokenScopes returns the scopes of an access token.
+// NOTE(marius): the tokens issued before we had scopes have either an empty scope or the "scope" placeholder
+// GenAccessToken used to set, and they get the same scopes as the clients which don't request any.
+func tokenScopes(scope string) scopes {
+	if scope == "" || scope == "scope" {
+		return DefaultScopes
+	}
+	return parseScopes(scope)
+}
+
+// requestTokens returns the OAuth2 access tokens sent with the request, from the cookie set by the login page
+// and from the Authorization header, in the order loadAuthorizedActor uses them.
+func requestTokens(r *http.Request) []string {
+	tokens := make([]string, 0, 2)
+	if cookieAuth, _ := r.Cookie("auth"); cookieAuth != nil {
+		if rawJson, err := url.QueryUnescape(cookieAuth.Value); err == nil {
+			tok := new(oauth2.Token)
+			if err = json.Unmarshal([]byte(rawJson), tok); err == nil && tok.AccessToken != "" {
+				tokens = append(tokens, tok.AccessToken)
+			}
+		}
+	}
+	if tok := bearerToken(r); tok != "" {
+		tokens = append(tokens, tok)
+	}
+	return tokens
+}
+
+// bearerToken returns the token from the Bearer Authorization header of the request.
+func bearerToken(r *http.Request) string {
+	if typ, tok, ok := strings.Cut(r.Header.Get("Authorization"), " "); ok && strings.EqualFold(typ, "Bearer") {
+		return strings.TrimSpace(tok)
+	}
+	return ""
+}
+
+// requestScopes returns the scopes of the OAuth2 access token the request has been authorized with.
+// The requests authorized otherwise, with HTTP signatures or with the actor's password, are not limited by scopes,
+// and for them the second returned value is false.
+func (o *oni) requestScopes(r *http.Request) (scopes, bool) {
+	for _, tok := range requestTokens(r) {
+		if ad, err := o.Storage.LoadAccess(tok); err == nil && ad != nil {
+			return tokenScopes(ad.Scope), true
+		}
+	}
+	return nil, false
+}
+
+// checkScopes returns a Forbidden error if the request has been authorized with an access token
+// which lacks any of the "needed" scopes.
+func (o *oni) checkScopes(r *http.Request, needed ...string) error {
+	granted, ok := o.requestScopes(r)
+	if !ok {
+		return nil
+	}
+	for _, sc := range needed {
+		if !granted.Has(sc) {
+			return errors.Forbiddenf("the access token doesn't have the %q scope", sc)
+		}
+	}
+	return nil
+}
+
+var (
+	followScopeTypes = vocab.ActivityVocabularyTypes{vocab.FollowType, vocab.BlockType, vocab.IgnoreType}
+	mediaObjectTypes = vocab.ActivityVocabularyTypes{vocab.ImageType, vocab.AudioType, vocab.VideoType, vocab.DocumentType}
+)
+
+func hasMedia(it vocab.Item) bool {
+	if vocab.IsNil(it) {
+		return false
+	}
+	if it.IsCollection() {
+		media := false
+		_ = vocab.OnCollectionIntf(it, func(col vocab.CollectionInterface) error {
+			media = slices.ContainsFunc(col.Collection(), hasMedia)
+			return nil
+		})
+		return media
+	}
+	media := false
+	_ = vocab.OnObject(it, func(ob *vocab.Object) error {
+		media = mediaObjectTypes.Match(ob.GetType()) || hasMedia(ob.Attachment)
+		return nil
+	})
+	return media
+}
+
+// activityScopes returns the scopes needed by a client for sending the activity "it".
+func (o *oni) activityScopes(it vocab.Item) []string {
+	needed := []string{ScopeWrite}
+	_ = vocab.OnActivity(it, func(act *vocab.Activity) error {
+		typ := act.GetType()
+		switch {
+		case followScopeTypes.Match(typ):
+			needed = []string{ScopeFollow}
+		case (vocab.ActivityVocabularyTypes{vocab.UndoType, vocab.AcceptType, vocab.RejectType}).Match(typ):
+			ob := act.Object
+			if vocab.IsIRI(ob) {
+				// NOTE(marius): the clients usually send only the IRI of the activity they accept, reject or undo,
+				// which is in our storage, as we received it, or we sent it.
+				if loaded, err := o.Storage.Load(ob.GetLink()); err == nil && !vocab.IsNil(loaded) {
+					ob = loaded
+				}
+			}
+			if !vocab.IsNil(ob) && followScopeTypes.Match(ob.GetType()) {
+				needed = []string{ScopeFollow}
+			}
+		}
+		// NOTE(marius): the media can be embedded in the object of any activity type, not only in Create and Update
+		if hasMedia(act.Object) {
+			needed = append(needed, ScopeMedia)
+		}
+		return nil
+	})
+	return needed
+}
+
+type scopeDescription struct {
+	Name        string
+	Description string
+}
+
+func describeScopes(s string) []scopeDescription {
+	desc := make([]scopeDescription, 0)
+	for _, sc := range parseScopes(s) {
+		desc = append(desc, scopeDescription{Name: sc, Description: scopeDescriptions[sc]})
+	}
+	return desc
+}
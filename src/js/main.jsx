@@ -26,6 +26,7 @@ import {ActivityPubAppreciation} from "./activity-pub-appreciation";
 import {ActivityPubFollow} from "./activity-pub-follow";
 import {Palette, PaletteElement} from "./oni-theme";
 import {OniThrobber} from "./oni-throbber";
+import {OniPasskeyLogin, OniPasskeyRegister} from "./oni-passkey";
 
 customElements.define('oni-main', OniMain);
 customElements.define('oni-errors', OniErrors);
@@ -60,6 +61,8 @@ customElements.define('oni-icon', OniIcon);
 customElements.define('oni-throbber', OniThrobber);
 
 customElements.define('oni-login-link', OniLoginLink);
+customElements.define('oni-passkey-login', OniPasskeyLogin);
+customElements.define('oni-passkey-register', OniPasskeyRegister);
 
 customElements.define('bandcamp-embed', BandCampEmbed);
 
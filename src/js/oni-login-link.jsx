@@ -35,6 +35,7 @@ export class OniLoginLink extends LitElement {
         fetched: {type: Boolean},
         error: {type: Object},
         authorized: {type: Boolean},
+        challenge: {type: String},
     }
 
     _auth = new AuthController(this);
@@ -55,6 +56,8 @@ export class OniLoginLink extends LitElement {
 
     hideDialog(e) {
         this.error = null;
+        this.challenge = null;
+        this._pw = null;
         this.shadowRoot?.querySelector("dialog")?.close();
     }
 
@@ -75,14 +78,21 @@ export class OniLoginLink extends LitElement {
         e.preventDefault();
 
         const form = e.target;
-        const pw = form._pw.value
+        if (this.challenge) {
+            // NOTE(marius): the password was correct, and the second factor is what we're sending now
+            const otp = form._otp.value;
+            form._otp.value = "";
+            this.authorizationToken(form.action, {_challenge: this.challenge, _otp: otp});
+            return;
+        }
+        this._pw = form._pw.value;
         form._pw.value = "";
 
-        this.authorizationToken(form.action, pw);
+        this.authorizationToken(form.action, {_pw: this._pw});
     }
 
-    async authorizationToken(targetURI, pw) {
-        const l = new URLSearchParams({_pw: pw});
+    async authorizationToken(targetURI, params) {
+        const l = new URLSearchParams(params);
 
         const req = {
             method: 'POST',
@@ -99,10 +109,16 @@ export class OniLoginLink extends LitElement {
                     throw Error(`invalid response received from authorization page`);
                 }
                 response.json().then(value => {
-                    if (response.status === 200) {
+                    if (response.status === 200 && value.challenge) {
+                        this.challenge = value.challenge;
+                    } else if (response.status === 200) {
                         console.debug(`Obtained authorization code: ${value.code}`)
-                        this.accessToken(value.code, value.state, pw);
+                        this.challenge = null;
+                        this.accessToken(value.code, value.state);
                     } else {
+                        // NOTE(marius): the challenges can be used only once, so we start again with the password
+                        this.challenge = null;
+                        this._pw = null;
                         this.error = {errors: [{code: value['error'], message: value['error_description']}]};
                     }
                 }).catch(console.warn);
@@ -110,18 +126,23 @@ export class OniLoginLink extends LitElement {
             .catch((error) => this.error = handleError(error));
     }
 
-    async accessToken(code, state, pw) {
+    async accessToken(code, state) {
         const tokenURL = this.tokenURL;
 
         const client = `${window.location.protocol}//${window.location.host}`;
+        const redirectURI = new URL(this.authorizeURL, window.location.href).searchParams.get('redirect_uri');
         const l = new URLSearchParams({
-            grant_type: 'client_credentials',
+            grant_type: 'authorization_code',
             code: code,
             state: state,
             client_id: client,
         });
+        if (redirectURI) {
+            l.set('redirect_uri', redirectURI);
+        }
 
-        const basicAuth = `${encodeURIComponent(client)}:${pw}`;
+        const basicAuth = `${encodeURIComponent(client)}:${encodeURIComponent(this._pw ?? "")}`;
+        this._pw = null;
         const req = {
             method: 'POST',
             body: l.toString(),
@@ -185,8 +206,15 @@ export class OniLoginLink extends LitElement {
                         <dialog closedby="any">
                             <oni-errors it=${JSON.stringify(this.error?.errors)} ?inline=${true}></oni-errors>
                             <form method="post" action=${this.authorizeURL} @submit="${this.login}">
-                                <input type="password" id="_pw" name="_pw" placeholder="Password" autofocus required autocomplete="current-password"/><br/>
-                                <button type="submit">Sign in</button>
+                                ${when(
+                                        this.challenge,
+                                        () => html`
+                                            <input type="text" id="_otp" name="_otp" placeholder="Authentication code" inputmode="numeric" autofocus required autocomplete="one-time-code"/><br/>
+                                            <button type="submit">Verify</button>`,
+                                        () => html`
+                                            <input type="password" id="_pw" name="_pw" placeholder="Password" autofocus required autocomplete="current-password"/><br/>
+                                            <button type="submit">Sign in</button>`
+                                )}
                             </form>
                         </dialog>`,
                     () => html`<a @click=${this.logout} href="#"><oni-icon alt="Sign out" name="sign-out"></oni-icon>Sign out</a>`
@@ -0,0 +1,190 @@
+import {css, html, LitElement, nothing} from "lit";
+import {when} from "lit-html/directives/when.js";
+import {AuthController} from "./auth-controller.js";
+
+const passkeyStyles = css`
+    :host {
+        display: block;
+        margin: .4rem 0;
+    }
+    oni-errors, .error {
+        color: var(--accent-color);
+        line-height: 1.4rem;
+    }
+`;
+
+function fromBase64URL(s) {
+    const b64 = s.replace(/-/g, '+').replace(/_/g, '/');
+    return Uint8Array.from(atob(b64.padEnd(b64.length + (4 - b64.length % 4) % 4, '=')), c => c.charCodeAt(0)).buffer;
+}
+
+function toBase64URL(buf) {
+    return btoa(String.fromCharCode(...new Uint8Array(buf)))
+        .replace(/\+/g, '-').replace(/\//g, '_').replace(/=+$/, '');
+}
+
+function creationOptions(opts) {
+    opts.challenge = fromBase64URL(opts.challenge);
+    opts.user.id = fromBase64URL(opts.user.id);
+    opts.excludeCredentials = (opts.excludeCredentials || []).map(c => ({...c, id: fromBase64URL(c.id)}));
+    return opts;
+}
+
+function requestOptions(opts) {
+    opts.challenge = fromBase64URL(opts.challenge);
+    opts.allowCredentials = (opts.allowCredentials || []).map(c => ({...c, id: fromBase64URL(c.id)}));
+    return opts;
+}
+
+// NOTE(marius): newer browsers can serialize the credentials themselves, for the others we do it by hand.
+function credentialJSON(cred) {
+    if (typeof cred.toJSON === 'function') {
+        return cred.toJSON();
+    }
+    const response = {clientDataJSON: toBase64URL(cred.response.clientDataJSON)};
+    if (cred.response.attestationObject) {
+        response.attestationObject = toBase64URL(cred.response.attestationObject);
+        response.transports = cred.response.getTransports?.() || [];
+    }
+    if (cred.response.authenticatorData) {
+        response.authenticatorData = toBase64URL(cred.response.authenticatorData);
+        response.signature = toBase64URL(cred.response.signature);
+        if (cred.response.userHandle) {
+            response.userHandle = toBase64URL(cred.response.userHandle);
+        }
+    }
+    return {
+        id: cred.id,
+        rawId: toBase64URL(cred.rawId),
+        type: cred.type,
+        authenticatorAttachment: cred.authenticatorAttachment,
+        clientExtensionResults: cred.getClientExtensionResults(),
+        response: response,
+    };
+}
+
+async function passkeyOptions(url, body, headers = {}) {
+    const response = await fetch(url, {
+        method: 'POST',
+        body: body,
+        headers: {
+            Accept: "application/json",
+            "Content-Type": "application/x-www-form-urlencoded",
+            ...headers,
+        },
+    });
+    if (!response.ok) {
+        throw Error(`unable to get the passkey options: ${response.statusText}`);
+    }
+    return response.json();
+}
+
+// OniPasskeyLogin signs in with a passkey from the login page, by posting the assertion in the enclosing form.
+export class OniPasskeyLogin extends LitElement {
+    static styles = [passkeyStyles];
+
+    static properties = {
+        begin: {type: String},
+        error: {type: String},
+    }
+
+    async login(e) {
+        e.preventDefault();
+        e.stopPropagation();
+
+        const form = this.closest('form');
+        try {
+            const options = await passkeyOptions(this.begin, '');
+            const cred = await navigator.credentials.get({publicKey: requestOptions(options.publicKey)});
+            form.elements.namedItem('_ceremony').value = options.ceremony;
+            form.elements.namedItem('_passkey').value = JSON.stringify(credentialJSON(cred));
+            form.elements.namedItem('_pw')?.removeAttribute('required');
+            form.submit();
+        } catch (err) {
+            console.warn(err);
+            this.error = err.message;
+        }
+    }
+
+    render() {
+        if (!window.PublicKeyCredential) {
+            return nothing;
+        }
+        return html`
+            <button type="button" @click=${this.login}><oni-icon name="sign-in"></oni-icon> Sign in with a passkey</button>
+            ${when(this.error, () => html`<p class="error">${this.error}</p>`)}`;
+    }
+}
+
+// OniPasskeyRegister adds a passkey, using either the one-time link token, or the authorization of the signed in actor,
+// who needs to confirm the password, and the authentication code when using two-factor authentication.
+export class OniPasskeyRegister extends LitElement {
+    static styles = [passkeyStyles];
+
+    static properties = {
+        begin: {type: String},
+        token: {type: String},
+        twoFactor: {type: Boolean, attribute: 'two-factor'},
+        error: {type: String},
+        added: {type: String},
+    }
+
+    _auth = new AuthController(this);
+
+    async register(e) {
+        e.preventDefault();
+        e.stopPropagation();
+
+        const elements = e.target.elements;
+        const name = elements.namedItem('name').value;
+        const headers = {};
+        const params = new URLSearchParams({token: this.token || ''});
+        if (!this.token) {
+            this._auth.authorized && this._auth.addHeader(headers);
+            params.set('_pw', elements.namedItem('_pw').value);
+            if (this.twoFactor) {
+                params.set('_otp', elements.namedItem('_otp').value);
+            }
+        }
+        try {
+            const options = await passkeyOptions(this.begin, params.toString(), headers);
+            const cred = await navigator.credentials.create({publicKey: creationOptions(options.publicKey)});
+            const response = await fetch(`${this.begin}/${options.ceremony}?${new URLSearchParams({name: name})}`, {
+                method: 'POST',
+                body: JSON.stringify(credentialJSON(cred)),
+                headers: {
+                    Accept: "application/json",
+                    "Content-Type": "application/json",
+                },
+            });
+            if (!response.ok) {
+                throw Error(`unable to add the passkey: ${response.statusText}`);
+            }
+            const value = await response.json();
+            this.added = value.name;
+            this.error = null;
+        } catch (err) {
+            console.warn(err);
+            this.error = err.message;
+        }
+    }
+
+    render() {
+        if (!window.PublicKeyCredential) {
+            return html`<p class="error">This browser doesn't support passkeys.</p>`;
+        }
+        if (this.added) {
+            return html`<p>Added the passkey "${this.added}", you can use it next time you sign in.</p>`;
+        }
+        return html`
+            <form @submit=${this.register}>
+                <input type="text" name="name" placeholder="Passkey name, eg: my phone" size="40"/><br/>
+                ${when(!this.token, () => html`
+                    <input type="password" name="_pw" placeholder="Password" autocomplete="current-password" required/><br/>
+                    ${when(this.twoFactor, () => html`
+                        <input type="text" name="_otp" placeholder="Authentication code" autocomplete="one-time-code" inputmode="numeric" required/><br/>`)}`)}
+                <button type="submit">Add a passkey</button>
+            </form>
+            ${when(this.error, () => html`<p class="error">${this.error}</p>`)}`;
+    }
+}
@@ -10,6 +10,8 @@ import (
 	"encoding/pem"
 	"fmt"
 	"math/rand/v2"
+	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 	"sync/atomic"
@@ -29,28 +31,97 @@ import (
 	gossh "golang.org/x/crypto/ssh"
 )
 
+// storedPw is the password hash of the last actor which authenticated with a password.
+type storedPw struct {
+	user string
+	hash []byte
+}
+
 func SSHAuthPw(f *oni) ssh.PasswordHandler {
-	// NOTE(marius): this is useful for cases where we use the maintenance command to close the storage
-	lastUsedPwHash := atomic.Pointer[[]byte]{}
+	// NOTE(marius): this is useful for cases where we use the maintenance command to close the storage.
+	// We keep it only for the actors without two-factor authentication, as we can't check the second factor
+	// while the storage is closed.
+	lastUsedPw := atomic.Pointer[storedPw]{}
 
-	validateStoredPw := func(pw string) bool {
-		hash := lastUsedPwHash.Load()
-		if hash == nil {
+	validateStoredPw := func(user, pw string) bool {
+		stored := lastUsedPw.Load()
+		if stored == nil || stored.user != user {
 			return false
 		}
-		return bcrypt.CompareHashAndPassword(*hash, []byte(pw)) == nil
+		return bcrypt.CompareHashAndPassword(stored.hash, []byte(pw)) == nil
 	}
 
 	return func(ctx ssh.Context, pw string) bool {
-		acc, ok := pwCheck(f, ctx.User(), []byte(pw))
-		if !ok {
-			if !validateStoredPw(pw) {
-				f.Logger.WithContext(lw.Ctx{"iri": ctx.User(), "pw": mask.S(pw)}).Warnf("failed password authentication")
+		var acc *vocab.Actor
+		needsSecondFactor := false
+		err := f.checkPassword("ssh", vocab.IRI(ctx.User()), ctx.RemoteAddr().String(), func() error {
+			var ok bool
+			if acc, ok = pwCheck(f, ctx.User(), []byte(pw)); ok {
+				if needsSecondFactor = f.TOTPEnabled(acc.ID); needsSecondFactor {
+					lastUsedPw.Store(nil)
+					return nil
+				}
+				if hash, err := bcrypt.GenerateFromPassword([]byte(pw), bcrypt.DefaultCost); err == nil {
+					lastUsedPw.Store(&storedPw{user: ctx.User(), hash: hash})
+				}
+				return nil
+			}
+			if validateStoredPw(ctx.User(), pw) {
+				return nil
+			}
+			return errUnauthorized
+		})
+		if err != nil {
+			f.Logger.WithContext(lw.Ctx{"iri": ctx.User(), "pw": mask.S(pw), "err": err.Error()}).Warnf("failed password authentication")
+			return false
+		}
+		if needsSecondFactor {
+			// NOTE(marius): the actors with two-factor authentication need to use keyboard-interactive authentication
+			f.Logger.WithContext(lw.Ctx{"iri": acc.ID}).Debugf("password authentication needs a second factor")
+			return false
+		}
+
+		ctx.SetValue("actor", acc)
+		return true
+	}
+}
+
+// SSHAuthKeyboardInteractive asks for the password, and for the actors which have enabled two-factor authentication,
+// for the TOTP or recovery code.
+func SSHAuthKeyboardInteractive(f *oni) ssh.KeyboardInteractiveHandler {
+	return func(ctx ssh.Context, challenge gossh.KeyboardInteractiveChallenge) bool {
+		iri := vocab.IRI(ctx.User())
+		addr := ctx.RemoteAddr().String()
+		lctx := lw.Ctx{"iri": ctx.User()}
+
+		answers, err := challenge(ctx.User(), "", []string{"Password: "}, []bool{false})
+		if err != nil || len(answers) != 1 {
+			return false
+		}
+		var acc *vocab.Actor
+		err = f.checkPassword("ssh", iri, addr, func() error {
+			var ok bool
+			if acc, ok = pwCheck(f, ctx.User(), []byte(answers[0])); !ok {
+				return errUnauthorized
+			}
+			return nil
+		})
+		if err != nil {
+			f.Logger.WithContext(lctx, lw.Ctx{"err": err.Error()}).Warnf("failed password authentication")
+			return false
+		}
+
+		if f.TOTPEnabled(acc.ID) {
+			answers, err = challenge(ctx.User(), "Two-factor authentication", []string{"Authentication code: "}, []bool{true})
+			if err != nil || len(answers) != 1 {
 				return false
 			}
-		} else {
-			if hash, err := bcrypt.GenerateFromPassword([]byte(pw), bcrypt.DefaultCost); err == nil {
-				lastUsedPwHash.Store(&hash)
+			err = f.checkOTP("ssh", acc.ID, addr, func() error {
+				return f.CheckSecondFactor(acc.ID, answers[0])
+			})
+			if err != nil {
+				f.Logger.WithContext(lctx, lw.Ctx{"err": err.Error()}).Warnf("failed two-factor authentication")
+				return false
 			}
 		}
 
@@ -102,7 +173,6 @@ func SSHAuthPublicKey(f *oni) ssh.PublicKeyHandler {
 var kongDefaultVars = kong.Vars{
 	"version":    Version,
 	"name":       AppName,
-	"default_pw": DefaultOAuth2ClientPw,
 	"defaultEnv": "dev",
 }
 
@@ -115,7 +185,9 @@ func runSSHCommand(f *oni, s ssh.Session) error {
 	ctl := new(Control)
 	ctl.Logger = f.Logger
 	ctl.Storage = f.Storage
+	ctl.StorageType = f.StorageType
 	ctl.StoragePath = f.StoragePath
+	ctl.handleControl = f.handleControl
 	ctl.out = s
 	ctl.in = s
 	ctl.err = s.Stderr()
@@ -266,15 +338,21 @@ func initSSHServer(ctl *oni) (m.Server, error) {
 	initFns := []m.SSHSetFn{
 		wish.WithPublicKeyAuth(SSHAuthPublicKey(ctl)),
 		wish.WithPasswordAuth(SSHAuthPw(ctl)),
+		wish.WithKeyboardInteractiveAuth(SSHAuthKeyboardInteractive(ctl)),
 		wish.WithMiddleware(
 			logging.MiddlewareWithLogger(justPrintLogger(ctl.Logger.Debugf)),
 			AdminHandler(ctl),
 		),
 	}
 
+	// NOTE(marius): the SSH server listens on the port following the one of the first TCP socket
+	listen := ""
+	if i := slices.IndexFunc(ctl.Listen, func(l string) bool { return !filepath.IsAbs(l) }); i >= 0 {
+		listen = ctl.Listen[i]
+	}
 	sshListen := "127.0.0.1:" + strconv.Itoa(defaultSSHPort)
-	if strings.Index(ctl.Listen, ":") >= 0 {
-		listenPieces := strings.Split(ctl.Listen, ":")
+	if strings.Index(listen, ":") >= 0 {
+		listenPieces := strings.Split(listen, ":")
 		var listenHost string
 		var listenPort int
 		if len(listenPieces) == 1 || len(listenPieces) == 2 {
@@ -0,0 +1,77 @@
+package oni
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+	"time"
+
+	"git.sr.ht/~mariusor/storage-all"
+	vocab "github.com/go-ap/activitypub"
+)
+
+// ServerStatus is the runtime information of a running server, served at /debug/status.
+type ServerStatus struct {
+	Version     string       `json:"version"`
+	Started     time.Time    `json:"started"`
+	Uptime      string       `json:"uptime"`
+	StorageType storage.Type `json:"storage_type"`
+	StoragePath string       `json:"storage_path"`
+	Maintenance bool         `json:"maintenance"`
+	Debug       bool         `json:"debug"`
+	Actors      vocab.IRIs   `json:"actors"`
+	Goroutines  int          `json:"goroutines"`
+	Queue       struct {
+		Pending int `json:"pending"`
+		Dead    int `json:"dead"`
+	} `json:"queue"`
+}
+
+func (o *oni) Status() ServerStatus {
+	st := ServerStatus{
+		Version:     Version,
+		Started:     o.started.UTC(),
+		Uptime:      time.Since(o.started).Truncate(time.Second).String(),
+		StorageType: o.StorageType,
+		StoragePath: o.StoragePath,
+		Maintenance: InMaintenanceMode.Load(),
+		Debug:       InDebugMode.Load(),
+		Actors:      make(vocab.IRIs, 0),
+		Goroutines:  runtime.NumGoroutine(),
+	}
+	o.mu.Lock()
+	for _, a := range o.a {
+		st.Actors = append(st.Actors, a.ID)
+	}
+	o.mu.Unlock()
+	st.Queue.Pending, st.Queue.Dead = o.Queue().Count()
+	return st
+}
+
+// ServeStatus serves the runtime status of the server as JSON.
+func (o *oni) ServeStatus(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	_ = json.NewEncoder(w).Encode(o.Status())
+}
+
+type Status struct{}
+
+func (s Status) Run(ctl *Control) error {
+	st, err := ctl.sendControl(controlRequest{Command: cmdStatus})
+	if err != nil {
+		return err
+	}
+	_, _ = fmt.Fprintf(ctl.out, "Version:     %s\n", st.Version)
+	_, _ = fmt.Fprintf(ctl.out, "Uptime:      %s\n", st.Uptime)
+	_, _ = fmt.Fprintf(ctl.out, "Storage:     %s %s\n", st.StorageType, st.StoragePath)
+	_, _ = fmt.Fprintf(ctl.out, "Maintenance: %t\n", st.Maintenance)
+	_, _ = fmt.Fprintf(ctl.out, "Debug:       %t\n", st.Debug)
+	_, _ = fmt.Fprintf(ctl.out, "Goroutines:  %d\n", st.Goroutines)
+	_, _ = fmt.Fprintf(ctl.out, "Queue:       %d pending, %d dead\n", st.Queue.Pending, st.Queue.Dead)
+	for _, a := range st.Actors {
+		_, _ = fmt.Fprintf(ctl.out, "Actor:       %s\n", a)
+	}
+	return nil
+}
@@ -0,0 +1,211 @@
+package oni
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"git.sr.ht/~mariusor/lw"
+	"github.com/go-ap/errors"
+)
+
+// certCheckInterval is how often the certificate files are checked for changes, so the renewed
+// certificates are used without having to reload the server.
+const certCheckInterval = time.Minute
+
+// certFiles returns the certificate and key paths for "host" from "dir", which can be either
+// <host>.crt and <host>.key, or the <host>/fullchain.pem and <host>/privkey.pem used by certbot.
+func certFiles(dir, host string) (string, string) {
+	crt, key := filepath.Join(dir, host+".crt"), filepath.Join(dir, host+".key")
+	if _, err := os.Stat(crt); err == nil {
+		return crt, key
+	}
+	return filepath.Join(dir, host, "fullchain.pem"), filepath.Join(dir, host, "privkey.pem")
+}
+
+func modTime(paths ...string) time.Time {
+	latest := time.Time{}
+	for _, p := range paths {
+		if fi, err := os.Stat(p); err == nil && fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest
+}
+
+// certStore keeps the TLS certificates of the root actors' hosts, which are selected using SNI.
+type certStore struct {
+	dir   string
+	hosts func() []string
+	l     lw.Logger
+
+	mu      sync.RWMutex
+	certs   map[string]*tls.Certificate
+	modTime map[string]time.Time
+}
+
+func newCertStore(dir string, hosts func() []string, l lw.Logger) *certStore {
+	return &certStore{
+		dir:     dir,
+		hosts:   hosts,
+		l:       l,
+		certs:   make(map[string]*tls.Certificate),
+		modTime: make(map[string]time.Time),
+	}
+}
+
+// Load reads the certificates which have changed since they were last loaded.
+// A certificate which fails to load is logged, and the previous one is kept in use.
+func (s *certStore) Load() {
+	for _, host := range s.hosts() {
+		crtPath, keyPath := certFiles(s.dir, host)
+		mod := modTime(crtPath, keyPath)
+
+		s.mu.RLock()
+		prev, loaded := s.modTime[host]
+		s.mu.RUnlock()
+		if loaded && !mod.After(prev) {
+			continue
+		}
+
+		lctx := lw.Ctx{"host": host, "cert": crtPath}
+		cert, err := tls.LoadX509KeyPair(crtPath, keyPath)
+		if err != nil {
+			s.l.WithContext(lctx, lw.Ctx{"err": err.Error()}).Warnf("Unable to load TLS certificate")
+			continue
+		}
+		s.mu.Lock()
+		s.certs[host] = &cert
+		s.modTime[host] = mod
+		s.mu.Unlock()
+		s.l.WithContext(lctx).Debugf("Loaded TLS certificate")
+	}
+}
+
+// Watch reloads the certificates when their files change, until "ctx" is done.
+func (s *certStore) Watch(ctx context.Context) {
+	t := time.NewTicker(certCheckInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			s.Load()
+		}
+	}
+}
+
+func (s *certStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if cert, ok := s.certs[strings.ToLower(hello.ServerName)]; ok {
+		return cert, nil
+	}
+	// NOTE(marius): clients connecting by IP address don't send a server name
+	if hello.ServerName == "" && len(s.certs) == 1 {
+		for _, cert := range s.certs {
+			return cert, nil
+		}
+	}
+	return nil, errors.Newf("no TLS certificate for %q", hello.ServerName)
+}
+
+func (s *certStore) Config() *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: s.GetCertificate,
+		NextProtos:     []string{"h2", "http/1.1"},
+	}
+}
+
+// listenServer is an HTTP server on a listener we have opened ourselves, which, unlike the ones created by
+// the servermux package, can serve TLS with the certificates from the certStore.
+type listenServer struct {
+	*http.Server
+	l   net.Listener
+	tls bool
+}
+
+func (s listenServer) Start() error {
+	var err error
+	if s.tls {
+		err = s.Server.ServeTLS(s.l, "", "")
+	} else {
+		err = s.Server.Serve(s.l)
+	}
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+func (s listenServer) Stop(ctx context.Context) error {
+	return s.Server.Shutdown(ctx)
+}
+
+func (o *oni) tlsServer(listen string) (listenServer, error) {
+	l, err := net.Listen("tcp", listen)
+	if err != nil {
+		return listenServer{}, err
+	}
+	srv := &http.Server{Handler: o, TLSConfig: o.certs.Config()}
+	return listenServer{Server: srv, l: l, tls: true}, nil
+}
+
+// httpsRedirect redirects the plain HTTP requests to the same URL on the TLS socket listening on "tlsListen".
+func httpsRedirect(tlsListen string) http.HandlerFunc {
+	_, port, _ := net.SplitHostPort(tlsListen)
+	return func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	}
+}
+
+func (o *oni) redirectServer(listen, tlsListen string) (listenServer, error) {
+	l, err := net.Listen("tcp", listen)
+	if err != nil {
+		return listenServer{}, err
+	}
+	srv := &http.Server{Handler: httpsRedirect(tlsListen), ReadHeaderTimeout: 10 * time.Second}
+	return listenServer{Server: srv, l: l}, nil
+}
+
+// rootHosts returns the hosts of the root actors, which need TLS certificates.
+func (o *oni) rootHosts() []string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	hosts := make([]string, 0, len(o.a))
+	for _, a := range o.a {
+		if u, err := a.ID.URL(); err == nil && u.Hostname() != "" {
+			hosts = append(hosts, strings.ToLower(u.Hostname()))
+		}
+	}
+	return hosts
+}
+
+// WithTLS enables serving TLS on the TCP sockets, with the certificates of the root actors' hosts found in "certDir".
+// If "redirectListen" is set, a plain HTTP socket is opened there, which redirects the requests to HTTPS.
+func WithTLS(certDir, redirectListen string) optionFn {
+	return func(o *oni) {
+		if certDir == "" {
+			return
+		}
+		o.certs = newCertStore(certDir, o.rootHosts, o.Logger.WithContext(lw.Ctx{"log": "tls"}))
+		o.httpRedirect = redirectListen
+	}
+}
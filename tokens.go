@@ -0,0 +1,310 @@
+package oni
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"git.sr.ht/~mariusor/lw"
+	vocab "github.com/go-ap/activitypub"
+	"github.com/go-ap/errors"
+	"github.com/openshift/osin"
+)
+
+// tokenUser returns the IRI of the actor an OAuth2 token has been issued for.
+func tokenUser(ud any) vocab.IRI {
+	switch u := ud.(type) {
+	case vocab.IRI:
+		return u
+	case string:
+		return vocab.IRI(u)
+	case fmt.Stringer:
+		return vocab.IRI(u.String())
+	}
+	return ""
+}
+
+// accessExpired returns if the access token has expired, the ones with a negative expiration never expire.
+func accessExpired(ad *osin.AccessData, t time.Time) bool {
+	return ad.ExpiresIn > 0 && ad.IsExpiredAt(t)
+}
+
+func authorizeExpired(a *osin.AuthorizeData, t time.Time) bool {
+	return a.ExpiresIn > 0 && a.IsExpiredAt(t)
+}
+
+func clientID(cl osin.Client) string {
+	if cl == nil {
+		return ""
+	}
+	return cl.GetId()
+}
+
+func (c *Control) tokenLister() (TokenLister, error) {
+	tl, ok := storageAs[TokenLister](c.Storage)
+	if !ok {
+		return nil, errors.NotImplementedf("the storage backend can't list OAuth2 tokens")
+	}
+	return tl, nil
+}
+
+// ListTokens returns the access tokens, for the actor "of" if it's not empty.
+func (c *Control) ListTokens(of vocab.IRI) ([]*osin.AccessData, error) {
+	tl, err := c.tokenLister()
+	if err != nil {
+		return nil, err
+	}
+	all, err := tl.ListAccess()
+	if err != nil {
+		return nil, errors.Annotatef(err, "unable to list OAuth2 access tokens")
+	}
+	if of == "" {
+		return all, nil
+	}
+	tokens := make([]*osin.AccessData, 0, len(all))
+	for _, ad := range all {
+		if tokenUser(ad.UserData).Equals(of, true) {
+			tokens = append(tokens, ad)
+		}
+	}
+	return tokens, nil
+}
+
+// RevokeAccess removes the access token, and the refresh token which was issued with it.
+func (c *Control) RevokeAccess(ad *osin.AccessData) error {
+	if err := c.Storage.RemoveAccess(ad.AccessToken); err != nil && !errors.IsNotFound(err) {
+		return errors.Annotatef(err, "unable to remove access token")
+	}
+	if ad.RefreshToken != "" {
+		if err := c.Storage.RemoveRefresh(ad.RefreshToken); err != nil && !errors.IsNotFound(err) {
+			return errors.Annotatef(err, "unable to remove refresh token")
+		}
+	}
+	return nil
+}
+
+// RevokeClient removes all the access tokens and authorization codes issued to the client with "id".
+func (c *Control) RevokeClient(id string) (int, error) {
+	tl, err := c.tokenLister()
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	accesses, err := tl.ListAccess()
+	if err != nil {
+		return count, errors.Annotatef(err, "unable to list OAuth2 access tokens")
+	}
+	for _, ad := range accesses {
+		if clientID(ad.Client) != id {
+			continue
+		}
+		if err = c.RevokeAccess(ad); err != nil {
+			return count, err
+		}
+		count++
+	}
+	authorizations, err := tl.ListAuthorize()
+	if err != nil {
+		return count, errors.Annotatef(err, "unable to list OAuth2 authorizations")
+	}
+	for _, a := range authorizations {
+		if clientID(a.Client) != id {
+			continue
+		}
+		if err = c.Storage.RemoveAuthorize(a.Code); err != nil {
+			return count, errors.Annotatef(err, "unable to remove authorization code")
+		}
+		count++
+	}
+	return count, nil
+}
+
+// PruneExpired removes the expired access tokens and authorization codes.
+func (c *Control) PruneExpired() (int, error) {
+	tl, err := c.tokenLister()
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now()
+	count := 0
+	accesses, err := tl.ListAccess()
+	if err != nil {
+		return count, errors.Annotatef(err, "unable to list OAuth2 access tokens")
+	}
+	for _, ad := range accesses {
+		if !accessExpired(ad, now) {
+			continue
+		}
+		if err = c.RevokeAccess(ad); err != nil {
+			return count, err
+		}
+		count++
+	}
+	authorizations, err := tl.ListAuthorize()
+	if err != nil {
+		return count, errors.Annotatef(err, "unable to list OAuth2 authorizations")
+	}
+	for _, a := range authorizations {
+		if !authorizeExpired(a, now) {
+			continue
+		}
+		if err = c.Storage.RemoveAuthorize(a.Code); err != nil {
+			return count, errors.Annotatef(err, "unable to remove authorization code")
+		}
+		count++
+	}
+	return count, nil
+}
+
+// loadToken loads the access data for either an access or a refresh token,
+// trying first the type the client has hinted at.
+func (c *Control) loadToken(token, hint string) (*osin.AccessData, error) {
+	loaders := []func(string) (*osin.AccessData, error){c.Storage.LoadAccess, c.Storage.LoadRefresh}
+	if hint == "refresh_token" {
+		loaders[0], loaders[1] = loaders[1], loaders[0]
+	}
+	var err error
+	for _, load := range loaders {
+		var ad *osin.AccessData
+		if ad, err = load(token); err == nil && ad != nil {
+			return ad, nil
+		}
+	}
+	return nil, err
+}
+
+// authenticateClient checks the client credentials from the HTTP Basic authorization of the request.
+func (o *oni) authenticateClient(r *http.Request) (osin.Client, error) {
+	ba, err := osin.CheckBasicAuth(r)
+	if err != nil || ba == nil {
+		return nil, errors.Unauthorizedf("client authentication is required")
+	}
+	return o.checkClient("token", ba.Username, ba.Password, r.RemoteAddr)
+}
+
+// checkClient checks the secret of the client with "id", with the attempts made from "addr" limited
+// the same way as the ones for the actor passwords.
+func (o *oni) checkClient(method, id, secret, addr string) (osin.Client, error) {
+	var cl osin.Client
+	err := o.checkPassword(method, vocab.IRI(id), addr, func() error {
+		c, err := o.clientStorage().GetClient(id)
+		if err != nil || c == nil || !osin.CheckClientSecret(c, secret) {
+			return errors.Unauthorizedf("invalid client credentials")
+		}
+		cl = c
+		return nil
+	})
+	return cl, err
+}
+
+// clientCredentials returns the credentials the client has sent, from where the OAuth2 server would read them.
+func clientCredentials(r *http.Request, allowParams bool) *osin.BasicAuth {
+	if _, ok := r.Form["client_secret"]; allowParams && ok && r.FormValue("client_id") != "" {
+		return &osin.BasicAuth{Username: r.FormValue("client_id"), Password: r.FormValue("client_secret")}
+	}
+	if ba, err := osin.CheckBasicAuth(r); err == nil {
+		return ba
+	}
+	return nil
+}
+
+// clientCanManage returns if the client "cl" can inspect or revoke the token "ad".
+// Besides its own tokens, the client of the root actor can manage the ones issued for the root actor,
+// or for the actors under it.
+func (o *oni) clientCanManage(cl osin.Client, ad *osin.AccessData, oniActor vocab.Actor) bool {
+	if clientID(ad.Client) == cl.GetId() {
+		return true
+	}
+	u, err := oniActor.ID.URL()
+	if err != nil || cl.GetId() != string(uriRootIRI(u)) {
+		return false
+	}
+	user := tokenUser(ad.UserData)
+	if user == "" {
+		return false
+	}
+	return user.Equals(oniActor.ID, true) ||
+		strings.HasPrefix(user.String(), strings.TrimRight(oniActor.ID.String(), "/")+"/")
+}
+
+func (o *oni) outputClientError(w http.ResponseWriter, r *http.Request, err error) {
+	resp := authServer(o).NewResponse()
+	resp.Type = osin.DATA
+	resp.SetError(osin.E_INVALID_CLIENT, err.Error())
+	if !setLockedOut(resp, err) {
+		resp.StatusCode = http.StatusUnauthorized
+	}
+	resp.Headers.Set("WWW-Authenticate", `Basic realm="oauth"`)
+	o.redirectOrOutput(resp, w, r)
+}
+
+// tokenIntrospection is the RFC 7662 introspection response.
+//
+// https://datatracker.ietf.org/doc/html/rfc7662#section-2.2
+type tokenIntrospection struct {
+	Active    bool   `json:"active"`
+	Scope     string `json:"scope,omitempty"`
+	ClientID  string `json:"client_id,omitempty"`
+	Username  string `json:"username,omitempty"`
+	TokenType string `json:"token_type,omitempty"`
+	Exp       int64  `json:"exp,omitempty"`
+	Iat       int64  `json:"iat,omitempty"`
+	Sub       string `json:"sub,omitempty"`
+	Iss       string `json:"iss,omitempty"`
+}
+
+// IntrospectToken is the RFC 7662 token introspection end-point.
+// The tokens which are invalid, expired or belong to other clients are reported as not active.
+func (o *oni) IntrospectToken(w http.ResponseWriter, r *http.Request) {
+	oniActor := o.oniActor(r)
+	cl, err := o.authenticateClient(r)
+	if err != nil {
+		o.outputClientError(w, r, err)
+		return
+	}
+
+	res := tokenIntrospection{}
+	ad, err := o.loadToken(r.PostFormValue("token"), r.PostFormValue("token_type_hint"))
+	if err == nil && !accessExpired(ad, time.Now()) && o.clientCanManage(cl, ad, oniActor) {
+		user := tokenUser(ad.UserData)
+		res = tokenIntrospection{
+			Active:    true,
+			Scope:     ad.Scope,
+			ClientID:  clientID(ad.Client),
+			Username:  user.String(),
+			TokenType: DefaultConfig.TokenType,
+			Iat:       ad.CreatedAt.Unix(),
+			Sub:       user.String(),
+			Iss:       oniActor.ID.String(),
+		}
+		if ad.ExpiresIn > 0 {
+			res.Exp = ad.ExpireAt().Unix()
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	_ = json.NewEncoder(w).Encode(res)
+}
+
+// RevokeToken is the RFC 7009 token revocation end-point.
+// As the RFC requires, revoking an invalid token is not an error.
+func (o *oni) RevokeToken(w http.ResponseWriter, r *http.Request) {
+	oniActor := o.oniActor(r)
+	cl, err := o.authenticateClient(r)
+	if err != nil {
+		o.outputClientError(w, r, err)
+		return
+	}
+
+	ad, err := o.loadToken(r.PostFormValue("token"), r.PostFormValue("token_type_hint"))
+	if err == nil && o.clientCanManage(cl, ad, oniActor) {
+		if err = o.RevokeAccess(ad); err != nil {
+			o.Error(err).ServeHTTP(w, r)
+			return
+		}
+		o.Logger.WithContext(lw.Ctx{"client": clientID(ad.Client), "by": cl.GetId()}).Infof("Revoked OAuth2 token")
+	}
+	w.WriteHeader(http.StatusOK)
+}
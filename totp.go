@@ -0,0 +1,305 @@
+package oni
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	vocab "github.com/go-ap/activitypub"
+	"github.com/go-ap/errors"
+	"golang.org/x/crypto/bcrypt"
+	"rsc.io/qr"
+)
+
+const (
+	totpDigits = 6
+	totpPeriod = 30
+	// totpSkew is the number of periods before and after the current one for which we accept the codes,
+	// to allow for clock drift and for the time it takes to type them.
+	totpSkew = 1
+
+	recoveryCodeCount = 10
+
+	// secondFactorTimeout is how long the login page waits for the second factor after a correct password.
+	secondFactorTimeout = 5 * time.Minute
+)
+
+var (
+	errTOTPEnabled    = errors.Newf("two-factor authentication is already enabled")
+	errTOTPNotEnabled = errors.Newf("two-factor authentication is not enabled")
+	errInvalidOTP     = errors.Unauthorizedf("invalid authentication code")
+
+	// NOTE(marius): the codes are checked and marked as used in the actor's metadata,
+	// and we don't want two concurrent logins to use the same one.
+	secondFactorMu sync.Mutex
+)
+
+var base32NoPadding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// totpCode returns the RFC 6238 code for the time "step", using HMAC-SHA1 as most authenticator apps expect.
+//
+// https://datatracker.ietf.org/doc/html/rfc6238
+func totpCode(secret []byte, step int64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	// NOTE(marius): this is the dynamic truncation from RFC 4226
+	off := sum[len(sum)-1] & 0x0f
+	bin := binary.BigEndian.Uint32(sum[off:off+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, bin%1_000_000)
+}
+
+func totpStep(t time.Time) int64 {
+	return t.Unix() / totpPeriod
+}
+
+// validTOTP returns the time step for which "code" is valid, if it's newer than the "last" one used.
+func validTOTP(secret []byte, code string, last int64, t time.Time) (int64, bool) {
+	now := totpStep(t)
+	for step := now - totpSkew; step <= now+totpSkew; step++ {
+		if step <= last {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(totpCode(secret, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// totpURI returns the otpauth URI which the authenticator apps use to add the account.
+//
+// https://github.com/google/google-authenticator/wiki/Key-Uri-Format
+func totpURI(secret []byte, actor vocab.Actor) string {
+	issuer := actor.ID.String()
+	if u, err := actor.ID.URL(); err == nil {
+		issuer = u.Host
+	}
+	account := issuer
+	if name := actor.PreferredUsername.First().String(); name != "" {
+		account = name
+	}
+	q := url.Values{}
+	q.Set("secret", base32NoPadding.EncodeToString(secret))
+	q.Set("issuer", issuer)
+	q.Set("algorithm", "SHA1")
+	q.Set("digits", fmt.Sprintf("%d", totpDigits))
+	q.Set("period", fmt.Sprintf("%d", totpPeriod))
+	u := url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + issuer + ":" + account,
+		RawQuery: q.Encode(),
+	}
+	return u.String()
+}
+
+// printQR writes "text" as a QR code using Unicode half blocks, so each line holds two rows of the code.
+// NOTE(marius): the light modules are drawn with blocks, which works for the terminals with a dark background.
+func printQR(w io.Writer, text string) error {
+	code, err := qr.Encode(text, qr.M)
+	if err != nil {
+		return err
+	}
+	const quiet = 2
+	light := func(x, y int) bool {
+		return !code.Black(x, y)
+	}
+	for y := -quiet; y < code.Size+quiet; y += 2 {
+		line := strings.Builder{}
+		for x := -quiet; x < code.Size+quiet; x++ {
+			top, bottom := light(x, y), light(x, y+1)
+			switch {
+			case top && bottom:
+				line.WriteString("█")
+			case top:
+				line.WriteString("▀")
+			case bottom:
+				line.WriteString("▄")
+			default:
+				line.WriteString(" ")
+			}
+		}
+		if _, err = fmt.Fprintln(w, line.String()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// normalizeRecoveryCode removes the separators and spaces people might type along with a recovery code.
+func normalizeRecoveryCode(code string) string {
+	return strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+// newRecoveryCodes returns the one-time recovery codes, and their hashes which get saved in the actor's metadata.
+func newRecoveryCodes() ([]string, [][]byte, error) {
+	codes := make([]string, 0, recoveryCodeCount)
+	hashes := make([][]byte, 0, recoveryCodeCount)
+	for range recoveryCodeCount {
+		code := rand.Text()[:10]
+		hash, err := bcrypt.GenerateFromPassword([]byte(code), bcrypt.DefaultCost)
+		if err != nil {
+			return nil, nil, err
+		}
+		codes = append(codes, code[:5]+"-"+code[5:])
+		hashes = append(hashes, hash)
+	}
+	return codes, hashes, nil
+}
+
+// TOTPEnabled returns if the actor with "iri" needs a second factor to authenticate.
+func (c *Control) TOTPEnabled(iri vocab.IRI) bool {
+	m := new(Metadata)
+	if err := c.Storage.LoadMetadata(iri, m); err != nil {
+		return false
+	}
+	return len(m.TOTPSecret) > 0
+}
+
+// EnableTOTP generates the TOTP secret and the recovery codes for the actor with "iri".
+func (c *Control) EnableTOTP(iri vocab.IRI) ([]byte, []string, error) {
+	m := new(Metadata)
+	if err := c.Storage.LoadMetadata(iri, m); err != nil && !errors.IsNotFound(err) {
+		return nil, nil, err
+	}
+	if len(m.TOTPSecret) > 0 {
+		return nil, nil, errTOTPEnabled
+	}
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, nil, err
+	}
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, nil, err
+	}
+	m.TOTPSecret = secret
+	m.TOTPLastStep = 0
+	m.RecoveryCodes = hashes
+	if err = c.Storage.SaveMetadata(iri, m); err != nil {
+		return nil, nil, err
+	}
+	return secret, codes, nil
+}
+
+// DisableTOTP removes the TOTP secret and the recovery codes of the actor with "iri".
+func (c *Control) DisableTOTP(iri vocab.IRI) error {
+	m := new(Metadata)
+	if err := c.Storage.LoadMetadata(iri, m); err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	if len(m.TOTPSecret) == 0 {
+		return errTOTPNotEnabled
+	}
+	m.TOTPSecret = nil
+	m.TOTPLastStep = 0
+	m.RecoveryCodes = nil
+	return c.Storage.SaveMetadata(iri, m)
+}
+
+// NewRecoveryCodes replaces the recovery codes of the actor with "iri".
+func (c *Control) NewRecoveryCodes(iri vocab.IRI) ([]string, error) {
+	m := new(Metadata)
+	if err := c.Storage.LoadMetadata(iri, m); err != nil && !errors.IsNotFound(err) {
+		return nil, err
+	}
+	if len(m.TOTPSecret) == 0 {
+		return nil, errTOTPNotEnabled
+	}
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	m.RecoveryCodes = hashes
+	return codes, c.Storage.SaveMetadata(iri, m)
+}
+
+// CheckSecondFactor checks "code" against the TOTP secret of the actor with "iri", and if it doesn't match,
+// against its recovery codes. Neither the TOTP codes, nor the recovery codes can be used twice.
+func (c *Control) CheckSecondFactor(iri vocab.IRI, code string) error {
+	secondFactorMu.Lock()
+	defer secondFactorMu.Unlock()
+
+	m := new(Metadata)
+	if err := c.Storage.LoadMetadata(iri, m); err != nil {
+		return err
+	}
+	if len(m.TOTPSecret) == 0 {
+		return errTOTPNotEnabled
+	}
+	code = strings.TrimSpace(code)
+	if code == "" {
+		return errInvalidOTP
+	}
+	if step, ok := validTOTP(m.TOTPSecret, code, m.TOTPLastStep, time.Now()); ok {
+		m.TOTPLastStep = step
+		return c.Storage.SaveMetadata(iri, m)
+	}
+	code = normalizeRecoveryCode(code)
+	for i, hash := range m.RecoveryCodes {
+		if bcrypt.CompareHashAndPassword(hash, []byte(code)) != nil {
+			continue
+		}
+		m.RecoveryCodes = append(m.RecoveryCodes[:i], m.RecoveryCodes[i+1:]...)
+		return c.Storage.SaveMetadata(iri, m)
+	}
+	return errInvalidOTP
+}
+
+// secondFactorChallenges keeps the logins which passed the password step of the login page,
+// and are waiting for the second factor.
+type secondFactorChallenges struct {
+	mu      sync.Mutex
+	pending map[string]pendingLogin
+}
+
+type pendingLogin struct {
+	actor   vocab.IRI
+	expires time.Time
+}
+
+func newSecondFactorChallenges() *secondFactorChallenges {
+	return &secondFactorChallenges{pending: make(map[string]pendingLogin)}
+}
+
+// Add returns the token identifying the login of "actor" in the second step.
+func (s *secondFactorChallenges) Add(actor vocab.IRI) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for tok, p := range s.pending {
+		if now.After(p.expires) {
+			delete(s.pending, tok)
+		}
+	}
+	tok := rand.Text()
+	s.pending[tok] = pendingLogin{actor: actor, expires: now.Add(secondFactorTimeout)}
+	return tok
+}
+
+// Take returns the actor of the login identified by "tok", which can be used only once.
+func (s *secondFactorChallenges) Take(tok string) (vocab.IRI, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, ok := s.pending[tok]
+	if !ok {
+		return "", false
+	}
+	delete(s.pending, tok)
+	return p.actor, time.Now().Before(p.expires)
+}
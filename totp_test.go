@@ -0,0 +1,66 @@
+package oni
+
+import (
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the SHA1 secret of the RFC 6238 test vectors.
+var rfc6238Secret = []byte("12345678901234567890")
+
+func Test_totpCode(t *testing.T) {
+	// NOTE(marius): the RFC 6238 test vectors have 8 digits, and the 6 digit codes are their last 6 digits
+	//
+	// https://datatracker.ietf.org/doc/html/rfc6238#appendix-B
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{unix: 59, want: "287082"},
+		{unix: 1111111109, want: "081804"},
+		{unix: 1111111111, want: "050471"},
+		{unix: 1234567890, want: "005924"},
+		{unix: 2000000000, want: "279037"},
+		{unix: 20000000000, want: "353130"},
+	}
+	for _, tt := range tests {
+		t.Run(time.Unix(tt.unix, 0).UTC().Format(time.RFC3339), func(t *testing.T) {
+			if got := totpCode(rfc6238Secret, totpStep(time.Unix(tt.unix, 0))); got != tt.want {
+				t.Errorf("totpCode() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_validTOTP(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	step := totpStep(now)
+	tests := []struct {
+		name     string
+		code     string
+		last     int64
+		wantStep int64
+		wantOK   bool
+	}{
+		{name: "current code", code: totpCode(rfc6238Secret, step), last: 0, wantStep: step, wantOK: true},
+		{name: "previous code", code: totpCode(rfc6238Secret, step-1), last: 0, wantStep: step - 1, wantOK: true},
+		{name: "next code", code: totpCode(rfc6238Secret, step+1), last: 0, wantStep: step + 1, wantOK: true},
+		{name: "code outside the skew", code: totpCode(rfc6238Secret, step-totpSkew-1), last: 0},
+		{name: "replayed code", code: totpCode(rfc6238Secret, step), last: step},
+		{name: "code older than the last one used", code: totpCode(rfc6238Secret, step-1), last: step},
+		{name: "code newer than the last one used", code: totpCode(rfc6238Secret, step+1), last: step, wantStep: step + 1, wantOK: true},
+		{name: "wrong code", code: "000000", last: 0},
+		{name: "empty code", code: "", last: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := validTOTP(rfc6238Secret, tt.code, tt.last, now)
+			if ok != tt.wantOK {
+				t.Fatalf("validTOTP() valid = %t, want %t", ok, tt.wantOK)
+			}
+			if got != tt.wantStep {
+				t.Errorf("validTOTP() step = %d, want %d", got, tt.wantStep)
+			}
+		})
+	}
+}
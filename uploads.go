@@ -0,0 +1,270 @@
+package oni
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"git.sr.ht/~mariusor/lw"
+	ct "github.com/elnormous/contenttype"
+	vocab "github.com/go-ap/activitypub"
+	"github.com/go-ap/errors"
+	"github.com/go-ap/jsonld"
+	"github.com/go-ap/processing"
+)
+
+// DefaultMaxBodySize is the limit for the bodies of the POST requests when none is configured.
+// It needs to take into account that the media files are base64 encoded, which makes them a third larger.
+const DefaultMaxBodySize ByteSize = 40 << 20
+
+// ByteSize is a size in bytes, which can be written in the configuration file as a number,
+// or as a string with one of the KB, MB or GB suffixes.
+type ByteSize int64
+
+var byteSizeUnits = []struct {
+	suffix string
+	size   ByteSize
+}{
+	{"GB", 1 << 30},
+	{"MB", 1 << 20},
+	{"KB", 1 << 10},
+	{"B", 1},
+}
+
+func (s *ByteSize) UnmarshalText(text []byte) error {
+	val := strings.ToUpper(strings.TrimSpace(string(text)))
+	mul := ByteSize(1)
+	for _, u := range byteSizeUnits {
+		if strings.HasSuffix(val, u.suffix) {
+			val, mul = strings.TrimSpace(strings.TrimSuffix(val, u.suffix)), u.size
+			break
+		}
+	}
+	n, err := strconv.ParseInt(val, 10, 64)
+	if err != nil || n < 0 {
+		return errors.Newf("invalid size %q", text)
+	}
+	*s = ByteSize(n) * mul
+	return nil
+}
+
+func (s ByteSize) String() string {
+	for _, u := range byteSizeUnits {
+		if s >= u.size && s%u.size == 0 {
+			return fmt.Sprintf("%d%s", s/u.size, u.suffix)
+		}
+	}
+	return fmt.Sprintf("%dB", int64(s))
+}
+
+func (u UploadsConfig) maxBodySize() ByteSize {
+	if u.MaxBodySize > 0 {
+		return u.MaxBodySize
+	}
+	return DefaultMaxBodySize
+}
+
+// maxMediaSize returns the size limit for "mediaType", first by its full value and then by its type.
+// A zero value means the media is limited only by the size of the request body.
+func (u UploadsConfig) maxMediaSize(mediaType ct.MediaType) ByteSize {
+	if s, ok := u.MaxMediaSize[mediaType.Type+"/"+mediaType.Subtype]; ok {
+		return s
+	}
+	return u.MaxMediaSize[mediaType.Type]
+}
+
+// uploadError is a failed validation of an uploaded media file, which needs to be reported with an HTTP
+// status that the errors package doesn't know about.
+type uploadError struct {
+	status int
+	msg    string
+}
+
+func (e uploadError) Error() string {
+	return e.msg
+}
+
+func uploadErrorf(status int, s string, args ...any) error {
+	return uploadError{status: status, msg: fmt.Sprintf(s, args...)}
+}
+
+// sniffableTypes are the media types http.DetectContentType always recognizes from the contents of a file,
+// for which a generic result means that the contents don't match.
+// NOTE(marius): MP3 files are recognized only when they start with an ID3 tag, and M4A ones only for some brands,
+// so they're not in the list.
+var sniffableTypes = []string{
+	"image/bmp", "image/gif", "image/jpeg", "image/png", "image/webp", "image/x-icon",
+	"audio/aiff", "audio/midi", "audio/ogg", "audio/wave", "audio/webm",
+	"video/avi", "video/mp4", "video/ogg", "video/webm",
+	"application/ogg", "application/pdf",
+}
+
+// subtypeAliases are the other subtypes in use for the same formats, and the ones the sniffing algorithm returns for them.
+var subtypeAliases = map[string]string{
+	"wav": "wave", "x-wav": "wave", "vnd.wave": "wave",
+	"mp3": "mpeg", "mpeg3": "mpeg", "x-mp3": "mpeg", "x-mpeg": "mpeg", "x-mpeg3": "mpeg",
+	"x-aiff": "aiff", "aif": "aiff",
+	"mid": "midi", "x-midi": "midi",
+	"x-m4a": "mp4", "m4a": "mp4",
+	"opus": "ogg", "vorbis": "ogg",
+	"msvideo": "avi", "x-msvideo": "avi",
+	"jpg": "jpeg", "pjpeg": "jpeg",
+	"x-png": "png",
+	"x-bmp": "bmp", "x-ms-bmp": "bmp",
+	"vnd.microsoft.icon": "x-icon",
+}
+
+// canonicalType returns the lower case type and subtype of "t", with the subtype aliases replaced.
+func canonicalType(t ct.MediaType) (string, string) {
+	typ, sub := strings.ToLower(t.Type), strings.ToLower(t.Subtype)
+	if alias, ok := subtypeAliases[sub]; ok {
+		sub = alias
+	}
+	return typ, sub
+}
+
+// sniffedMatches returns if the media type detected from the contents of a file is compatible with the declared one.
+// The sniffing algorithm doesn't recognize all the media types, so the generic results are accepted for the ones
+// it doesn't know about, and it doesn't distinguish between the audio and video in the same container format.
+func sniffedMatches(declared, sniffed ct.MediaType) bool {
+	declaredType, declaredSub := canonicalType(declared)
+	sniffedType, sniffedSub := canonicalType(sniffed)
+	switch sniffedType + "/" + sniffedSub {
+	case "application/octet-stream", "text/plain", "text/xml":
+		return !slices.Contains(sniffableTypes, declaredType+"/"+declaredSub)
+	}
+	if declaredSub != sniffedSub {
+		return false
+	}
+	if declaredType == sniffedType {
+		return true
+	}
+	containers := []string{"application", "audio", "video"}
+	return slices.Contains(containers, declaredType) && slices.Contains(containers, sniffedType)
+}
+
+func (u UploadsConfig) validateMedia(ob *vocab.Object) error {
+	declared, r := dataURIReader(ob.Content.First(), ob.MediaType)
+	if ob.MediaType != "" && !strings.EqualFold(string(ob.MediaType), declared) {
+		return uploadErrorf(http.StatusUnsupportedMediaType, "the mediaType %q of %s doesn't match the data URI type %q", ob.MediaType, ob.ID, declared)
+	}
+	declaredType, err := ct.ParseMediaType(declared)
+	if err != nil {
+		return uploadErrorf(http.StatusUnsupportedMediaType, "invalid media type %q for %s", declared, ob.ID)
+	}
+
+	size, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return uploadErrorf(http.StatusUnprocessableEntity, "invalid data URI for %s", ob.ID)
+	}
+	if limit := u.maxMediaSize(declaredType); limit > 0 && ByteSize(size) > limit {
+		return uploadErrorf(http.StatusRequestEntityTooLarge, "%s is larger than the %s limit for %s files", ob.ID, limit, declared)
+	}
+
+	head := make([]byte, 512)
+	if _, err = r.Seek(0, io.SeekStart); err != nil {
+		return uploadErrorf(http.StatusUnprocessableEntity, "invalid data URI for %s", ob.ID)
+	}
+	n, err := io.ReadFull(r, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return uploadErrorf(http.StatusUnprocessableEntity, "invalid data URI for %s", ob.ID)
+	}
+	sniffed, _ := ct.ParseMediaType(http.DetectContentType(head[:n]))
+	if !sniffedMatches(declaredType, sniffed) {
+		return uploadErrorf(http.StatusUnsupportedMediaType, "the content of %s is %s, not %s", ob.ID, sniffed.Type+"/"+sniffed.Subtype, declared)
+	}
+	return nil
+}
+
+// validateUploads checks the media files uploaded in "it", and in the objects embedded in it,
+// against the size limits, their declared media types and the alt text policy of the actor.
+func (u UploadsConfig) validateUploads(it vocab.Item, requireAltText bool) error {
+	if vocab.IsNil(it) || vocab.IsIRI(it) {
+		return nil
+	}
+	if vocab.IsItemCollection(it) {
+		return vocab.OnItemCollection(it, func(col *vocab.ItemCollection) error {
+			for _, ob := range *col {
+				if err := u.validateUploads(ob, requireAltText); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+	if vocab.ActivityTypes.Match(it.GetType()) {
+		return vocab.OnActivity(it, func(act *vocab.Activity) error {
+			return u.validateUploads(act.Object, requireAltText)
+		})
+	}
+	return vocab.OnObject(it, func(ob *vocab.Object) error {
+		if bytes.HasPrefix(ob.Content.First(), []byte("data:")) {
+			if err := u.validateMedia(ob); err != nil {
+				return err
+			}
+			needsAlt := ob.Type == vocab.ImageType || ob.Type == vocab.VideoType
+			if requireAltText && needsAlt && len(ob.Name) == 0 && len(ob.Summary) == 0 {
+				return uploadErrorf(http.StatusUnprocessableEntity, "%s %s needs a description in its name or summary", ob.Type, ob.ID)
+			}
+		}
+		for _, embedded := range []vocab.Item{ob.Attachment, ob.Icon, ob.Image, ob.Preview} {
+			if err := u.validateUploads(embedded, requireAltText); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func writeUploadError(w http.ResponseWriter, status int, err error) {
+	dat, _ := jsonld.Marshal(struct {
+		Errors []errors.Http `jsonld:"errors"`
+	}{Errors: []errors.Http{{Code: status, Message: err.Error()}}})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(dat)
+}
+
+// ValidateUploads limits the size of the bodies of the POST requests, and for the outbox ones it validates
+// the uploaded media files before they reach the activity processing.
+func (o *oni) ValidateUploads(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit := o.config().Uploads.maxBodySize()
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, int64(limit)))
+		if err != nil {
+			mbe := new(http.MaxBytesError)
+			if errors.As(err, &mbe) {
+				writeUploadError(w, http.StatusRequestEntityTooLarge, errors.Newf("the request body is larger than the %s limit", limit))
+				return
+			}
+			errors.HandleError(errors.NewBadRequest(err, "unable to read request body")).ServeHTTP(w, r)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		if processing.Typer.Type(r) != vocab.Outbox {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// NOTE(marius): the invalid JSON documents are reported by the activity processing
+		it, err := vocab.UnmarshalJSON(body)
+		if err != nil || vocab.IsNil(it) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cfg := o.config()
+		requireAltText := cfg.Actor(o.oniActor(r).ID).RequireAltText
+		if err = cfg.Uploads.validateUploads(it, requireAltText); err != nil {
+			ue := uploadError{status: http.StatusBadRequest, msg: err.Error()}
+			_ = errors.As(err, &ue)
+			o.Logger.WithContext(lw.Ctx{"iri": irif(r), "status": ue.status, "err": ue.msg}).Warnf("Rejected upload")
+			writeUploadError(w, ue.status, ue)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,62 @@
+package oni
+
+import (
+	"net/http"
+	"testing"
+
+	ct "github.com/elnormous/contenttype"
+)
+
+func Test_sniffedMatches(t *testing.T) {
+	wav := []byte("RIFF\x24\x00\x00\x00WAVEfmt \x10\x00\x00\x00\x01\x00\x01\x00")
+	mp3 := []byte("ID3\x04\x00\x00\x00\x00\x00\x00")
+	pngData := append([]byte{}, pngSignature...)
+
+	tests := []struct {
+		name     string
+		declared string
+		sniffed  string
+		data     []byte
+		want     bool
+	}{
+		{name: "same type", declared: "image/png", sniffed: "image/png", want: true},
+		{name: "different type", declared: "image/png", sniffed: "image/gif", want: false},
+		{name: "png data declared as jpeg", declared: "image/jpeg", data: pngData, want: false},
+		{name: "wav", declared: "audio/wav", data: wav, want: true},
+		{name: "x-wav", declared: "audio/x-wav", data: wav, want: true},
+		{name: "wave", declared: "audio/wave", data: wav, want: true},
+		{name: "wav declared as mpeg", declared: "audio/mpeg", data: wav, want: false},
+		{name: "mp3", declared: "audio/mp3", data: mp3, want: true},
+		{name: "mpeg", declared: "audio/mpeg", data: mp3, want: true},
+		{name: "mp3 declared as wav", declared: "audio/wav", data: mp3, want: false},
+		{name: "upper case", declared: "AUDIO/X-WAV", data: wav, want: true},
+		{name: "jpg alias", declared: "image/jpg", sniffed: "image/jpeg", want: true},
+		{name: "opus in ogg", declared: "audio/opus", sniffed: "application/ogg", want: true},
+		{name: "audio in video container", declared: "audio/webm", sniffed: "video/webm", want: true},
+		{name: "unknown type sniffed as generic", declared: "audio/flac", sniffed: "application/octet-stream", want: true},
+		{name: "mp3 without ID3 sniffed as generic", declared: "audio/mp3", sniffed: "application/octet-stream", want: true},
+		{name: "sniffable type sniffed as generic", declared: "image/png", sniffed: "application/octet-stream", want: false},
+		{name: "sniffable alias sniffed as generic", declared: "audio/x-wav", sniffed: "application/octet-stream", want: false},
+		{name: "text declared as image", declared: "image/gif", sniffed: "text/plain", want: false},
+		{name: "image in application", declared: "application/png", sniffed: "image/png", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			declared, err := ct.ParseMediaType(tt.declared)
+			if err != nil {
+				t.Fatalf("invalid declared media type %q: %s", tt.declared, err)
+			}
+			sniffedType := tt.sniffed
+			if tt.data != nil {
+				sniffedType = http.DetectContentType(tt.data)
+			}
+			sniffed, err := ct.ParseMediaType(sniffedType)
+			if err != nil {
+				t.Fatalf("invalid sniffed media type %q: %s", sniffedType, err)
+			}
+			if got := sniffedMatches(declared, sniffed); got != tt.want {
+				t.Errorf("sniffedMatches(%s, %s) = %t, want %t", tt.declared, sniffedType, got, tt.want)
+			}
+		})
+	}
+}
@@ -134,7 +134,7 @@ func LoadIRI(db processing.ReadStore, what vocab.IRI, checkFns ...func(vocab.Ite
 }
 
 func (o *oni) loadActorFromStorage(checkFns ...func(vocab.Item) bool) (vocab.Item, error) {
-	for _, act := range o.a {
+	for _, act := range o.actors() {
 		var found *vocab.Actor
 		for _, fn := range checkFns {
 			if !fn(act) {
@@ -566,7 +566,7 @@ type ClientRegistrationResponse struct {
 	// instances of a client using the same "client_id".  This value is
 	// used by confidential clients to authenticate to the token
 	// endpoint, as described in OAuth 2.0 [RFC6749], Section 2.3.1.
-	ClientSecret string `json:"client_secret"`
+	ClientSecret string `json:"client_secret,omitempty"`
 
 	// IssuedAt OPTIONAL.  Time at which the client identifier was issued.  The
 	// time is represented as the number of seconds from
@@ -581,6 +581,36 @@ type ClientRegistrationResponse struct {
 	Expires int64 `json:"client_secret_expires_at"`
 }
 
+// clientURLs returns the name of the client, the URLs of its actor, and its cleaned up redirect URIs.
+// When the request doesn't have a client name, the host of the first redirect URI is used.
+func (c ClientRegistrationRequest) clientURLs() (string, vocab.ItemCollection, []string) {
+	name := c.ClientName
+	urls := make(vocab.ItemCollection, 0)
+
+	redirect := make([]string, 0, len(c.RedirectUris))
+	for _, redirectUrl := range c.RedirectUris {
+		u, err := url.ParseRequestURI(redirectUrl)
+		if err != nil {
+			continue
+		}
+		if cleanPath := path.Clean(u.Path); cleanPath != "." {
+			u.Path = cleanPath
+		}
+		if name == "" {
+			name = u.Host
+		}
+		curURL := u.String()
+
+		u.Path = ""
+		_ = urls.Append(vocab.IRI(u.String()), vocab.IRI(curURL))
+		redirect = append(redirect, curURL)
+	}
+	if c.ClientURI != "" {
+		urls = append(urls, vocab.IRI(c.ClientURI))
+	}
+	return name, urls, redirect
+}
+
 func HandleOAuthClientRegistration(o *oni) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
@@ -610,32 +640,12 @@ func HandleOAuthClientRegistration(o *oni) func(w http.ResponseWriter, r *http.R
 		var id string
 		var d osin.Client
 		var status int
+		// NOTE(marius): only the hashes of the secret and of the registration access token are stored,
+		// so they're returned only when the client is created
+		var secret, regToken string
 
 		now := TimeNow()
-		name := regReq.ClientName
-		urls := make(vocab.ItemCollection, 0)
-
-		redirect := make([]string, 0, len(regReq.RedirectUris))
-		for _, redirectUrl := range regReq.RedirectUris {
-			u, err := url.ParseRequestURI(redirectUrl)
-			if err != nil {
-				continue
-			}
-			if cleanPath := path.Clean(u.Path); cleanPath != "." {
-				u.Path = cleanPath
-			}
-			if name == "" {
-				name = u.Host
-			}
-			curURL := u.String()
-
-			u.Path = ""
-			_ = urls.Append(vocab.IRI(u.String()), vocab.IRI(curURL))
-			redirect = append(redirect, curURL)
-		}
-		if regReq.ClientURI != "" {
-			urls = append(urls, vocab.IRI(regReq.ClientURI))
-		}
+		name, urls, redirect := regReq.clientURLs()
 
 		clientID := self.GetLink().AddPath("client")
 		if regReq.SoftwareID != nil {
@@ -675,8 +685,7 @@ func HandleOAuthClientRegistration(o *oni) func(w http.ResponseWriter, r *http.R
 			}
 			status = http.StatusOK
 		} else {
-			// TODO(marius): use some valid pw generation here
-			pw := []byte(DefaultOAuth2ClientPw)
+			pw := []byte(GenerateSecret())
 
 			app, err := o.AddActorWithPassword(clientActor, pw, self)
 			if err != nil {
@@ -690,36 +699,41 @@ func HandleOAuthClientRegistration(o *oni) func(w http.ResponseWriter, r *http.R
 				}
 			}
 
-			// TODO(marius): allow for updates of the application actor with incoming parameters for Icon, Summary, samd.
-
 			id = app.GetID().String()
 			if id == "" {
 				o.Error(errors.Newf("invalid actor saved, id is null")).ServeHTTP(w, r)
 				return
 			}
 
-			// TODO(marius): add a local Client struct that implements Client and ClientSecretMatcher interfaces with bcrypt support
-			//   It could even be a struct composite from an activitypub.Application + secret and callback properties
 			userData, _ := json.Marshal(regReq)
-			d = &osin.DefaultClient{
-				Id:          id,
-				Secret:      string(pw),
-				RedirectUri: strings.Join(redirect, "\n"),
-				UserData:    userData,
+			cl, err := newClient(id, string(pw), strings.Join(redirect, "\n"), userData)
+			if err != nil {
+				o.Error(errors.Annotatef(err, "unable to hash OAuth2 client secret")).ServeHTTP(w, r)
+				return
 			}
-
-			if err = o.Storage.SaveClient(d); err != nil {
+			if err = o.Storage.SaveClient(cl); err != nil {
 				o.Error(errors.Newf("unable to save OAuth2 client application")).ServeHTTP(w, r)
 				return
 			}
+			if regToken, err = o.newRegistrationToken(app.GetID()); err != nil {
+				o.Error(errors.Annotatef(err, "unable to save the registration access token")).ServeHTTP(w, r)
+				return
+			}
+			d = cl
+			secret = string(pw)
 			status = http.StatusCreated
 		}
 
-		resp := ClientRegistrationResponse{
-			ClientID:     d.GetId(),
-			ClientSecret: d.GetSecret(),
-			IssuedAt:     clientActor.Published.Unix(),
-			Expires:      0,
+		resp := ClientInformationResponse{
+			ClientRegistrationResponse: ClientRegistrationResponse{
+				ClientID:     d.GetId(),
+				ClientSecret: secret,
+				IssuedAt:     clientActor.Published.Unix(),
+				Expires:      0,
+			},
+			ClientRegistrationRequest: regReq,
+			RegistrationClientURI:     registrationClientURI(self, clientActor.ID).String(),
+			RegistrationAccessToken:   regToken,
 		}
 		w.Header().Add("Content-Type", "application/json")
 		w.WriteHeader(status)
@@ -835,6 +849,10 @@ type OauthAuthorizationMetadata struct {
 	TokenEndpointAuthMethodsSupported          []string                 `json:"token_endpoint_auth_methods_supported,omitempty"`
 	TokenEndpointAuthSigningAlgValuesSupported []string                 `json:"token_endpoint_auth_signing_alg_values_supported,omitempty"`
 	RegistrationEndpoint                       string                   `json:"registration_endpoint"`
+	RevocationEndpoint                         string                   `json:"revocation_endpoint,omitempty"`
+	RevocationEndpointAuthMethodsSupported     []string                 `json:"revocation_endpoint_auth_methods_supported,omitempty"`
+	IntrospectionEndpoint                      string                   `json:"introspection_endpoint,omitempty"`
+	IntrospectionEndpointAuthMethodsSupported  []string                 `json:"introspection_endpoint_auth_methods_supported,omitempty"`
 	GrantTypesSupported                        []osin.AccessRequestType `json:"grant_types_supported,omitempty"`
 	ScopesSupported                            []string                 `json:"scopes_supported,omitempty"`
 	ResponseTypesSupported                     []string                 `json:"response_types_supported,omitempty"`
@@ -859,12 +877,17 @@ func HandleOauthAuthorizationServer(o *oni) func(w http.ResponseWriter, r *http.
 			return
 		}
 		meta := OauthAuthorizationMetadata{
-			Issuer:                            actor.ID.String(),
-			AuthorizationEndpoint:             actor.Endpoints.OauthAuthorizationEndpoint.GetID().String(),
-			TokenEndpoint:                     actor.Endpoints.OauthTokenEndpoint.GetID().String(),
-			GrantTypesSupported:               defaultGrantTypes(),
-			TokenEndpointAuthMethodsSupported: []string{"client_secret_basic"},
-			RegistrationEndpoint:              actor.ID.AddPath("oauth/client").String(),
+			Issuer:                                     actor.ID.String(),
+			AuthorizationEndpoint:                      actor.Endpoints.OauthAuthorizationEndpoint.GetID().String(),
+			TokenEndpoint:                              actor.Endpoints.OauthTokenEndpoint.GetID().String(),
+			GrantTypesSupported:                        defaultGrantTypes(),
+			ScopesSupported:                            Scopes,
+			TokenEndpointAuthMethodsSupported:          []string{"client_secret_basic"},
+			RegistrationEndpoint:                       actor.ID.AddPath("oauth/client").String(),
+			RevocationEndpoint:                         actor.ID.AddPath("oauth/revoke").String(),
+			IntrospectionEndpoint:                      actor.ID.AddPath("oauth/introspect").String(),
+			RevocationEndpointAuthMethodsSupported:     []string{"client_secret_basic"},
+			IntrospectionEndpointAuthMethodsSupported:  []string{"client_secret_basic"},
 			TokenEndpointAuthSigningAlgValuesSupported: []string{},
 			ResponseTypesSupported:                     nil,
 		}
@@ -887,7 +910,7 @@ func HandleHostMeta(o *oni) func(w http.ResponseWriter, r *http.Request) {
 				{
 					Rel:      "lrdd",
 					Type:     "application/xrd+json",
-					Template: fmt.Sprintf("https://%s/.well-known/node?resource={uri}", r.Host),
+					Template: fmt.Sprintf("%s://%s/.well-known/node?resource={uri}", requestScheme(r), r.Host),
 				},
 			},
 		}
@@ -1061,7 +1084,7 @@ type WebInfo struct {
 
 func reqBaseIRI(r http.Request, secure bool) vocab.IRI {
 	scheme := "http"
-	if secure || r.TLS != nil {
+	if secure || r.TLS != nil || r.URL.Scheme == "https" {
 		scheme = "https"
 	}
 	u := url.URL{